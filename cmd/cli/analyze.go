@@ -5,12 +5,14 @@ Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/asottile/dockerfile"
 	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
@@ -26,13 +28,23 @@ type analyzeCmd struct {
 	stdin                    io.Reader
 	stdout                   io.Writer
 	stderr                   io.Writer
-	username                 string
-	password                 string
+	registryOptions          registryOptions
 	dockerfile               string
+	target                   string
+	baseImage                string
 	subjectImageRef          string
+	subjectImage             string
 	subjectImageManifestFile string
+	subjectImageConfigFile   string
+	platforms                []string
 	lpmManifestArtifactRef   string
+	attach                   bool
+	signKey                  string
+	format                   string
 	output                   string
+
+	// signingKey is the key read from signKey.
+	signingKey *signingKey
 }
 
 func newAnalyzeCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
@@ -44,14 +56,22 @@ func newAnalyzeCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []s
 
 	cobraCmd := &cobra.Command{
 		Use:   "analyze",
-		Short: "TODO",
+		Short: "generate the lpm manifest of a subject image, attributing each layer to its base image or to the Dockerfile command that created it, and push it as a referrer of the image",
 		Example: `lpm analyze \
---username 						username \
---password 						password \
+[--username 					username] \
+[--password-stdin] \
 --subject-image-ref 			myregistry.myserver.io/myimage:latest (or myimage@digest) \
---dockerfile 					Dockerfile \
---subject-image-manifest 		subject-image-manifest.json \
+(or --subject-image 			oci-layout://path/to/layout[:tag] (or docker-archive://myimage.tar[:tag])) \
+[--dockerfile 					Dockerfile] \
+[--target 						final-stage-name (or stage index)] \
+[--base-image 					mcr.microsoft.com/mybaseimage:latest (or mybaseimage@digest)] \
+[--subject-image-manifest 		subject-image-manifest.json] \
+[--subject-image-config 		subject-image-config.json] \
+[--platform 					linux/amd64] \
 [--lpm-manifest-artifact-ref 	myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest)] \
+[--attach] \
+[--sign-key 					lpm-signing-key.pem] \
+[--format 						lpm|in-toto|slsa] \
 [--output 						lpm-output-copy.json]
 `,
 		RunE: func(_ *cobra.Command, args []string) error {
@@ -61,36 +81,70 @@ func newAnalyzeCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []s
 
 	f := cobraCmd.Flags()
 
-	var usernameLongFlag = "username"
-	f.StringVarP(&analyzeCmd.username, usernameLongFlag, "u", "", "username to use for authentication with the registry")
-	cobraCmd.MarkFlagRequired(usernameLongFlag)
-
-	// TODO add support for --password-stdin (reading password from stdin) for more secure password input.
-	var passwordLongFlag = "password"
-	f.StringVarP(&analyzeCmd.password, passwordLongFlag, "p", "", "password to use for authentication with the registry")
-	cobraCmd.MarkFlagRequired(passwordLongFlag)
+	addRegistryFlags(f, &analyzeCmd.registryOptions)
 
 	var dockerfileLongFlag = "dockerfile"
-	f.StringVarP(&analyzeCmd.dockerfile, dockerfileLongFlag, "d", "", "subject image's Dockerfile to use for generating layer provenance metadata")
-	cobraCmd.MarkFlagRequired(dockerfileLongFlag)
+	f.StringVarP(&analyzeCmd.dockerfile, dockerfileLongFlag, "d", "", "(optional) subject image's Dockerfile to use for generating layer provenance metadata (default: use the subject image config's history)")
+
+	f.StringVar(&analyzeCmd.target, "target", "", "(optional) name or index of the Dockerfile build stage that the subject image was built from (default: final stage)")
+
+	f.StringVar(&analyzeCmd.baseImage, "base-image", "", "(optional) base image reference whose layers are matched by digest against the subject image's layers to find the upstream layers (default: resolved from the Dockerfile's FROM command)")
 
-	var subjectImageRefLongFlag = "subject-image-ref"
-	f.StringVarP(&analyzeCmd.subjectImageRef, subjectImageRefLongFlag, "s", "", "subject image reference of the layer provenance metadata to be generated")
-	cobraCmd.MarkFlagRequired(subjectImageRefLongFlag)
+	f.StringVarP(&analyzeCmd.subjectImageRef, "subject-image-ref", "s", "", "subject image reference of the layer provenance metadata to be generated (required unless --subject-image is given)")
+
+	f.StringVar(&analyzeCmd.subjectImage, "subject-image", "", "subject image of the layer provenance metadata to be generated, which is a subject image reference, an OCI image layout (oci-layout://path[:tag]) or a \"docker save\" tarball (docker-archive://file.tar[:tag]) (required unless --subject-image-ref is given)")
 
 	var subjectImageManifestFileLongFlag = "subject-image-manifest"
-	f.StringVarP(&analyzeCmd.subjectImageManifestFile, subjectImageManifestFileLongFlag, "m", "", "subject image manifest to use for generating layer provenance metadata")
-	cobraCmd.MarkFlagRequired(subjectImageManifestFileLongFlag)
+	f.StringVarP(&analyzeCmd.subjectImageManifestFile, subjectImageManifestFileLongFlag, "m", "", "(optional) subject image manifest file to use for generating layer provenance metadata, for offline use (default: fetched from the registry using the subject image ref)")
+
+	f.StringVar(&analyzeCmd.subjectImageConfigFile, "subject-image-config", "", "(optional) subject image config whose history is used to attribute layers when no Dockerfile is given, or to tell whether ambiguous Dockerfile commands (such as WORKDIR) produced a layer (default: fetched from the registry when no Dockerfile is given)")
+
+	f.StringArrayVar(&analyzeCmd.platforms, "platform", []string{}, "(optional) platform (os/arch[/variant]) of a multi-platform subject image to generate layer provenance metadata for, can be repeated (default: all platforms)")
 
 	var lpmManifestArtifactRefLongFlag = "lpm-manifest-artifact-ref"
 	f.StringVarP(&analyzeCmd.lpmManifestArtifactRef, lpmManifestArtifactRefLongFlag, "t", "", "(optional) target artifact ref in which the generated lpm manifest file will be pushed to as an ORAS referrer to the subject image")
 
+	f.BoolVar(&analyzeCmd.attach, "attach", false, "(optional) push the generated lpm manifest to the subject image's repository as a referrer of the subject image, using the referrers API or the referrers tag schema on registries without it")
+
+	f.StringVar(&analyzeCmd.signKey, "sign-key", "", "(optional) PEM private key file (ECDSA, RSA or Ed25519) to sign the pushed lpm manifest (or lpm index) with, the cosign signature is pushed as a referrer of the lpm manifest wherever the lpm manifest is pushed")
+
+	f.StringVar(&analyzeCmd.format, "format", "lpm", "(optional) output format of the layer provenance metadata, either 'lpm' (the lpm manifest), 'in-toto' (an in-toto Statement with the lpm predicate) or 'slsa' (an in-toto Statement with SLSA provenance v1), the lpm manifest is pushed whatever the output format")
+
 	f.StringVarP(&analyzeCmd.output, "output", "o", "", "(optional) output file to also write layer provenance metadata (default: stdout)")
 
 	return cobraCmd
 }
 
 func (analyzeCmd *analyzeCmd) run() error {
+	// Read the registry password from stdin if needed.
+	if err := analyzeCmd.registryOptions.complete(analyzeCmd.stdin, registryHost(analyzeCmd.subjectImageRef), registryHost(analyzeCmd.subjectImage), registryHost(analyzeCmd.lpmManifestArtifactRef)); err != nil {
+		return err
+	}
+
+	// The subject image is given either as a reference or as an image that may also be read from the local file system.
+	if analyzeCmd.subjectImageRef != "" && analyzeCmd.subjectImage != "" {
+		return fmt.Errorf("--subject-image-ref and --subject-image are mutually exclusive")
+	}
+	if analyzeCmd.subjectImage != "" {
+		analyzeCmd.subjectImageRef = analyzeCmd.subjectImage
+	}
+	if analyzeCmd.subjectImageRef == "" {
+		return fmt.Errorf("--subject-image-ref or --subject-image is required")
+	}
+	if analyzeCmd.format != "lpm" && analyzeCmd.format != "in-toto" && analyzeCmd.format != "slsa" {
+		return fmt.Errorf("unsupported output format '%s', expected 'lpm', 'in-toto' or 'slsa'", analyzeCmd.format)
+	}
+	if analyzeCmd.signKey != "" {
+		if !analyzeCmd.pushing() {
+			return fmt.Errorf("--sign-key requires --lpm-manifest-artifact-ref or --attach")
+		}
+		key, err := loadSigningKey(analyzeCmd.signKey)
+		if err != nil {
+			return err
+		}
+		analyzeCmd.signingKey = key
+	}
+
 	// Set output writer.
 	var out io.Writer
 	if analyzeCmd.output == "" {
@@ -104,34 +158,487 @@ func (analyzeCmd *analyzeCmd) run() error {
 		out = f
 	}
 
-	// Parse subject image Dockerfile.
-	dockerfileCommands, err := dockerfile.ParseFile(analyzeCmd.dockerfile)
+	// Parse platform filters.
+	platforms, err := parsePlatforms(analyzeCmd.platforms)
 	if err != nil {
 		return err
 	}
 
-	// Parse subject image manifest file.
-	subjectManifestIn, err := os.Open(analyzeCmd.subjectImageManifestFile)
+	// Describe the Dockerfile build for SLSA provenance.
+	build, err := analyzeCmd.dockerfileBuild()
 	if err != nil {
 		return err
 	}
-	defer subjectManifestIn.Close()
-	subjectManifest, err := goocispecv1.ParseManifest(subjectManifestIn)
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&analyzeCmd.registryOptions)
 	if err != nil {
 		return err
 	}
 
-	// Modify the subject image manifest to include layer provenance metadata (as OCI annotations) using the Dockerfile.
-	subjectManifestWithDockerfileOrigin, err := modifyManifestWithDockerfileOrigin(dockerfileCommands, subjectManifest)
+	// Open the subject image, which is in a registry, in an OCI image layout or in a "docker save" tarball.
+	subject, err := openImageSource(registry, analyzeCmd.subjectImageRef)
 	if err != nil {
 		return err
 	}
+	if analyzeCmd.attach {
+		if _, ok := subject.(*dockerArchiveImageSource); ok {
+			return fmt.Errorf("--attach is not supported for \"docker save\" tarballs, save the subject image as an OCI image layout instead")
+		}
+		if layout, ok := subject.(*ociLayoutImageSource); ok && layout.dir == "" {
+			return fmt.Errorf("--attach is not supported for \"docker save\" tarballs, extract the tarball into an OCI image layout directory instead")
+		}
+	}
+	if _, ok := subject.(*dockerArchiveImageSource); ok {
+		fmt.Fprintf(analyzeCmd.stderr, "[!] Warning: \"docker save\" tarball '%s' has no image manifest, the lpm manifest describes an image manifest made from its config and layers, whose digest differs from the image manifest pushed to a registry\n", analyzeCmd.subjectImageRef)
+	}
 
-	ctx := context.Background()
+	// Read subject image manifest.
+	// The manifest is read from the manifest file if one is given (for offline use).
+	// Otherwise, the manifest is read from the subject image (for example, fetched from the registry by resolving the subject image ref).
+	var subjectManifestBytes []byte
+	var subjectManifestDesc ocispecv1.Descriptor
+	if analyzeCmd.subjectImageManifestFile != "" {
+		subjectManifestBytes, err = os.ReadFile(analyzeCmd.subjectImageManifestFile)
+		if err != nil {
+			return err
+		}
+		subjectManifestDesc, err = analyzeCmd.subjectDescriptorForFile(ctx, subject, subjectManifestBytes)
+		if err != nil {
+			return err
+		}
+	} else {
+		subjectManifestBytes, subjectManifestDesc, err = subject.resolve(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Multi-platform subject images are described by an image index (or Docker manifest list) instead of an image manifest.
+	if isImageIndex(subjectManifestBytes) {
+		return analyzeCmd.runIndex(ctx, registry, subject, subjectManifestBytes, subjectManifestDesc, platforms, build, out)
+	}
+
+	// Generate the lpm manifest of the subject image.
+	lpmArtifact, err := analyzeCmd.generateLpmArtifact(ctx, registry, subject, subjectManifestBytes, subjectManifestDesc, nil)
+	if err != nil {
+		return err
+	}
+
+	// Write the complete reference manifest (with reference config and reference layers) to output,
+	// or the in-toto Statement made from it.
+	completeManifestJsonString, err := json.MarshalIndent(analyzeCmd.formatLpmManifest(lpmArtifact.completeManifest, build), "", "	")
+	if err != nil {
+		return err
+	}
+	out.Write(completeManifestJsonString)
+
+	// Return early if we are not supposed to push the lpm manifest to a registry.
+	if !analyzeCmd.pushing() {
+		return nil
+	}
+
+	// Add the reference manifest, reference config and reference layers to the memory store.
+	memoryStore := content.NewMemory()
+	lpmArtifact.addToStore(memoryStore)
+	err = memoryStore.StoreManifest(memoryStoreArtifactName, lpmArtifact.manifestDesc.Descriptor, lpmArtifact.manifest)
+	if err != nil {
+		return err
+	}
+
+	// Push the reference manifest as a referrer of the subject image.
+	return analyzeCmd.push(ctx, registry, subject, memoryStore, []referrer{{subject: subjectManifestDesc.Digest, desc: lpmArtifact.manifestDesc}})
+}
+
+// runIndex generates an lpm manifest for each platform manifest of a multi-platform subject image,
+// together with an lpm index that mirrors the subject image index.
+//
+// The lpm index is written to output.
+// When writing to an output file, each platform's lpm manifest is also written next to it
+// (for example, "lpm.json" and "lpm-linux-amd64.json").
+// With the "in-toto" and "slsa" output formats, the in-toto Statement of each platform is written to output instead of the lpm index,
+// one Statement per line (as in an in-toto attestation bundle).
+func (analyzeCmd *analyzeCmd) runIndex(ctx context.Context, registry *content.Registry, subject imageSource, subjectIndexBytes []byte, subjectIndexDesc ocispecv1.Descriptor, platforms []*goocispecv1.Platform, build dockerfileBuild, out io.Writer) error {
+	subjectIndex, err := goocispecv1.ParseIndexManifest(bytes.NewReader(subjectIndexBytes))
+	if err != nil {
+		return err
+	}
 
 	// Create a new ORAS memory store.
 	memoryStore := content.NewMemory()
 
+	// Generate an lpm manifest for each (selected) platform manifest of the subject image index, in the order of the subject image index.
+	lpmManifestDescs := make([]artifactDescriptor, 0)
+	referrers := make([]referrer, 0)
+	statements := make([]interface{}, 0)
+	for _, subjectManifestDesc := range subjectIndex.Manifests {
+		// Skip attestation manifests (such as provenance attached by BuildKit), which are not runnable images.
+		if subjectManifestDesc.Annotations[annotationKeyForDockerReferenceType] == "attestation-manifest" {
+			continue
+		}
+		if !platformMatches(subjectManifestDesc.Platform, platforms) {
+			continue
+		}
+
+		// Fetch the platform's subject image manifest by digest.
+		subjectManifestBytes, err := subject.fetch(ctx, toOCIDescriptor(subjectManifestDesc))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(analyzeCmd.stderr, "[*] Analyzing platform '%s' of subject image '%s'...\n", platformString(subjectManifestDesc.Platform), analyzeCmd.subjectImageRef)
+
+		lpmArtifact, err := analyzeCmd.generateLpmArtifact(ctx, registry, subject, subjectManifestBytes, toOCIDescriptor(subjectManifestDesc), subjectManifestDesc.Platform)
+		if err != nil {
+			return err
+		}
+
+		// Write the platform's complete reference manifest (or the in-toto Statement made from it) next to the output file.
+		statements = append(statements, analyzeCmd.formatLpmManifest(lpmArtifact.completeManifest, build))
+		if analyzeCmd.output != "" {
+			completeManifestJsonString, err := json.MarshalIndent(statements[len(statements)-1], "", "	")
+			if err != nil {
+				return err
+			}
+			err = os.WriteFile(platformOutputFile(analyzeCmd.output, subjectManifestDesc.Platform), completeManifestJsonString, 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Add the platform's reference manifest, reference config and reference layers to the memory store.
+		lpmArtifact.addToStore(memoryStore)
+
+		// Refer to the platform's reference manifest from the lpm index.
+		lpmManifestDesc := lpmArtifact.manifestDesc
+		lpmManifestDesc.Platform = toOCIPlatform(subjectManifestDesc.Platform)
+		lpmManifestDescs = append(lpmManifestDescs, lpmManifestDesc)
+
+		// The platform's reference manifest is a referrer of the platform's subject image manifest.
+		referrers = append(referrers, referrer{subject: digest.Digest(subjectManifestDesc.Digest.String()), desc: lpmArtifact.manifestDesc})
+	}
+	if len(lpmManifestDescs) == 0 {
+		return fmt.Errorf("no platform manifest of subject image '%s' matches the given platforms", analyzeCmd.subjectImageRef)
+	}
+
+	// Create the lpm index that mirrors the subject image index.
+	lpmIndex := artifactIndex{
+		Index: ocispecv1.Index{
+			Versioned: ocispecs.Versioned{SchemaVersion: int(subjectIndex.SchemaVersion)},
+			MediaType: ocispecv1.MediaTypeImageIndex,
+			Annotations: map[string]string{
+				annotationKeyForSubjectMediaType: subjectIndexDesc.MediaType,
+				annotationKeyForSubjectDigest:    subjectIndexDesc.Digest.String(),
+				annotationKeyForSubjectSize:      fmt.Sprint(subjectIndexDesc.Size),
+				ocispecv1.AnnotationCreated:      time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+		Manifests:    lpmManifestDescs,
+		ArtifactType: mediaTypeForManifestLpm,
+		Subject:      &subjectIndexDesc,
+	}
+	lpmIndexBytes, lpmIndexDesc, err := marshalArtifact(ocispecv1.MediaTypeImageIndex, mediaTypeForManifestLpm, lpmIndex)
+	if err != nil {
+		return err
+	}
+	lpmIndexDesc.Annotations = lpmIndex.Annotations
+
+	// Write the lpm index (or the in-toto Statement of each platform) to output.
+	if analyzeCmd.format == "lpm" {
+		lpmIndexJsonString, err := json.MarshalIndent(lpmIndex, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(lpmIndexJsonString)
+	} else {
+		for _, statement := range statements {
+			statementJsonString, err := json.Marshal(statement)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s\n", statementJsonString)
+		}
+	}
+
+	// Return early if we are not supposed to push the lpm index to a registry.
+	if !analyzeCmd.pushing() {
+		return nil
+	}
+
+	// Add the lpm index to the memory store.
+	err = memoryStore.StoreManifest(memoryStoreArtifactName, lpmIndexDesc.Descriptor, lpmIndexBytes)
+	if err != nil {
+		return err
+	}
+
+	// Push the lpm index (together with the lpm manifests of each platform).
+	// The lpm index is a referrer of the subject image index.
+	referrers = append(referrers, referrer{subject: subjectIndexDesc.Digest, desc: lpmIndexDesc})
+	return analyzeCmd.push(ctx, registry, subject, memoryStore, referrers)
+}
+
+// formatLpmManifest returns the generated lpm manifest of a subject image manifest in the output format,
+// which is the lpm manifest itself, or an in-toto Statement about the subject image manifest
+// whose predicate is the lpm manifest's layer attribution ("in-toto") or the SLSA provenance of the Dockerfile build ("slsa").
+func (analyzeCmd *analyzeCmd) formatLpmManifest(lpmManifest artifactManifest, build dockerfileBuild) interface{} {
+	switch analyzeCmd.format {
+	case "in-toto":
+		return newLpmStatement(subjectNameOf(analyzeCmd.subjectImageRef), lpmManifest)
+	case "slsa":
+		return newSlsaProvenanceStatement(subjectNameOf(analyzeCmd.subjectImageRef), lpmManifest, build)
+	default:
+		return lpmManifest
+	}
+}
+
+// dockerfileBuild describes the Dockerfile build of the subject image:
+// the Dockerfile and its digest, the target build stage, and the commands of the build stages that the subject image was built from.
+func (analyzeCmd *analyzeCmd) dockerfileBuild() (dockerfileBuild, error) {
+	build := dockerfileBuild{target: analyzeCmd.target}
+	if analyzeCmd.dockerfile == "" {
+		return build, nil
+	}
+
+	b, err := os.ReadFile(analyzeCmd.dockerfile)
+	if err != nil {
+		return build, err
+	}
+	build.dockerfile = analyzeCmd.dockerfile
+	build.dockerfileDigest = digest.FromBytes(b)
+
+	dockerfileCommands, err := dockerfile.ParseFile(analyzeCmd.dockerfile)
+	if err != nil {
+		return build, err
+	}
+	stages, err := parseDockerfileStages(dockerfileCommands)
+	if err != nil {
+		return build, err
+	}
+	chain, err := dockerfileStageChain(stages, analyzeCmd.target)
+	if err != nil {
+		return build, err
+	}
+	for _, stage := range chain {
+		build.instructions = append(build.instructions, stage.from.Original)
+		for _, command := range stage.commands {
+			build.instructions = append(build.instructions, command.Original)
+		}
+	}
+
+	return build, nil
+}
+
+// pushing returns whether the generated lpm manifest is supposed to be pushed to a registry.
+func (analyzeCmd *analyzeCmd) pushing() bool {
+	return analyzeCmd.lpmManifestArtifactRef != "" || analyzeCmd.attach
+}
+
+// subjectDescriptorForFile returns the descriptor of a subject image manifest read from a file.
+//
+// Manifest files saved with tools such as "docker manifest inspect" are reformatted,
+// so their digest may differ from the subject image manifest in the registry.
+// The descriptor is therefore resolved from the subject image when the lpm manifest is pushed as a referrer of the subject image,
+// and computed from the file's content otherwise (for offline use).
+func (analyzeCmd *analyzeCmd) subjectDescriptorForFile(ctx context.Context, subject imageSource, subjectManifestBytes []byte) (ocispecv1.Descriptor, error) {
+	if analyzeCmd.pushing() {
+		_, desc, err := subject.resolve(ctx)
+		return desc, err
+	}
+
+	var versioned ocispecv1.Manifest
+	if err := json.Unmarshal(subjectManifestBytes, &versioned); err != nil {
+		return ocispecv1.Descriptor{}, err
+	}
+	return ocispecv1.Descriptor{
+		MediaType: versioned.MediaType,
+		Digest:    digest.FromBytes(subjectManifestBytes),
+		Size:      int64(len(subjectManifestBytes)),
+	}, nil
+}
+
+// push pushes the lpm manifest (or lpm index) stored in the memory store to the lpm manifest artifact ref and/or to the subject image's repository,
+// and makes the pushed manifests discoverable as referrers of their subject image manifests.
+// With a signing key, the pushed lpm manifest (or lpm index) is also signed wherever it is pushed.
+// For a subject image in an OCI image layout, the lpm manifest is attached by writing it into the OCI image layout.
+func (analyzeCmd *analyzeCmd) push(ctx context.Context, registry *content.Registry, subject imageSource, memoryStore *content.Memory, referrers []referrer) error {
+	// Resolve the lpm manifest (or lpm index) to sign it once pushed.
+	_, lpmDesc, err := memoryStore.Resolve(ctx, memoryStoreArtifactName)
+	if err != nil {
+		return err
+	}
+
+	if analyzeCmd.lpmManifestArtifactRef != "" {
+		fmt.Fprintf(analyzeCmd.stderr, "[*] Pushing to '%s' as an ORAS reference to subject image '%s'...\n", analyzeCmd.lpmManifestArtifactRef, analyzeCmd.subjectImageRef)
+
+		desc, err := oras.Copy(ctx, memoryStore, memoryStoreArtifactName, registry, analyzeCmd.lpmManifestArtifactRef)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(analyzeCmd.stderr, "Pushed to '%s' with digest '%s'\n", analyzeCmd.lpmManifestArtifactRef, desc.Digest)
+
+		if analyzeCmd.signingKey != nil {
+			if err := pushSignature(ctx, registry, analyzeCmd.lpmManifestArtifactRef, &analyzeCmd.registryOptions, lpmDesc, analyzeCmd.signingKey, analyzeCmd.stderr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if analyzeCmd.attach {
+		if layout, ok := subject.(*ociLayoutImageSource); ok {
+			if err := writeToOCILayout(layout.dir, memoryStore, referrers); err != nil {
+				return err
+			}
+			fmt.Fprintf(analyzeCmd.stderr, "Attached to subject image '%s' in OCI image layout '%s'\n", analyzeCmd.subjectImageRef, layout.dir)
+			if analyzeCmd.signingKey != nil {
+				return writeSignatureToOCILayout(layout.dir, analyzeCmd.subjectImageRef, lpmDesc, analyzeCmd.signingKey, analyzeCmd.stderr)
+			}
+			return nil
+		}
+		if err := attachArtifact(ctx, registry, memoryStore, analyzeCmd.subjectImageRef, &analyzeCmd.registryOptions, referrers, analyzeCmd.stderr); err != nil {
+			return err
+		}
+		if analyzeCmd.signingKey != nil {
+			return pushSignature(ctx, registry, analyzeCmd.subjectImageRef, &analyzeCmd.registryOptions, lpmDesc, analyzeCmd.signingKey, analyzeCmd.stderr)
+		}
+	}
+
+	return nil
+}
+
+// lpmArtifact is a generated lpm manifest together with the content needed to push it to a registry.
+type lpmArtifact struct {
+	// completeManifest is the complete reference manifest (with reference config and reference layers).
+	completeManifest artifactManifest
+	// manifest and manifestDesc are the reference manifest pushed to the registry.
+	manifest     []byte
+	manifestDesc artifactDescriptor
+	// config and configDesc are the reference config pushed to the registry.
+	config     []byte
+	configDesc ocispecv1.Descriptor
+}
+
+// addToStore adds the reference manifest, reference config and reference layers to the memory store.
+func (lpmArtifact *lpmArtifact) addToStore(memoryStore *content.Memory) {
+	for _, referenceLayerDesc := range lpmArtifact.completeManifest.Layers {
+		memoryStore.Set(referenceLayerDesc, []byte(""))
+	}
+	memoryStore.Set(lpmArtifact.configDesc, lpmArtifact.config)
+	memoryStore.Set(lpmArtifact.manifestDesc.Descriptor, lpmArtifact.manifest)
+}
+
+// generateLpmArtifact generates the lpm manifest of a single-platform subject image manifest.
+// subject is used to fetch the subject image config when needed.
+// subjectManifestDesc describes the subject image manifest, which the generated lpm manifest refers to as its subject.
+// platform is the subject image's platform if the subject image manifest was selected from an image index (or nil).
+func (analyzeCmd *analyzeCmd) generateLpmArtifact(ctx context.Context, registry *content.Registry, subject imageSource, subjectManifestBytes []byte, subjectManifestDesc ocispecv1.Descriptor, platform *goocispecv1.Platform) (*lpmArtifact, error) {
+	subjectManifest, err := goocispecv1.ParseManifest(bytes.NewReader(subjectManifestBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse subject image config.
+	// The config is read from the config file if one is given.
+	// Otherwise, the config is fetched from the subject image (for example, from the subject image's repository),
+	// unless the subject image manifest was read from a file (for offline use) and there is a Dockerfile to attribute layers with.
+	var subjectConfig *goocispecv1.ConfigFile
+	if analyzeCmd.subjectImageConfigFile != "" {
+		subjectConfigIn, err := os.Open(analyzeCmd.subjectImageConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		defer subjectConfigIn.Close()
+		subjectConfig, err = goocispecv1.ParseConfigFile(subjectConfigIn)
+		if err != nil {
+			return nil, err
+		}
+	} else if analyzeCmd.dockerfile == "" || analyzeCmd.subjectImageManifestFile == "" {
+		subjectConfigBytes, err := subject.fetch(ctx, toOCIDescriptor(subjectManifest.Config))
+		if err != nil {
+			return nil, err
+		}
+		subjectConfig, err = goocispecv1.ParseConfigFile(bytes.NewReader(subjectConfigBytes))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var subjectConfigHistory []goocispecv1.History
+	if subjectConfig != nil {
+		subjectConfigHistory = subjectConfig.History
+	}
+
+	// Parse subject image Dockerfile.
+	var dockerfileCommands []dockerfile.Command
+	if analyzeCmd.dockerfile != "" {
+		dockerfileCommands, err = dockerfile.ParseFile(analyzeCmd.dockerfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Find the layers that the subject image inherited from its base image by matching layer digests.
+	// Without a base image, upstream layers can only be told from the Dockerfile.
+	base, err := analyzeCmd.resolveBaseImage(ctx, registry, subject, dockerfileCommands, subjectManifest, subjectConfig, platform)
+	if err != nil {
+		return nil, err
+	}
+	upstreamLayers := -1
+	if base != nil {
+		upstreamLayers = commonLayerPrefix(base, subjectManifest.Layers, subjectConfig)
+	}
+
+	// Modify the subject image manifest to include layer provenance metadata (as OCI annotations).
+	var subjectManifestWithOrigin *goocispecv1.Manifest
+	if analyzeCmd.dockerfile != "" {
+		// Attribute the layers using the Dockerfile.
+		var warnings []string
+		subjectManifestWithOrigin, warnings, err = modifyManifestWithDockerfileOrigin(dockerfileCommands, analyzeCmd.target, subjectConfigHistory, upstreamLayers, subjectManifest)
+		if err != nil {
+			return nil, err
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(analyzeCmd.stderr, "[!] Warning: %s\n", warning)
+		}
+	} else {
+		// Attribute the layers using the subject image config's history.
+		if upstreamLayers < 0 {
+			fmt.Fprintf(analyzeCmd.stderr, "[!] Warning: the ownership of the subject image's layers is unknown without a base image, pass --base-image to tell upstream layers from non-upstream layers\n")
+		}
+		subjectManifestWithOrigin, err = modifyManifestWithHistoryOrigin(subjectConfigHistory, upstreamLayers, subjectManifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Record who provides each layer using the OCI image labels.
+	// The subject image's labels are read from its config, or from the Dockerfile's LABEL commands when the config is not available.
+	subjectLabels := configLabels(subjectConfig)
+	if subjectConfig == nil && dockerfileCommands != nil {
+		subjectLabels, err = dockerfileLabels(dockerfileCommands, analyzeCmd.target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var baseLabels map[string]string
+	if base != nil {
+		baseLabels = configLabels(base.config)
+	}
+	subjectManifestWithOrigin = modifyManifestWithLabels(subjectManifestWithOrigin, subjectLabels, baseLabels)
+
+	// Trace the upstream layers through the base image's own lpm manifest (if attached to the base image),
+	// to tell which base image in the chain of "FROM" base images created each upstream layer.
+	if base != nil {
+		var baseLpmManifest *artifactManifest
+		if base.desc.Digest != "" {
+			baseLpmManifest, err = fetchBaseLpmManifest(ctx, registry, base, &analyzeCmd.registryOptions)
+			if err != nil {
+				fmt.Fprintf(analyzeCmd.stderr, "[!] Warning: cannot discover the lpm manifest of base image '%s' (%s)\n", base.ref, err)
+			}
+		}
+		subjectManifestWithOrigin = modifyManifestWithLineage(subjectManifestWithOrigin, upstreamLayers, base, baseLpmManifest)
+	}
+
 	// Iterate through the subject layer descriptors
 	// (containing layer ownership info annotated earlier)
 	// and generate reference layer descriptors.
@@ -146,10 +653,9 @@ func (analyzeCmd *analyzeCmd) run() error {
 	//
 	// As we iterate through the subject layers, we create
 	// a corresponding ocispecv1 reference layer descriptor
-	// (that refers to the goocispecv1 subject layer)
-	// in the memory store.
+	// (that refers to the goocispecv1 subject layer).
 	referenceLayerDescs := make([]ocispecv1.Descriptor, 0)
-	for _, subjectLayerDesc := range subjectManifestWithDockerfileOrigin.Layers {
+	for _, subjectLayerDesc := range subjectManifestWithOrigin.Layers {
 		// Copy the lpm manifest's annotations, which contains the subject layer's ownership information.
 		layerAnnotations := subjectLayerDesc.Annotations
 
@@ -167,111 +673,157 @@ func (analyzeCmd *analyzeCmd) run() error {
 			Annotations: layerAnnotations,
 		}
 
-		// If we are supposed to push the lpm manifest to a registry,
-		if analyzeCmd.lpmManifestArtifactRef != "" {
-			// Add the reference layer descriptor to the memory store.
-			memoryStore.Set(referenceLayerDesc, content)
-		}
-
 		// Append the reference layer descriptor in order.
 		// Layers are from bottom layer to top layer.
 		referenceLayerDescs = append(referenceLayerDescs, referenceLayerDesc)
 	}
 
 	// Create manifest annotations for the reference manifest.
-	referenceManifestAnnotations := subjectManifestWithDockerfileOrigin.Annotations
-	referenceManifestAnnotations[annotationKeyForSubjectMediaType] = string(subjectManifestWithDockerfileOrigin.MediaType)
+	referenceManifestAnnotations := subjectManifestWithOrigin.Annotations
+	referenceManifestAnnotations[annotationKeyForSubjectMediaType] = string(subjectManifestWithOrigin.MediaType)
+	if platform != nil {
+		referenceManifestAnnotations[annotationKeyForSubjectPlatform] = platformString(platform)
+	}
+	// Record when the lpm manifest was created, which tells the most recent one apart when an image is analyzed several times.
+	referenceManifestAnnotations[ocispecv1.AnnotationCreated] = time.Now().UTC().Format(time.RFC3339)
+	if base != nil {
+		referenceManifestAnnotations[annotationKeyForSubjectBaseImageRef] = base.ref
+		if base.desc.Digest != "" {
+			referenceManifestAnnotations[annotationKeyForSubjectBaseImageDigest] = base.desc.Digest.String()
+		}
+	}
 
 	// Create config annotations for the reference manifest's config.
-	referenceConfigAnnotations := subjectManifestWithDockerfileOrigin.Config.Annotations
-	referenceConfigAnnotations[annotationKeyForSubjectMediaType] = string(subjectManifestWithDockerfileOrigin.Config.MediaType)
-	referenceConfigAnnotations[annotationKeyForSubjectDigest] = subjectManifestWithDockerfileOrigin.Config.Digest.String()
-	referenceConfigAnnotations[annotationKeyForSubjectSize] = fmt.Sprint(subjectManifestWithDockerfileOrigin.Config.Size)
+	referenceConfigAnnotations := subjectManifestWithOrigin.Config.Annotations
+	referenceConfigAnnotations[annotationKeyForSubjectMediaType] = string(subjectManifestWithOrigin.Config.MediaType)
+	referenceConfigAnnotations[annotationKeyForSubjectDigest] = subjectManifestWithOrigin.Config.Digest.String()
+	referenceConfigAnnotations[annotationKeyForSubjectSize] = fmt.Sprint(subjectManifestWithOrigin.Config.Size)
 
-	// Create the reference manifest and reference config.
-	referenceManifest, referenceManifestDesc, referenceConfig, referenceConfigDesc, err := content.GenerateManifestAndConfig(referenceManifestAnnotations, referenceConfigAnnotations, referenceLayerDescs...)
+	// Create the reference config.
+	referenceConfig, referenceConfigDesc, err := content.GenerateConfig(referenceConfigAnnotations)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Set the reference config descriptor's mediaType because content.GenerateConfig() sets the mediaType to "application/vnd.unknown.config.v1+json".
 	// See https://github.com/oras-project/oras-go/blob/v1.1.1/pkg/content/manifest.go#L41-L52
 	referenceConfigDesc.MediaType = mediaTypeForConfigLpm
 
-	// Write the complete reference manifest (with reference config and reference layers) to output.
-	completeManifest := ocispecv1.Manifest{
-		Versioned:   ocispecs.Versioned{SchemaVersion: int(subjectManifestWithDockerfileOrigin.SchemaVersion)},
-		MediaType:   mediaTypeForManifestLpm,
-		Config:      referenceConfigDesc,
-		Layers:      referenceLayerDescs,
-		Annotations: referenceManifestAnnotations,
+	// Create the complete reference manifest (with reference config and reference layers).
+	// The reference manifest is an OCI image manifest whose artifact type is the lpm manifest media type,
+	// so that it can be pushed to any OCI registry and discovered through the referrers of its subject image.
+	completeManifest := artifactManifest{
+		Manifest: ocispecv1.Manifest{
+			Versioned:   ocispecs.Versioned{SchemaVersion: int(subjectManifestWithOrigin.SchemaVersion)},
+			MediaType:   ocispecv1.MediaTypeImageManifest,
+			Config:      referenceConfigDesc,
+			Layers:      referenceLayerDescs,
+			Annotations: referenceManifestAnnotations,
+		},
+		ArtifactType: mediaTypeForManifestLpm,
+		Subject:      &subjectManifestDesc,
 	}
-	completeManifestJsonString, err := json.MarshalIndent(completeManifest, "", "	")
+	referenceManifest, referenceManifestDesc, err := marshalArtifact(ocispecv1.MediaTypeImageManifest, mediaTypeForManifestLpm, completeManifest)
 	if err != nil {
-		return err
-	}
-	out.Write(completeManifestJsonString)
-
-	// Return early if we are not supposed to push the lpm manifest to a registry.
-	if analyzeCmd.lpmManifestArtifactRef == "" {
-		return nil
+		return nil, err
 	}
+	referenceManifestDesc.Annotations = referenceManifestAnnotations
+
+	return &lpmArtifact{
+		completeManifest: completeManifest,
+		manifest:         referenceManifest,
+		manifestDesc:     referenceManifestDesc,
+		config:           referenceConfig,
+		configDesc:       referenceConfigDesc,
+	}, nil
+}
 
-	// Add the reference manifest and reference config to the memory store.
-	memoryStore.Set(referenceConfigDesc, referenceConfig)
-	err = memoryStore.StoreManifest(analyzeCmd.lpmManifestArtifactRef, referenceManifestDesc, referenceManifest)
+// modifyManifestWithDockerfileOrigin annotates the image manifest layers with the Dockerfile commands that created them.
+//
+// upstreamLayers is the number of bottom layers that the subject image shares with its base image (or -1 if unknown).
+// When known, exactly these layers are attributed as "upstream",
+// and a warning is returned for each layer where the Dockerfile tells otherwise.
+func modifyManifestWithDockerfileOrigin(dockerfileCommands []dockerfile.Command, target string, history []goocispecv1.History, upstreamLayers int, manifest *goocispecv1.Manifest) (*goocispecv1.Manifest, []string, error) {
+	// Split the Dockerfile into build stages and find the stages that make up the subject image.
+	// Stages that the target stage is not built on do not leave layers in the subject image and are ignored.
+	stages, err := parseDockerfileStages(dockerfileCommands)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-
-	// Create a local registry store.
-	registry, err := content.NewRegistry(content.RegistryOptions{Username: analyzeCmd.username, Password: analyzeCmd.password})
+	chain, err := dockerfileStageChain(stages, target)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	fmt.Printf("[*] Pushing to '%s' as an ORAS reference to subject image '%s'...\n", analyzeCmd.lpmManifestArtifactRef, analyzeCmd.subjectImageRef)
-
-	// Push the reference manifest.
-	// TODO add an ORAS reference from the reference manifest to the subject image ref.
-	desc, err := oras.Copy(ctx, memoryStore, analyzeCmd.lpmManifestArtifactRef, registry, "")
-	if err != nil {
-		return err
+	// Flatten the commands of the stage chain (from the root stage to the target stage),
+	// remembering the stage that each command belongs to.
+	commands := make([]dockerfile.Command, 0)
+	commandStages := make([]dockerfileStage, 0)
+	for _, stage := range chain {
+		for _, command := range stage.commands {
+			commands = append(commands, command)
+			commandStages = append(commandStages, stage)
+		}
 	}
-	fmt.Printf("Pushed to '%s' with digest '%s'\n", analyzeCmd.lpmManifestArtifactRef, desc.Digest)
 
-	return nil
-}
+	// Only some Dockerfile commands (such as RUN, COPY and ADD) produce a layer.
+	// The remaining commands (such as ENV and LABEL) only change the image config and must not be lined up with a layer.
+	layerCommands := dockerfileLayerCommands(commands, history)
 
-func modifyManifestWithDockerfileOrigin(dockerfileCommands []dockerfile.Command, manifest *goocispecv1.Manifest) (*goocispecv1.Manifest, error) {
 	// Set ownership of the image manifest to "non-upstream".
 	manifest.Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
 	// Set ownership of the image manifest config to "non-upstream".
 	manifest.Config.Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
 
-	d := len(dockerfileCommands) - 1
-	m := len(manifest.Layers) - 1
-	for ; d >= 0 && m >= 0; d, m = d-1, m-1 {
-		// Stop processing if the Dockerfile command is a "FROM" command.
-		// Reason:
-		//		The remaining image manifest layers are inherited from the "FROM" command's base image.
-		//		Therefore, the ownership of the remaining image manifest layers will be set to "upstream".
-		if strings.ToUpper(dockerfileCommands[d].Cmd) == "FROM" {
-			break
+	// Walking backwards from the top layer, each layer is lined up with a command that produces a layer.
+	// The remaining bottom layers are inherited from the root stage's "FROM" base image,
+	// so the Dockerfile attributes them as "upstream".
+	// Layers shared with the base image are attributed as "upstream" instead when the base image's layers are known,
+	// since layer digests tell which layers were inherited even when the Dockerfile does not match the actual build.
+	root := chain[0]
+	warnings := make([]string, 0)
+	for m := len(manifest.Layers) - 1; m >= 0; m-- {
+		l := len(layerCommands) - (len(manifest.Layers) - m)
+
+		upstreamByDockerfile := l < 0
+		upstream := upstreamByDockerfile
+		if upstreamLayers >= 0 {
+			upstream = m < upstreamLayers
+			if upstream && !upstreamByDockerfile {
+				warnings = append(warnings, fmt.Sprintf("layer %d (%s) is attributed to '%s' by the Dockerfile but is shared with the base image, attributing it as upstream", m, manifest.Layers[m].Digest, commands[layerCommands[l]].Original))
+			}
+			if !upstream && upstreamByDockerfile {
+				warnings = append(warnings, fmt.Sprintf("layer %d (%s) is attributed to the base image by the Dockerfile but is not shared with the base image, attributing it as non-upstream", m, manifest.Layers[m].Digest))
+			}
 		}
 
-		// Set ownership of the image manifest layer to "non-upstream".
-		manifest.Layers[m].Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
-		manifest.Layers[m].Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = dockerfileCommands[d].Original
-	}
+		if upstream {
+			// Set ownership of the image manifest layer to "upstream".
+			manifest.Layers[m].Annotations = deepCopyMap(annotationsForUpstreamOwnership)
+		} else {
+			// Set ownership of the image manifest layer to "non-upstream".
+			manifest.Layers[m].Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
+		}
 
-	for ; m >= 0; m = m - 1 {
-		// Set ownership of the remaining image manifest layers to "upstream".
-		manifest.Layers[m].Annotations = deepCopyMap(annotationsForUpstreamOwnership)
-		manifest.Layers[m].Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = dockerfileCommands[d].Original
+		if upstream || l < 0 {
+			manifest.Layers[m].Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = root.from.Original
+			setDockerfileStageAnnotations(manifest.Layers[m].Annotations, root)
+		} else {
+			d := layerCommands[l]
+			manifest.Layers[m].Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = commands[d].Original
+			setDockerfileStageAnnotations(manifest.Layers[m].Annotations, commandStages[d])
+		}
 	}
 
-	return manifest, nil
+	return manifest, warnings, nil
+}
+
+// setDockerfileStageAnnotations records the Dockerfile build stage that produced a layer.
+func setDockerfileStageAnnotations(annotations map[string]string, stage dockerfileStage) {
+	annotations[annotationKeyForSubjectDockerfileStageIndex] = fmt.Sprint(stage.index)
+	if stage.name != "" {
+		annotations[annotationKeyForSubjectDockerfileStageName] = stage.name
+	}
 }
 
 func deepCopyMap(m map[string]string) map[string]string {
@@ -281,3 +833,62 @@ func deepCopyMap(m map[string]string) map[string]string {
 	}
 	return newMap
 }
+
+// resolveBaseImage fetches the subject image's base image, which is given with "--base-image",
+// or else resolved from the "FROM" command of the Dockerfile's root stage.
+// nil is returned when there is no base image to match layers against.
+//
+// A base image resolved from the Dockerfile may not be reachable (for example, a private base image or a build argument),
+// in which case a warning is written and the layers are attributed using the Dockerfile alone.
+func (analyzeCmd *analyzeCmd) resolveBaseImage(ctx context.Context, registry *content.Registry, subject imageSource, dockerfileCommands []dockerfile.Command, subjectManifest *goocispecv1.Manifest, subjectConfig *goocispecv1.ConfigFile, platform *goocispecv1.Platform) (*baseImage, error) {
+	baseRef := analyzeCmd.baseImage
+	if baseRef == "" {
+		if dockerfileCommands == nil {
+			return nil, nil
+		}
+		stages, err := parseDockerfileStages(dockerfileCommands)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := dockerfileStageChain(stages, analyzeCmd.target)
+		if err != nil {
+			return nil, err
+		}
+		baseRef = chain[0].base
+
+		// An image built "FROM scratch" has no upstream layers.
+		if strings.EqualFold(baseRef, "scratch") {
+			return &baseImage{ref: baseRef}, nil
+		}
+		if !isResolvableBaseImage(baseRef) {
+			fmt.Fprintf(analyzeCmd.stderr, "[!] Warning: cannot resolve base image '%s' from the Dockerfile, use --base-image to match layers against the base image\n", baseRef)
+			return nil, nil
+		}
+	}
+
+	// A multi-platform base image's manifest is selected by the subject image's platform,
+	// which is read from the subject image config for single-platform subject images.
+	if platform == nil {
+		if subjectConfig == nil {
+			subjectConfigBytes, err := subject.fetch(ctx, toOCIDescriptor(subjectManifest.Config))
+			if err == nil {
+				subjectConfig, _ = goocispecv1.ParseConfigFile(bytes.NewReader(subjectConfigBytes))
+			}
+		}
+		if subjectConfig != nil && subjectConfig.OS != "" {
+			platform = &goocispecv1.Platform{OS: subjectConfig.OS, Architecture: subjectConfig.Architecture, Variant: subjectConfig.Variant}
+		}
+	}
+
+	fmt.Fprintf(analyzeCmd.stderr, "[*] Matching layers against base image '%s'...\n", baseRef)
+	base, err := fetchBaseImage(ctx, registry, baseRef, platform)
+	if err != nil {
+		if analyzeCmd.baseImage != "" {
+			return nil, err
+		}
+		fmt.Fprintf(analyzeCmd.stderr, "[!] Warning: cannot fetch base image '%s' (%s), attributing layers using the Dockerfile alone\n", baseRef, err)
+		return nil, nil
+	}
+
+	return base, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"encoding/json"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The vendored OCI image-spec predates OCI image-spec v1.1,
+// which adds the "artifactType" and "subject" fields used by the referrers API.
+// See https://github.com/opencontainers/image-spec/blob/v1.1.0/manifest.md
+
+// artifactDescriptor is an OCI descriptor with the OCI image-spec v1.1 "artifactType" field.
+type artifactDescriptor struct {
+	ocispecv1.Descriptor
+
+	// ArtifactType is the artifact type of the referenced manifest.
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// artifactManifest is an OCI image manifest with the OCI image-spec v1.1 "artifactType" and "subject" fields.
+type artifactManifest struct {
+	ocispecv1.Manifest
+
+	// ArtifactType is the type of the artifact carried by the manifest.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject is the manifest that the artifact refers to.
+	Subject *ocispecv1.Descriptor `json:"subject,omitempty"`
+}
+
+// artifactIndex is an OCI image index with the OCI image-spec v1.1 "artifactType" and "subject" fields.
+// It is also the response of the referrers API and the content of the referrers tag schema.
+type artifactIndex struct {
+	ocispecv1.Index
+
+	// Manifests overrides ocispecv1.Index's manifests to keep each manifest's artifact type.
+	Manifests []artifactDescriptor `json:"manifests"`
+
+	// ArtifactType is the type of the artifact carried by the index.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject is the manifest that the artifact refers to.
+	Subject *ocispecv1.Descriptor `json:"subject,omitempty"`
+}
+
+// artifactTypeOf returns the artifact type of a manifest.
+// Manifests without an "artifactType" field fall back to the config's media type,
+// and manifests generated before the "artifactType" field was set (which used a custom manifest media type) fall back to the manifest's media type.
+func artifactTypeOf(manifest artifactManifest) string {
+	if manifest.ArtifactType != "" {
+		return manifest.ArtifactType
+	}
+	if manifest.MediaType != "" && manifest.MediaType != ocispecv1.MediaTypeImageManifest {
+		return manifest.MediaType
+	}
+	return manifest.Config.MediaType
+}
+
+// marshalArtifact marshals a manifest (or index) and returns its content together with its descriptor.
+func marshalArtifact(mediaType string, artifactType string, v interface{}) ([]byte, artifactDescriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, artifactDescriptor{}, err
+	}
+
+	return b, artifactDescriptor{
+		Descriptor: ocispecv1.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		},
+		ArtifactType: artifactType,
+	}, nil
+}
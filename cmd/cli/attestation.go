@@ -0,0 +1,233 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// inTotoStatement is an in-toto attestation Statement.
+// See https://github.com/in-toto/attestation/blob/v1.0/spec/v1/statement.md
+type inTotoStatement struct {
+	Type          string                     `json:"_type"`
+	Subject       []inTotoResourceDescriptor `json:"subject"`
+	PredicateType string                     `json:"predicateType"`
+	Predicate     interface{}                `json:"predicate"`
+}
+
+// inTotoResourceDescriptor describes a software artifact or resource (such as an image manifest or a Dockerfile).
+// See https://github.com/in-toto/attestation/blob/v1.0/spec/v1/resource_descriptor.md
+type inTotoResourceDescriptor struct {
+	Name        string                 `json:"name,omitempty"`
+	URI         string                 `json:"uri,omitempty"`
+	Digest      map[string]string      `json:"digest,omitempty"`
+	MediaType   string                 `json:"mediaType,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// lpmPredicate is the in-toto predicate of type predicateTypeForLpm,
+// which carries the layer attribution of an lpm manifest.
+type lpmPredicate struct {
+	// Platform is the platform of the subject image (for a platform manifest of a multi-platform subject image).
+	Platform string `json:"platform,omitempty"`
+	// BaseImage is the base image that the subject image was built on (if known).
+	BaseImage *inTotoResourceDescriptor `json:"baseImage,omitempty"`
+	// Config is the attribution of the subject image's config.
+	Config lpmPredicateDescriptor `json:"config"`
+	// Layers are the attribution of the subject image's layers, from the bottom layer to the top layer.
+	Layers []lpmPredicateDescriptor `json:"layers"`
+	// Annotations are the lpm manifest's annotations.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// lpmPredicateDescriptor is the attribution of a subject image's config or layer.
+type lpmPredicateDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	// Ownership is either "upstream" (inherited from the base image) or "non-upstream".
+	Ownership string `json:"ownership"`
+	// Command is the Dockerfile command (or history entry) that created the layer.
+	Command string `json:"command,omitempty"`
+	// Annotations are all the lpm annotations of the config or layer.
+	Annotations map[string]string `json:"annotations"`
+}
+
+// slsaProvenance is the SLSA provenance (v1) predicate.
+// See https://slsa.dev/spec/v1.0/provenance
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string                     `json:"buildType"`
+	ExternalParameters   map[string]interface{}     `json:"externalParameters"`
+	ResolvedDependencies []inTotoResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+type slsaRunDetails struct {
+	Builder    slsaBuilder                `json:"builder"`
+	Byproducts []inTotoResourceDescriptor `json:"byproducts,omitempty"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+// dockerfileBuild is the Dockerfile build that produced a subject image, as told to lpm.
+type dockerfileBuild struct {
+	// dockerfile is the path of the Dockerfile (or "" if no Dockerfile was given) and dockerfileDigest is the digest of its content.
+	dockerfile       string
+	dockerfileDigest digest.Digest
+	// target is the Dockerfile build stage that the subject image was built from ("" for the final stage).
+	target string
+	// instructions are the Dockerfile commands of the build stages that the subject image was built from.
+	instructions []string
+}
+
+// inTotoDigest returns the in-toto digest set of an OCI digest (for example {"sha256": "..."}).
+func inTotoDigest(d digest.Digest) map[string]string {
+	return map[string]string{d.Algorithm().String(): d.Encoded()}
+}
+
+// inTotoSubject returns the in-toto subject of an lpm manifest, which is the subject image manifest that it describes.
+func inTotoSubject(subjectName string, lpmManifest artifactManifest) []inTotoResourceDescriptor {
+	subject := inTotoResourceDescriptor{Name: subjectName}
+	if lpmManifest.Subject != nil {
+		subject.Digest = inTotoDigest(lpmManifest.Subject.Digest)
+	}
+	return []inTotoResourceDescriptor{subject}
+}
+
+// newLpmPredicateDescriptor returns the attribution of a subject image's config or layer from its lpm annotations.
+func newLpmPredicateDescriptor(annotations map[string]string) lpmPredicateDescriptor {
+	size, _ := strconv.ParseInt(annotations[annotationKeyForSubjectSize], 10, 64)
+	return lpmPredicateDescriptor{
+		MediaType:   annotations[annotationKeyForSubjectMediaType],
+		Digest:      annotations[annotationKeyForSubjectDigest],
+		Size:        size,
+		Ownership:   layerOwnership(annotations),
+		Command:     annotations[annotationKeyForSubjectOriginalDockerfileFullCommand],
+		Annotations: annotations,
+	}
+}
+
+// baseImageResourceDescriptor returns the base image recorded in an lpm manifest's annotations (or nil if unknown).
+func baseImageResourceDescriptor(lpmManifest artifactManifest) *inTotoResourceDescriptor {
+	ref := lpmManifest.Annotations[annotationKeyForSubjectBaseImageRef]
+	if ref == "" || strings.EqualFold(ref, "scratch") {
+		return nil
+	}
+	base := &inTotoResourceDescriptor{Name: ref, URI: "docker://" + ref}
+	if d, err := digest.Parse(lpmManifest.Annotations[annotationKeyForSubjectBaseImageDigest]); err == nil {
+		base.Digest = inTotoDigest(d)
+	}
+	return base
+}
+
+// newLpmStatement returns an in-toto Statement about the subject image of an lpm manifest,
+// whose predicate carries the lpm manifest's layer attribution.
+func newLpmStatement(subjectName string, lpmManifest artifactManifest) inTotoStatement {
+	predicate := lpmPredicate{
+		Platform:    lpmManifest.Annotations[annotationKeyForSubjectPlatform],
+		BaseImage:   baseImageResourceDescriptor(lpmManifest),
+		Config:      newLpmPredicateDescriptor(lpmManifest.Config.Annotations),
+		Layers:      make([]lpmPredicateDescriptor, 0),
+		Annotations: lpmManifest.Annotations,
+	}
+	for _, layer := range lpmManifest.Layers {
+		predicate.Layers = append(predicate.Layers, newLpmPredicateDescriptor(layer.Annotations))
+	}
+
+	return inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       inTotoSubject(subjectName, lpmManifest),
+		PredicateType: predicateTypeForLpm,
+		Predicate:     predicate,
+	}
+}
+
+// newSlsaProvenanceStatement returns an in-toto Statement about the subject image of an lpm manifest,
+// whose predicate is the SLSA provenance of the subject image's Dockerfile build.
+//
+// The Dockerfile, the build stage and the Dockerfile's instructions are the build's external parameters,
+// the Dockerfile and the base image are its resolved dependencies,
+// and each layer (with the Dockerfile command that created it) is a byproduct of the build.
+// lpm tells the build's provenance from the built image rather than by observing the build,
+// so the builder is lpm itself.
+func newSlsaProvenanceStatement(subjectName string, lpmManifest artifactManifest, build dockerfileBuild) inTotoStatement {
+	externalParameters := make(map[string]interface{})
+	resolvedDependencies := make([]inTotoResourceDescriptor, 0)
+	if build.dockerfile != "" {
+		externalParameters["dockerfile"] = build.dockerfile
+		resolvedDependencies = append(resolvedDependencies, inTotoResourceDescriptor{
+			Name:   build.dockerfile,
+			Digest: inTotoDigest(build.dockerfileDigest),
+		})
+	}
+	if build.target != "" {
+		externalParameters["target"] = build.target
+	}
+	if platform := lpmManifest.Annotations[annotationKeyForSubjectPlatform]; platform != "" {
+		externalParameters["platform"] = platform
+	}
+	if len(build.instructions) > 0 {
+		externalParameters["instructions"] = build.instructions
+	}
+	if base := baseImageResourceDescriptor(lpmManifest); base != nil {
+		resolvedDependencies = append(resolvedDependencies, *base)
+	}
+
+	byproducts := make([]inTotoResourceDescriptor, 0)
+	for i, layer := range lpmManifest.Layers {
+		byproduct := inTotoResourceDescriptor{
+			Name:      "layer " + strconv.Itoa(i),
+			MediaType: layer.Annotations[annotationKeyForSubjectMediaType],
+			Annotations: map[string]interface{}{
+				"ownership": layerOwnership(layer.Annotations),
+			},
+		}
+		if d, err := digest.Parse(layer.Annotations[annotationKeyForSubjectDigest]); err == nil {
+			byproduct.Digest = inTotoDigest(d)
+		}
+		if command := layer.Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand]; command != "" {
+			byproduct.Annotations["command"] = command
+		}
+		byproducts = append(byproducts, byproduct)
+	}
+
+	return inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       inTotoSubject(subjectName, lpmManifest),
+		PredicateType: predicateTypeForSlsaProvenance,
+		Predicate: slsaProvenance{
+			BuildDefinition: slsaBuildDefinition{
+				BuildType:            buildTypeForSlsaDockerfile,
+				ExternalParameters:   externalParameters,
+				ResolvedDependencies: resolvedDependencies,
+			},
+			RunDetails: slsaRunDetails{
+				Builder:    slsaBuilder{ID: builderIDForSlsa},
+				Byproducts: byproducts,
+			},
+		},
+	}
+}
+
+// subjectNameOf returns the name of a subject image in an in-toto Statement,
+// which is the subject image's repository (or the subject image as given, for a subject image that is not in a registry).
+func subjectNameOf(subjectRef string) string {
+	if strings.Contains(subjectRef, "://") {
+		return subjectRef
+	}
+	if repository, err := repositoryOf(subjectRef); err == nil {
+		return repository
+	}
+	return subjectRef
+}
@@ -0,0 +1,423 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	digest "github.com/opencontainers/go-digest"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"oras.land/oras-go/pkg/content"
+)
+
+type auditCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	registry        string
+	repository      string
+	warnDays        int
+	workers         int
+	format          string
+	output          string
+}
+
+func newAuditCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	auditCmd := &auditCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "audit every tagged image of a registry (or of a repository) for missing or stale lpm manifests, and for passed or approaching end of life dates",
+		Example: `lpm audit \
+[--username 					username] \
+[--password-stdin] \
+--registry 						myregistry.myserver.io \
+[--repository 					myimage] \
+[--warn-days 					30] \
+[--workers 						8] \
+[--format 						table|json|csv] \
+[--output 						audit.csv]
+`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return auditCmd.run()
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &auditCmd.registryOptions)
+
+	var registryLongFlag = "registry"
+	f.StringVar(&auditCmd.registry, registryLongFlag, "", "registry host to audit")
+	cobraCmd.MarkFlagRequired(registryLongFlag)
+
+	f.StringVar(&auditCmd.repository, "repository", "", "(optional) repository of the registry to audit (default: every repository of the registry's catalog)")
+
+	f.IntVar(&auditCmd.warnDays, "warn-days", 30, "(optional) number of days before an end of life date from which the end of life is reported as approaching")
+
+	f.IntVar(&auditCmd.workers, "workers", 4, "(optional) number of images to audit concurrently")
+
+	f.StringVar(&auditCmd.format, "format", "table", "(optional) output format, either 'table', 'json' or 'csv'")
+
+	f.StringVarP(&auditCmd.output, "output", "o", "", "(optional) output file to write the audit report to (default: stdout)")
+
+	return cobraCmd
+}
+
+// The findings of an audited image.
+var auditFindingMissingLpm = "missing-lpm"
+var auditFindingStaleLpm = "stale-lpm"
+var auditFindingEolPassed = "eol-passed"
+var auditFindingEolApproaching = "eol-approaching"
+var auditFindingEolInvalid = "eol-invalid"
+
+// audit is the report of an audit of the tagged images of a registry.
+type audit struct {
+	Registry string         `json:"registry"`
+	Images   []auditedImage `json:"images"`
+}
+
+// auditedImage is the audit of a tagged image.
+type auditedImage struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest,omitempty"`
+	// LpmArtifact is the digest of the lpm artifact that was checked (the last one listed).
+	LpmArtifact string `json:"lpmArtifact,omitempty"`
+	// EolDate is the earliest end of life date declared for the image.
+	EolDate  string   `json:"eolDate,omitempty"`
+	Findings []string `json:"findings"`
+	// Error is the error that the image could not be audited because of
+	// (or, without a tag, the error that the repository's tags could not be listed because of).
+	Error string `json:"error,omitempty"`
+
+	// skipped tells that the tag is not an image, but an artifact (such as an lpm artifact or a signature).
+	skipped bool
+}
+
+func (auditCmd *auditCmd) run() error {
+	// Read the registry password from stdin if needed.
+	if err := auditCmd.registryOptions.complete(auditCmd.stdin, auditCmd.registry); err != nil {
+		return err
+	}
+
+	if auditCmd.format != "table" && auditCmd.format != "json" && auditCmd.format != "csv" {
+		return fmt.Errorf("unsupported output format '%s', expected 'table', 'json' or 'csv'", auditCmd.format)
+	}
+	if auditCmd.workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if auditCmd.warnDays < 0 {
+		return fmt.Errorf("--warn-days must not be negative")
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if auditCmd.output == "" {
+		out = auditCmd.stdout
+	} else {
+		f, err := os.Create(auditCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx := context.Background()
+
+	// List the repositories to audit.
+	repositories := []string{auditCmd.repository}
+	if auditCmd.repository == "" {
+		var err error
+		repositories, err = listCatalog(ctx, auditCmd.registry, &auditCmd.registryOptions)
+		if err != nil {
+			return err
+		}
+		sort.Strings(repositories)
+	}
+
+	// List the tags of each repository, leaving out the referrers tag schema tags (and the tags derived from them, such as cosign's "sha256-<ref>.sig").
+	// A repository whose tags cannot be listed (for example, because access to it is denied) is reported with its error,
+	// and the other repositories are still audited.
+	// The client of each repository is shared by the workers auditing its images.
+	images := make([]auditedImage, 0)
+	remotes := make(map[string]*remoteRepository)
+	tagged := 0
+	for _, repository := range repositories {
+		remote, err := newRemoteRepository(ctx, auditCmd.registry+"/"+repository, &auditCmd.registryOptions, false)
+		if err != nil {
+			images = append(images, auditedImage{Repository: repository, Findings: make([]string, 0), Error: err.Error()})
+			continue
+		}
+		tags, err := remote.tags(ctx)
+		if err != nil {
+			images = append(images, auditedImage{Repository: repository, Findings: make([]string, 0), Error: err.Error()})
+			continue
+		}
+		remotes[repository] = remote
+		sort.Strings(tags)
+		for _, tag := range tags {
+			if isReferrersTag(tag) {
+				continue
+			}
+			images = append(images, auditedImage{Repository: repository, Tag: tag, Findings: make([]string, 0)})
+			tagged++
+		}
+	}
+	fmt.Fprintf(auditCmd.stderr, "[*] Auditing %d tags of %d repositories of '%s' with %d workers...\n", tagged, len(remotes), auditCmd.registry, auditCmd.workers)
+
+	// Audit the images concurrently. Each worker has its own registry store.
+	now := time.Now()
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	registries := make([]*content.Registry, auditCmd.workers)
+	for w := range registries {
+		registry, err := newRegistry(&auditCmd.registryOptions)
+		if err != nil {
+			return err
+		}
+		registries[w] = registry
+	}
+	for _, registry := range registries {
+		registry := registry
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				image := &images[i]
+				ref := fmt.Sprintf("%s/%s:%s", auditCmd.registry, image.Repository, image.Tag)
+				if err := auditCmd.auditImage(ctx, registry, remotes[image.Repository], ref, image, now); err != nil {
+					image.Error = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range images {
+		if images[i].Error == "" {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := audit{Registry: auditCmd.registry, Images: make([]auditedImage, 0)}
+	for _, image := range images {
+		if image.skipped {
+			continue
+		}
+		switch {
+		case image.Error != "" && image.Tag == "":
+			fmt.Fprintf(auditCmd.stderr, "[!] Warning: could not list the tags of '%s/%s': %s\n", auditCmd.registry, image.Repository, image.Error)
+		case image.Error != "":
+			fmt.Fprintf(auditCmd.stderr, "[!] Warning: could not audit '%s/%s:%s': %s\n", auditCmd.registry, image.Repository, image.Tag, image.Error)
+		}
+		report.Images = append(report.Images, image)
+	}
+
+	switch auditCmd.format {
+	case "json":
+		reportJsonString, err := json.MarshalIndent(report, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(reportJsonString)
+	case "csv":
+		w := csv.NewWriter(out)
+		w.Write([]string{"repository", "tag", "digest", "lpmArtifact", "eolDate", "findings", "error"})
+		for _, image := range report.Images {
+			w.Write([]string{image.Repository, image.Tag, image.Digest, image.LpmArtifact, image.EolDate, strings.Join(image.Findings, ";"), image.Error})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	default:
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REPOSITORY\tTAG\tDIGEST\tLPM\tEOL\tFINDINGS")
+		for _, image := range report.Images {
+			findings := strings.Join(image.Findings, ",")
+			switch {
+			case image.Error != "":
+				findings = "error"
+			case findings == "":
+				findings = "ok"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", image.Repository, image.Tag, image.Digest, image.LpmArtifact, image.EolDate, findings)
+		}
+		w.Flush()
+	}
+
+	return nil
+}
+
+// auditImage audits a tagged image of the repository that remote is a client of:
+// it checks that an lpm artifact is attached to the image and still matches it,
+// and that the end of life dates declared for the image are not passed or approaching.
+func (auditCmd *auditCmd) auditImage(ctx context.Context, registry *content.Registry, remote *remoteRepository, ref string, image *auditedImage, now time.Time) error {
+	b, desc, err := fetchManifest(ctx, registry, ref)
+	if err != nil {
+		return err
+	}
+	image.Digest = desc.Digest.String()
+	image.skipped, err = isArtifact(b)
+	if image.skipped || err != nil {
+		return err
+	}
+
+	repository := auditCmd.registry + "/" + image.Repository
+
+	// Check the lpm artifact. An image analyzed several times has several lpm artifacts, the most recently created one is checked.
+	lpmDescs, err := remote.referrersOfType(ctx, desc.Digest, mediaTypeForManifestLpm)
+	if err != nil {
+		return err
+	}
+	if len(lpmDescs) == 0 {
+		image.Findings = append(image.Findings, auditFindingMissingLpm)
+	} else {
+		lpmDesc := latestReferrer(lpmDescs)
+		image.LpmArtifact = lpmDesc.Digest.String()
+		loaded, lpmIndex, err := loadLpmManifests(ctx, registry, fmt.Sprintf("%s@%s", repository, lpmDesc.Digest))
+		if err != nil {
+			return err
+		}
+		drifts, _, err := lpmDrifts(ctx, registry, loaded, lpmIndex, fmt.Sprintf("%s@%s", repository, desc.Digest))
+		if err != nil {
+			return err
+		}
+		if len(drifts) > 0 {
+			image.Findings = append(image.Findings, auditFindingStaleLpm)
+		}
+	}
+
+	// Check the earliest end of life date.
+	declarations, err := fetchEolDeclarations(ctx, registry, remote, repository, desc.Digest)
+	if err != nil {
+		return err
+	}
+	var earliest time.Time
+	for _, declaration := range declarations {
+		date, err := parseEolDate(declaration.Date)
+		if err != nil {
+			if !containsString(image.Findings, auditFindingEolInvalid) {
+				image.Findings = append(image.Findings, auditFindingEolInvalid)
+			}
+			continue
+		}
+		if image.EolDate == "" || date.Before(earliest) {
+			earliest, image.EolDate = date, declaration.Date
+		}
+	}
+	switch {
+	case image.EolDate == "":
+	case earliest.Before(now):
+		image.Findings = append(image.Findings, auditFindingEolPassed)
+	case earliest.Before(now.AddDate(0, 0, auditCmd.warnDays)):
+		image.Findings = append(image.Findings, auditFindingEolApproaching)
+	}
+
+	return nil
+}
+
+// isArtifact returns whether a manifest (or index) is an artifact (such as an lpm artifact or a signature) rather than an image.
+func isArtifact(b []byte) (bool, error) {
+	if isImageIndex(b) {
+		var index artifactIndex
+		if err := json.Unmarshal(b, &index); err != nil {
+			return false, err
+		}
+		return index.ArtifactType != "" || index.Subject != nil, nil
+	}
+	var manifest artifactManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return false, err
+	}
+	if manifest.ArtifactType != "" || manifest.Subject != nil {
+		return true, nil
+	}
+	configMediaType := manifest.Config.MediaType
+	return configMediaType != ocispecv1.MediaTypeImageConfig && configMediaType != string(types.DockerConfigJSON), nil
+}
+
+// isReferrersTag returns whether a tag is a referrers tag schema tag ("<alg>-<ref>"), or a tag derived from one (such as "<alg>-<ref>.sig").
+func isReferrersTag(tag string) bool {
+	tag = strings.SplitN(tag, ".", 2)[0]
+	return digest.Digest(strings.Replace(tag, "-", ":", 1)).Validate() == nil
+}
+
+// listCatalog lists the repositories of a registry through the catalog API.
+func listCatalog(ctx context.Context, host string, registryOptions *registryOptions) ([]string, error) {
+	config := registryOptions.configFor(host)
+	nameOptions := make([]name.Option, 0)
+	if config.usePlainHTTP(host) {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	registry, err := name.NewRegistry(host, nameOptions...)
+	if err != nil {
+		return nil, err
+	}
+	authenticator, err := registryOptions.authenticator(registry)
+	if err != nil {
+		return nil, err
+	}
+	roundTripper, err := registryOptions.transport(config)
+	if err != nil {
+		return nil, err
+	}
+	t, err := transport.NewWithContext(ctx, registry, authenticator, roundTripper, []string{registry.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: t}
+
+	repositories := make([]string, 0)
+	for endpoint := fmt.Sprintf("%s://%s/v2/_catalog", config.scheme(host), host); endpoint != ""; {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = transport.CheckError(resp, http.StatusOK)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		if err == nil {
+			endpoint, err = nextPageURL(resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, page.Repositories...)
+	}
+	return repositories, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	reg, host := newTestRegistry(t, false)
+	reg.denied["denied"] = true
+	remote, err := newRemoteRepository(ctx, host+"/app:1", &registryOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// app:1 has a matching lpm manifest (and an older one, of a previous build, listed after it), app:2 has none,
+	// and app:3 has one describing another image.
+	// The lpm manifests are attached through the referrers tag schema, and one of them is also tagged.
+	image1, image2, image3 := testImageManifest("app1", 2), testImageManifest("app2", 2), testImageManifest("app3", 2)
+	desc1, desc3 := pushTestManifest(t, remote, "1", image1), pushTestManifest(t, remote, "3", image3)
+	pushTestManifest(t, remote, "2", image2)
+	for _, attached := range []struct {
+		subject artifactDescriptor
+		lpm     artifactManifest
+		lpmTag  string
+		created string
+	}{
+		{subject: desc1, lpm: testLpmManifest(desc1, image1), lpmTag: "1-lpm", created: "2023-06-01T10:00:00Z"},
+		{subject: desc1, lpm: testLpmManifest(desc1, image3), created: "2023-01-01T10:00:00Z"},
+		{subject: desc3, lpm: testLpmManifest(desc3, image1)},
+	} {
+		if attached.created != "" {
+			attached.lpm.Annotations = map[string]string{ocispecv1.AnnotationCreated: attached.created}
+		}
+		lpmDesc := pushTestManifest(t, remote, attached.lpmTag, attached.lpm)
+		lpmDesc.Annotations = attached.lpm.Annotations
+		if err := remote.attachReferrer(ctx, attached.subject.Digest, lpmDesc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	auditCmd := &auditCmd{
+		stdin:    strings.NewReader(""),
+		stdout:   &stdout,
+		stderr:   &stderr,
+		registry: host,
+		warnDays: 30,
+		workers:  2,
+		format:   "json",
+	}
+	if err := auditCmd.run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var report audit
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	// The images as "<repository>:<tag> <findings>", or "<repository>:<tag> error" for the images that could not be audited
+	// (without a tag for a repository whose tags cannot be listed).
+	images := make([]string, 0)
+	for _, image := range report.Images {
+		if image.Error != "" {
+			images = append(images, fmt.Sprintf("%s:%s error", image.Repository, image.Tag))
+			continue
+		}
+		images = append(images, fmt.Sprintf("%s:%s %v", image.Repository, image.Tag, image.Findings))
+	}
+	want := []string{
+		"app:1 []",
+		"app:2 [missing-lpm]",
+		"app:3 [stale-lpm]",
+		"denied: error",
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("audited images = %q, want %q", images, want)
+	}
+	if !strings.Contains(stderr.String(), fmt.Sprintf("could not list the tags of '%s/denied'", host)) {
+		t.Errorf("stderr = %q, want a warning about the tags of the denied repository", stderr.String())
+	}
+}
+
+func TestIsArtifact(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     bool
+		wantErr  bool
+	}{
+		{
+			name:     "OCI image",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`,
+			want:     false,
+		},
+		{
+			name:     "Docker image",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`,
+			want:     false,
+		},
+		{
+			name:     "lpm manifest with an artifact type",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/io.azurecr.distribution.manifest.v2.lpm.v1+json","config":{"mediaType":"application/io.azurecr.container.image.v1.lpm.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`,
+			want:     true,
+		},
+		{
+			name:     "signature with a subject and an image config",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc","size":100}}`,
+			want:     true,
+		},
+		{
+			name:     "artifact without artifact type or subject",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/io.azurecr.container.image.v1.eol.v1+json","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`,
+			want:     true,
+		},
+		{
+			name:     "multi-platform image",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc","size":100,"platform":{"os":"linux","architecture":"amd64"}}]}`,
+			want:     false,
+		},
+		{
+			name:     "lpm index",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","artifactType":"application/io.azurecr.distribution.manifest.v2.lpm.v1+json","manifests":[]}`,
+			want:     true,
+		},
+		{
+			name:     "referrers tag schema index",
+			manifest: `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[],"subject":{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc","size":100}}`,
+			want:     true,
+		},
+		{
+			name:     "invalid manifest",
+			manifest: `{"schemaVersion":`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isArtifact([]byte(tt.manifest))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("isArtifact() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("isArtifact() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsReferrersTag(t *testing.T) {
+	hex := "7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc"
+
+	tests := []struct {
+		tag  string
+		want bool
+	}{
+		{tag: "sha256-" + hex, want: true},
+		{tag: "sha256-" + hex + ".sig", want: true},
+		{tag: "sha256-" + hex + ".att", want: true},
+		{tag: "sha512-" + strings.Repeat("ab", 64), want: true},
+		{tag: "latest", want: false},
+		{tag: "1.0", want: false},
+		{tag: "3.10-slim", want: false},
+		{tag: "sha256", want: false},
+		{tag: "sha256-", want: false},
+		{tag: "sha256-abc", want: false},
+		{tag: "sha256-" + strings.ToUpper(hex), want: false},
+		{tag: "sha256-" + hex + "-1", want: false},
+		{tag: "md5-" + hex[:32], want: false},
+		{tag: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := isReferrersTag(tt.tag); got != tt.want {
+			t.Errorf("isReferrersTag(%q) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+}
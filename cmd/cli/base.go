@@ -0,0 +1,148 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+// baseImage is the base image that a subject image was built on.
+type baseImage struct {
+	// ref is the base image reference.
+	ref string
+	// repository is the base image's repository (registry host and repository name).
+	repository string
+	// desc describes the base image manifest (for a multi-platform base image, the manifest of the subject image's platform).
+	desc ocispecv1.Descriptor
+	// layers are the base image's layers, from the bottom layer to the top layer.
+	layers []goocispecv1.Descriptor
+	// config is the base image's config.
+	config *goocispecv1.ConfigFile
+}
+
+// normalizeImageRef returns the fully qualified form of an image reference as written in a Dockerfile "FROM" command,
+// for example "docker.io/library/ubuntu:22.04" for "ubuntu:22.04".
+func normalizeImageRef(ref string) (string, error) {
+	parsedRef, err := name.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	// go-containerregistry names Docker Hub "index.docker.io", while the ORAS registry client expects "docker.io".
+	registry := parsedRef.Context().RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = "docker.io"
+	}
+
+	separator := ":"
+	if _, ok := parsedRef.(name.Digest); ok {
+		separator = "@"
+	}
+	return registry + "/" + parsedRef.Context().RepositoryStr() + separator + parsedRef.Identifier(), nil
+}
+
+// fetchBaseImage fetches the manifest of the base image.
+// For a multi-platform base image, the manifest of the given platform is fetched.
+func fetchBaseImage(ctx context.Context, registry *content.Registry, ref string, platform *goocispecv1.Platform) (*baseImage, error) {
+	normalizedRef, err := normalizeImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestBytes, desc, err := fetchManifest(ctx, registry, normalizedRef)
+	if err != nil {
+		return nil, err
+	}
+	repository, err := repositoryOf(normalizedRef)
+	if err != nil {
+		return nil, err
+	}
+
+	if isImageIndex(manifestBytes) {
+		if platform == nil {
+			return nil, fmt.Errorf("base image '%s' is a multi-platform image but the subject image's platform is unknown", ref)
+		}
+		index, err := goocispecv1.ParseIndexManifest(bytes.NewReader(manifestBytes))
+		if err != nil {
+			return nil, err
+		}
+
+		// Select the base image manifest of the subject image's platform.
+		var platformDesc *goocispecv1.Descriptor
+		for i, d := range index.Manifests {
+			if d.Annotations[annotationKeyForDockerReferenceType] == "attestation-manifest" {
+				continue
+			}
+			if platformMatches(d.Platform, []*goocispecv1.Platform{platform}) {
+				platformDesc = &index.Manifests[i]
+				break
+			}
+		}
+		if platformDesc == nil {
+			return nil, fmt.Errorf("base image '%s' has no manifest for platform '%s'", ref, platformString(platform))
+		}
+
+		desc = toOCIDescriptor(*platformDesc)
+		manifestBytes, err = fetchContent(ctx, registry, fmt.Sprintf("%s@%s", repository, desc.Digest), desc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := goocispecv1.ParseManifest(bytes.NewReader(manifestBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch the base image config, whose labels describe who provides the base image.
+	configBytes, err := fetchContent(ctx, registry, fmt.Sprintf("%s@%s", repository, manifest.Config.Digest), toOCIDescriptor(manifest.Config))
+	if err != nil {
+		return nil, err
+	}
+	config, err := goocispecv1.ParseConfigFile(bytes.NewReader(configBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return &baseImage{ref: ref, repository: repository, desc: desc, layers: manifest.Layers, config: config}, nil
+}
+
+// commonLayerPrefix returns the number of bottom layers that the subject image shares with its base image,
+// which is the length of the longest common prefix of their layer digests.
+// These are exactly the layers that the subject image inherited from its base image.
+//
+// When both images' configs are known, layers are also matched by their DiffIDs (the digests of their uncompressed content),
+// since the same layer has another digest when it is compressed differently (for example, in a "docker save" tarball).
+func commonLayerPrefix(base *baseImage, subjectLayers []goocispecv1.Descriptor, subjectConfig *goocispecv1.ConfigFile) int {
+	var baseDiffIDs, subjectDiffIDs []goocispecv1.Hash
+	if base.config != nil && subjectConfig != nil {
+		baseDiffIDs, subjectDiffIDs = base.config.RootFS.DiffIDs, subjectConfig.RootFS.DiffIDs
+	}
+
+	n := 0
+	for n < len(base.layers) && n < len(subjectLayers) {
+		sameDigest := base.layers[n].Digest == subjectLayers[n].Digest
+		sameDiffID := n < len(baseDiffIDs) && n < len(subjectDiffIDs) && baseDiffIDs[n] == subjectDiffIDs[n]
+		if !sameDigest && !sameDiffID {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// isResolvableBaseImage returns whether a Dockerfile "FROM" base can be fetched from a registry.
+// "scratch" has no layers, and bases that use build arguments cannot be resolved without the build's arguments.
+func isResolvableBaseImage(base string) bool {
+	return !strings.EqualFold(base, "scratch") && !strings.Contains(base, "$")
+}
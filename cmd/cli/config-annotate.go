@@ -10,26 +10,39 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
 
+	digest "github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go"
 	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 	"oras.land/oras-go/pkg/content"
 	"oras.land/oras-go/pkg/oras"
+	"sigs.k8s.io/yaml"
 )
 
 type configAnnotateCmd struct {
 	stdin                  io.Reader
 	stdout                 io.Writer
 	stderr                 io.Writer
-	username               string
-	password               string
+	registryOptions        registryOptions
 	subjectImageRef        string
 	manifestMediaType      string
 	configMediaType        string
 	annotationSlice        []string
+	annotationsFile        string
+	manifestAnnotations    []string
+	files                  []string
+	configFile             string
 	lpmManifestArtifactRef string
+	attach                 bool
+	signKey                string
 	output                 string
 }
 
@@ -42,18 +55,24 @@ func newConfigAnnotateCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, a
 
 	cobraCmd := &cobra.Command{
 		Use:   "config-annotate",
-		Short: "TODO",
+		Short: "generate an artifact (such as an eol artifact) whose config carries the given annotations, and push it as a referrer of a subject image",
 		Example: `lpm config-annotate \
---username 						username \
---password 						password \
+[--username 					username] \
+[--password-stdin] \
 --subject-image-ref 			myregistry.myserver.io/myimage:latest (or myimage@digest) \
 --manifest-media-type 			"application/io.azurecr.distribution.manifest.v2.eol.v1+json" \
 --config-media-type 			"application/io.azurecr.container.image.v1.eol.v1+json" \
---annotation 					"io.azurecr.eol.v1.subject.eol.date:2025-01-01" \
---annotation 					"io.azurecr.eol.v1.subject.eol.reason:end-of-maintenance" \
---annotation 					"io.azurecr.eol.v1.subject.eol.description:This image will no longer be maintained by the maintainer." \
---annotation 					"io.azurecr.eol.v1.subject.eol.support.url:https://docs.microsoft.com/en-us/azure/container-registry/container-registry-eol" \
+--annotation 					"io.azurecr.eol.v1.subject.eol.date=2025-01-01" \
+--annotation 					"io.azurecr.eol.v1.subject.eol.reason=end-of-maintenance" \
+--annotation 					"io.azurecr.eol.v1.subject.eol.description=This image will no longer be maintained by the maintainer." \
+--annotation 					"io.azurecr.eol.v1.subject.eol.support.url=https://docs.microsoft.com/en-us/azure/container-registry/container-registry-eol" \
+[--annotations-file 			eol-annotations.yaml] \
+[--manifest-annotation 			"org.opencontainers.image.created={{.Now}}"] \
+[--file 						migration-guide.md:text/markdown] \
+[--config-file 					eol-config.json] \
 [--lpm-manifest-artifact-ref 	myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest)] \
+[--attach] \
+[--sign-key 					eol-signing-key.pem] \
 [--output 						lpm-output-copy.json]
 `,
 		RunE: func(_ *cobra.Command, args []string) error {
@@ -63,14 +82,7 @@ func newConfigAnnotateCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, a
 
 	f := cobraCmd.Flags()
 
-	var usernameLongFlag = "username"
-	f.StringVarP(&configAnnotateCmd.username, usernameLongFlag, "u", "", "username to use for authentication with the registry")
-	cobraCmd.MarkFlagRequired(usernameLongFlag)
-
-	// TODO add support for --password-stdin (reading password from stdin) for more secure password input.
-	var passwordLongFlag = "password"
-	f.StringVarP(&configAnnotateCmd.password, passwordLongFlag, "p", "", "password to use for authentication with the registry")
-	cobraCmd.MarkFlagRequired(passwordLongFlag)
+	addRegistryFlags(f, &configAnnotateCmd.registryOptions)
 
 	var subjectImageRefLongFlag = "subject-image-ref"
 	f.StringVarP(&configAnnotateCmd.subjectImageRef, subjectImageRefLongFlag, "s", "", "subject image reference of the config annotation")
@@ -84,19 +96,143 @@ func newConfigAnnotateCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, a
 	f.StringVarP(&configAnnotateCmd.configMediaType, configMediaTypeLongFlag, "c", "", "mediaType of the generated manifest's config")
 	cobraCmd.MarkFlagRequired(configMediaTypeLongFlag)
 
-	var annotationSliceLongFlag = "annotation"
-	f.StringArrayVarP(&configAnnotateCmd.annotationSlice, annotationSliceLongFlag, "a", []string{}, "annotation to add to the generated manifest's config")
-	cobraCmd.MarkFlagRequired(annotationSliceLongFlag)
+	f.StringArrayVarP(&configAnnotateCmd.annotationSlice, "annotation", "a", []string{}, "(optional) annotation to add to the generated manifest's config, as 'key=value' (or 'key:value', which trims the whitespace after the colon), can be repeated; values can use the templates {{.SubjectRef}}, {{.SubjectDigest}} and {{.Now}}")
+
+	f.StringVar(&configAnnotateCmd.annotationsFile, "annotations-file", "", "(optional) JSON or YAML file with a map of annotations to add to the generated manifest's config, which --annotation overrides")
+
+	f.StringArrayVar(&configAnnotateCmd.manifestAnnotations, "manifest-annotation", []string{}, "(optional) annotation to add to the generated manifest itself, with the same syntax as --annotation, can be repeated")
+
+	f.StringArrayVar(&configAnnotateCmd.files, "file", []string{}, "(optional) file to add as a layer of the generated manifest, as 'path[:mediaType]' (default mediaType: '"+content.DefaultBlobMediaType+"'), can be repeated")
+
+	f.StringVar(&configAnnotateCmd.configFile, "config-file", "", "(optional) file to use as the generated manifest's config, with the --config-media-type mediaType (default: an empty JSON object)")
 
 	var lpmManifestArtifactRefLongFlag = "lpm-manifest-artifact-ref"
 	f.StringVarP(&configAnnotateCmd.lpmManifestArtifactRef, lpmManifestArtifactRefLongFlag, "t", "", "(optional) target artifact ref in which the generated manifest file (with config annotations) will be pushed to as an ORAS referrer to the subject image")
 
+	f.BoolVar(&configAnnotateCmd.attach, "attach", false, "(optional) push the generated manifest to the subject image's repository as a referrer of the subject image, using the referrers API or the referrers tag schema on registries without it")
+
+	f.StringVar(&configAnnotateCmd.signKey, "sign-key", "", "(optional) PEM private key file (ECDSA, RSA or Ed25519) to sign the pushed manifest with, the cosign signature is pushed as a referrer of the manifest wherever the manifest is pushed")
+
 	f.StringVarP(&configAnnotateCmd.output, "output", "o", "", "(optional) output file to also write the generated manifest file (with config annotations) (default: stdout)")
 
 	return cobraCmd
 }
 
 func (configAnnotateCmd *configAnnotateCmd) run() error {
+	// Process annotations by turning them into a map, the flags overriding the annotations file.
+	annotationsMap := make(map[string]string)
+	if configAnnotateCmd.annotationsFile != "" {
+		b, err := os.ReadFile(configAnnotateCmd.annotationsFile)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, &annotationsMap); err != nil {
+			return fmt.Errorf("invalid annotations file '%s', expected a map of annotation keys to string values: %w", configAnnotateCmd.annotationsFile, err)
+		}
+	}
+	for _, rawAnnotation := range configAnnotateCmd.annotationSlice {
+		key, value, err := parseAnnotation(rawAnnotation)
+		if err != nil {
+			return err
+		}
+		annotationsMap[key] = value
+	}
+
+	manifestAnnotationsMap := make(map[string]string)
+	for _, rawAnnotation := range configAnnotateCmd.manifestAnnotations {
+		key, value, err := parseAnnotation(rawAnnotation)
+		if err != nil {
+			return err
+		}
+		manifestAnnotationsMap[key] = value
+	}
+
+	return configAnnotateCmd.annotate(annotationsMap, manifestAnnotationsMap)
+}
+
+// parseAnnotation parses an annotation flag, which is either 'key=value' (the value is kept as is),
+// or 'key:value' (the whitespace after the colon is trimmed), whichever separator comes first.
+func parseAnnotation(rawAnnotation string) (string, string, error) {
+	i := strings.IndexAny(rawAnnotation, "=:")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid annotation '%s', expected 'key=value' or 'key:value'", rawAnnotation)
+	}
+	key, value := rawAnnotation[:i], rawAnnotation[i+1:]
+	if rawAnnotation[i] == ':' {
+		value = strings.TrimLeftFunc(value, unicode.IsSpace)
+	}
+	return key, value, nil
+}
+
+// annotationTemplateData is the data that annotation values are rendered with as Go templates.
+type annotationTemplateData struct {
+	// SubjectRef is the reference of the subject image, as given.
+	SubjectRef string
+	// SubjectDigest is the digest of the subject image's manifest (or index).
+	SubjectDigest string
+	// Now is the current time, in RFC 3339 format (UTC).
+	Now string
+}
+
+// templateAction matches the start of a Go template action on the template data (such as "{{.SubjectDigest}}" or "{{ .Now }}").
+var templateAction = regexp.MustCompile(`{{-?\s*\.`)
+
+// isTemplate returns whether an annotation value is a Go template, rather than a value that merely contains "{{" (such as "see {{ in the docs").
+func isTemplate(value string) bool {
+	return templateAction.MatchString(value)
+}
+
+// renderAnnotations renders the annotation values that are Go templates (such as "{{.SubjectDigest}}") in place.
+func renderAnnotations(annotations map[string]string, data annotationTemplateData) error {
+	for key, value := range annotations {
+		if !isTemplate(value) {
+			continue
+		}
+		t, err := template.New(key).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid template in annotation '%s': %w", key, err)
+		}
+		var rendered strings.Builder
+		if err := t.Execute(&rendered, data); err != nil {
+			return fmt.Errorf("invalid template in annotation '%s': %w", key, err)
+		}
+		annotations[key] = rendered.String()
+	}
+	return nil
+}
+
+// hasTemplate returns whether any of the annotation values is a Go template.
+func hasTemplate(annotations ...map[string]string) bool {
+	for _, m := range annotations {
+		for _, value := range m {
+			if isTemplate(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// annotate generates a manifest whose config (and the manifest itself) has the given annotations, writes it to the output, and pushes it if asked to.
+func (configAnnotateCmd *configAnnotateCmd) annotate(annotationsMap map[string]string, manifestAnnotationsMap map[string]string) error {
+	// Read the registry password from stdin if needed.
+	if err := configAnnotateCmd.registryOptions.complete(configAnnotateCmd.stdin, registryHost(configAnnotateCmd.subjectImageRef), registryHost(configAnnotateCmd.lpmManifestArtifactRef)); err != nil {
+		return err
+	}
+
+	// Read the signing key.
+	var key *signingKey
+	if configAnnotateCmd.signKey != "" {
+		if !configAnnotateCmd.pushing() {
+			return fmt.Errorf("--sign-key requires --lpm-manifest-artifact-ref or --attach")
+		}
+		var err error
+		key, err = loadSigningKey(configAnnotateCmd.signKey)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Set output writer.
 	var out io.Writer
 	if configAnnotateCmd.output == "" {
@@ -110,44 +246,50 @@ func (configAnnotateCmd *configAnnotateCmd) run() error {
 		out = f
 	}
 
-	// Process annotations by turning them into a map.
-	re := regexp.MustCompile(`:\s*`)
-	annotationsMap := make(map[string]string)
-	for _, rawAnnotation := range configAnnotateCmd.annotationSlice {
-		annotation := re.Split(rawAnnotation, 2)
-		if len(annotation) != 2 {
-			return fmt.Errorf("invalid annotation: %s", rawAnnotation)
-		}
-		annotationsMap[annotation[0]] = annotation[1]
-		configAnnotateCmd.stderr.Write([]byte(fmt.Sprintf("[*] annotation: '%s: %s'\n", annotation[0], annotation[1])))
-	}
-
 	ctx := context.Background()
 
-	// Create a new ORAS memory store.
-	memoryStore := content.NewMemory()
-
-	layerDescs := make([]ocispecv1.Descriptor, 0)
-	manifest, manifestDesc, config, configDesc, err := content.GenerateManifestAndConfig(nil, nil, layerDescs...)
+	// Create a registry store.
+	registry, err := newRegistry(&configAnnotateCmd.registryOptions)
 	if err != nil {
 		return err
 	}
 
-	// Set the reference config descriptor's mediaType because content.GenerateConfig() sets the mediaType to "application/vnd.unknown.config.v1+json".
-	// See https://github.com/oras-project/oras-go/blob/v1.1.1/pkg/content/manifest.go#L41-L52
-	configDesc.MediaType = configAnnotateCmd.configMediaType
+	// Resolve the subject image manifest's descriptor if we are supposed to push the generated manifest,
+	// so that the generated manifest can refer to the subject image as its subject,
+	// or if annotation templates are to be rendered with the subject image's digest.
+	var subjectDesc *ocispecv1.Descriptor
+	templateData := annotationTemplateData{
+		SubjectRef: configAnnotateCmd.subjectImageRef,
+		Now:        time.Now().UTC().Format(time.RFC3339),
+	}
+	if configAnnotateCmd.pushing() || hasTemplate(annotationsMap, manifestAnnotationsMap) {
+		_, desc, err := registry.Resolve(ctx, configAnnotateCmd.subjectImageRef)
+		if err != nil {
+			return err
+		}
+		templateData.SubjectDigest = desc.Digest.String()
+		if configAnnotateCmd.pushing() {
+			subjectDesc = &desc
+		}
+	}
 
-	// Add the config annotations to the config.
-	configDesc.Annotations = annotationsMap
+	// Render the annotation templates.
+	if err := renderAnnotations(annotationsMap, templateData); err != nil {
+		return err
+	}
+	if err := renderAnnotations(manifestAnnotationsMap, templateData); err != nil {
+		return err
+	}
+	writeAnnotations(configAnnotateCmd.stderr, "annotation", annotationsMap)
+	writeAnnotations(configAnnotateCmd.stderr, "manifest annotation", manifestAnnotationsMap)
 
-	// Write the complete reference manifest (with reference config and reference layers) to output.
-	completeManifest := ocispecv1.Manifest{
-		Versioned:   ocispecs.Versioned{SchemaVersion: int(2)},
-		MediaType:   configAnnotateCmd.manifestMediaType,
-		Config:      configDesc,
-		Layers:      layerDescs,
-		Annotations: map[string]string{},
+	// Generate the manifest in a memory store.
+	memoryStore, completeManifest, manifestDesc, err := configAnnotateCmd.newArtifact(annotationsMap, manifestAnnotationsMap, subjectDesc)
+	if err != nil {
+		return err
 	}
+
+	// Write the complete reference manifest (with reference config and reference layers) to output.
 	completeManifestJsonString, err := json.MarshalIndent(completeManifest, "", "	")
 	if err != nil {
 		return err
@@ -155,32 +297,148 @@ func (configAnnotateCmd *configAnnotateCmd) run() error {
 	out.Write(completeManifestJsonString)
 
 	// Return early if we are not supposed to push the generated manifest to a registry.
-	if configAnnotateCmd.lpmManifestArtifactRef == "" {
+	if !configAnnotateCmd.pushing() {
 		return nil
 	}
 
-	// Add the reference manifest and reference config to the memory store.
-	memoryStore.Set(configDesc, config)
-	err = memoryStore.StoreManifest(configAnnotateCmd.lpmManifestArtifactRef, manifestDesc, manifest)
-	if err != nil {
-		return err
+	if configAnnotateCmd.lpmManifestArtifactRef != "" {
+		fmt.Fprintf(configAnnotateCmd.stderr, "[*] Pushing to '%s' as an ORAS reference to subject image '%s'...\n", configAnnotateCmd.lpmManifestArtifactRef, configAnnotateCmd.subjectImageRef)
+
+		// Push the reference manifest.
+		desc, err := oras.Copy(ctx, memoryStore, memoryStoreArtifactName, registry, configAnnotateCmd.lpmManifestArtifactRef)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(configAnnotateCmd.stderr, "Pushed to '%s' with digest '%s'\n", configAnnotateCmd.lpmManifestArtifactRef, desc.Digest)
+
+		if key != nil {
+			if err := pushSignature(ctx, registry, configAnnotateCmd.lpmManifestArtifactRef, &configAnnotateCmd.registryOptions, manifestDesc.Descriptor, key, configAnnotateCmd.stderr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if configAnnotateCmd.attach {
+		// Push the reference manifest as a referrer of the subject image.
+		err := attachArtifact(ctx, registry, memoryStore, configAnnotateCmd.subjectImageRef, &configAnnotateCmd.registryOptions, []referrer{{subject: subjectDesc.Digest, desc: manifestDesc}}, configAnnotateCmd.stderr)
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			return pushSignature(ctx, registry, configAnnotateCmd.subjectImageRef, &configAnnotateCmd.registryOptions, manifestDesc.Descriptor, key, configAnnotateCmd.stderr)
+		}
 	}
 
-	// Create a local registry store.
-	registry, err := content.NewRegistry(content.RegistryOptions{Username: configAnnotateCmd.username, Password: configAnnotateCmd.password})
+	return nil
+}
+
+// newArtifact generates the manifest whose config (and the manifest itself) has the given annotations, with the files as layers,
+// and stores it in a new memory store under memoryStoreArtifactName, together with its config and layers.
+// The manifest is an OCI image manifest whose artifact type is the given manifest media type,
+// so that it can be pushed to any OCI registry and discovered through the referrers of its subject image.
+func (configAnnotateCmd *configAnnotateCmd) newArtifact(annotationsMap map[string]string, manifestAnnotationsMap map[string]string, subjectDesc *ocispecv1.Descriptor) (*content.Memory, artifactManifest, artifactDescriptor, error) {
+	// Create a new ORAS memory store.
+	memoryStore := content.NewMemory()
+
+	// Add the files to the memory store as the reference layers.
+	layerDescs, err := addFileLayers(memoryStore, configAnnotateCmd.files)
 	if err != nil {
-		return err
+		return nil, artifactManifest{}, artifactDescriptor{}, err
 	}
 
-	fmt.Printf("[*] Pushing to '%s' as an ORAS reference to subject image '%s'...\n", configAnnotateCmd.lpmManifestArtifactRef, configAnnotateCmd.subjectImageRef)
+	// Use the config file as the reference config, or generate an empty config.
+	var config []byte
+	var configDesc ocispecv1.Descriptor
+	if configAnnotateCmd.configFile != "" {
+		config, err = os.ReadFile(configAnnotateCmd.configFile)
+		if err != nil {
+			return nil, artifactManifest{}, artifactDescriptor{}, err
+		}
+		configDesc = ocispecv1.Descriptor{Digest: digest.FromBytes(config), Size: int64(len(config))}
+	} else {
+		config, configDesc, err = content.GenerateConfig(nil)
+		if err != nil {
+			return nil, artifactManifest{}, artifactDescriptor{}, err
+		}
+	}
+
+	// Set the reference config descriptor's mediaType because content.GenerateConfig() sets the mediaType to "application/vnd.unknown.config.v1+json".
+	// See https://github.com/oras-project/oras-go/blob/v1.1.1/pkg/content/manifest.go#L41-L52
+	configDesc.MediaType = configAnnotateCmd.configMediaType
+
+	// Add the config annotations to the config.
+	configDesc.Annotations = annotationsMap
+
+	// Create the complete reference manifest (with reference config and reference layers).
+	completeManifest := artifactManifest{
+		Manifest: ocispecv1.Manifest{
+			Versioned:   ocispecs.Versioned{SchemaVersion: int(2)},
+			MediaType:   ocispecv1.MediaTypeImageManifest,
+			Config:      configDesc,
+			Layers:      layerDescs,
+			Annotations: manifestAnnotationsMap,
+		},
+		ArtifactType: configAnnotateCmd.manifestMediaType,
+		Subject:      subjectDesc,
+	}
 
-	// Push the reference manifest.
-	// TODO add an ORAS reference from the reference manifest to the subject image ref.
-	desc, err := oras.Copy(ctx, memoryStore, configAnnotateCmd.lpmManifestArtifactRef, registry, "")
+	// Add the reference manifest and reference config to the memory store.
+	manifest, manifestDesc, err := marshalArtifact(ocispecv1.MediaTypeImageManifest, configAnnotateCmd.manifestMediaType, completeManifest)
 	if err != nil {
-		return err
+		return nil, artifactManifest{}, artifactDescriptor{}, err
+	}
+	memoryStore.Set(configDesc, config)
+	if err := memoryStore.StoreManifest(memoryStoreArtifactName, manifestDesc.Descriptor, manifest); err != nil {
+		return nil, artifactManifest{}, artifactDescriptor{}, err
 	}
-	fmt.Printf("Pushed to '%s' with digest '%s'\n", configAnnotateCmd.lpmManifestArtifactRef, desc.Digest)
 
-	return nil
+	return memoryStore, completeManifest, manifestDesc, nil
+}
+
+// addFileLayers adds files to the memory store as layers, each given as 'path[:mediaType]',
+// and returns the layers' descriptors, which are titled with the files' names (as ORAS does) so that the files can be pulled by name.
+func addFileLayers(memoryStore *content.Memory, files []string) ([]ocispecv1.Descriptor, error) {
+	layerDescs := make([]ocispecv1.Descriptor, 0)
+	names := make(map[string]string)
+	for _, file := range files {
+		// The mediaType is after the last colon, if what follows it looks like a mediaType ("type/subtype"),
+		// so that paths with colons can still be given without a mediaType.
+		path, mediaType := file, ""
+		if i := strings.LastIndex(file, ":"); i > 0 && strings.Contains(file[i+1:], "/") {
+			path, mediaType = file[:i], file[i+1:]
+		}
+		name := filepath.Base(path)
+		if previous, ok := names[name]; ok {
+			return nil, fmt.Errorf("files '%s' and '%s' have the same name '%s'", previous, path, name)
+		}
+		names[name] = path
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := memoryStore.Add(name, mediaType, b)
+		if err != nil {
+			return nil, err
+		}
+		layerDescs = append(layerDescs, desc)
+	}
+	return layerDescs, nil
+}
+
+// writeAnnotations writes annotations (sorted by key) as progress lines.
+func writeAnnotations(w io.Writer, what string, annotations map[string]string) {
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "[*] %s: '%s: %s'\n", what, k, annotations[k])
+	}
+}
+
+// pushing returns whether the generated manifest is supposed to be pushed to a registry.
+func (configAnnotateCmd *configAnnotateCmd) pushing() bool {
+	return configAnnotateCmd.lpmManifestArtifactRef != "" || configAnnotateCmd.attach
 }
@@ -0,0 +1,296 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+func TestConfigAnnotateNewArtifact(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"guide.md":    "# Migration guide",
+		"report.json": `{"status":"eol"}`,
+		"config.json": `{"eol":true}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configAnnotateCmd := &configAnnotateCmd{
+		files: []string{
+			filepath.Join(dir, "guide.md") + ":text/markdown",
+			filepath.Join(dir, "report.json"),
+		},
+		configFile:        filepath.Join(dir, "config.json"),
+		configMediaType:   mediaTypeForConfigEol,
+		manifestMediaType: mediaTypeForManifestEol,
+	}
+	annotations := map[string]string{annotationKeyForSubjectEolDate: "2025-01-01"}
+	memoryStore, manifest, manifestDesc, err := configAnnotateCmd.newArtifact(annotations, map[string]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file is a layer titled with the file's name, with the given mediaType or the default one.
+	want := []struct {
+		name      string
+		mediaType string
+	}{
+		{name: "guide.md", mediaType: "text/markdown"},
+		{name: "report.json", mediaType: content.DefaultBlobMediaType},
+	}
+	if len(manifest.Layers) != len(want) {
+		t.Fatalf("manifest has %d layers, want %d", len(manifest.Layers), len(want))
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest != digest.FromString(files[want[i].name]) {
+			t.Errorf("layer %d digest = '%s', want the digest of '%s'", i, layer.Digest, want[i].name)
+		}
+		if layer.MediaType != want[i].mediaType {
+			t.Errorf("layer %d mediaType = %q, want %q", i, layer.MediaType, want[i].mediaType)
+		}
+		if title := layer.Annotations[ocispecv1.AnnotationTitle]; title != want[i].name {
+			t.Errorf("layer %d title = %q, want %q", i, title, want[i].name)
+		}
+		if _, b, ok := memoryStore.Get(layer); !ok || string(b) != files[want[i].name] {
+			t.Errorf("layer %d is not in the memory store with the content of '%s'", i, want[i].name)
+		}
+	}
+
+	// The config file is the config, which keeps its annotations.
+	config := manifest.Config
+	if config.Digest != digest.FromString(files["config.json"]) || config.MediaType != mediaTypeForConfigEol {
+		t.Errorf("config = '%s' (%s), want the config file with mediaType %q", config.Digest, config.MediaType, mediaTypeForConfigEol)
+	}
+	if !reflect.DeepEqual(config.Annotations, annotations) {
+		t.Errorf("config annotations = %v, want %v", config.Annotations, annotations)
+	}
+	if _, b, ok := memoryStore.Get(config); !ok || string(b) != files["config.json"] {
+		t.Errorf("config is not in the memory store with the content of the config file")
+	}
+
+	// The manifest is stored under the artifact name, with the artifact type.
+	_, desc, err := memoryStore.Resolve(context.Background(), memoryStoreArtifactName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, b, ok := memoryStore.Get(desc); !ok || desc.Digest != manifestDesc.Digest || digest.FromBytes(b) != manifestDesc.Digest {
+		t.Errorf("manifest is not in the memory store under '%s'", memoryStoreArtifactName)
+	}
+	if manifestDesc.ArtifactType != mediaTypeForManifestEol {
+		t.Errorf("manifest artifact type = %q, want %q", manifestDesc.ArtifactType, mediaTypeForManifestEol)
+	}
+}
+
+func TestConfigAnnotateNewArtifactWithoutConfigFile(t *testing.T) {
+	configAnnotateCmd := &configAnnotateCmd{
+		files:             []string{},
+		configMediaType:   mediaTypeForConfigEol,
+		manifestMediaType: mediaTypeForManifestEol,
+	}
+	annotations := map[string]string{annotationKeyForSubjectEolDate: "2025-01-01"}
+	_, manifest, _, err := configAnnotateCmd.newArtifact(annotations, map[string]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config is an empty JSON object with the config mediaType, which keeps its annotations.
+	if config := manifest.Config; config.Digest != digest.FromString("{}") || config.MediaType != mediaTypeForConfigEol {
+		t.Errorf("config = '%s' (%s), want an empty JSON object with mediaType %q", config.Digest, config.MediaType, mediaTypeForConfigEol)
+	}
+	if !reflect.DeepEqual(manifest.Config.Annotations, annotations) {
+		t.Errorf("config annotations = %v, want %v", manifest.Config.Annotations, annotations)
+	}
+	if len(manifest.Layers) != 0 {
+		t.Errorf("manifest has %d layers, want none", len(manifest.Layers))
+	}
+}
+
+func TestAddFileLayersRejectsSameName(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, sub, "guide.md"), []byte(sub), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := addFileLayers(content.NewMemory(), []string{filepath.Join(dir, "a", "guide.md"), filepath.Join(dir, "b", "guide.md")}); err == nil {
+		t.Errorf("addFileLayers() of two files with the same name succeeded, want an error")
+	}
+}
+
+func TestParseAnnotation(t *testing.T) {
+	tests := []struct {
+		rawAnnotation string
+		wantKey       string
+		wantValue     string
+		wantErr       bool
+	}{
+		{rawAnnotation: "key=value", wantKey: "key", wantValue: "value"},
+		{rawAnnotation: "key:value", wantKey: "key", wantValue: "value"},
+		{rawAnnotation: "key: value", wantKey: "key", wantValue: "value"},
+		{rawAnnotation: "key:\t  value ", wantKey: "key", wantValue: "value "},
+		{rawAnnotation: "key= value", wantKey: "key", wantValue: " value"},
+		{rawAnnotation: "key=", wantKey: "key", wantValue: ""},
+		{rawAnnotation: "key=a=b", wantKey: "key", wantValue: "a=b"},
+		{rawAnnotation: "url=https://example.com:8080/eol", wantKey: "url", wantValue: "https://example.com:8080/eol"},
+		{rawAnnotation: "url: https://example.com:8080/eol", wantKey: "url", wantValue: "https://example.com:8080/eol"},
+		{rawAnnotation: "io.azurecr.lpm.v1.subject.eol.date:2025-01-01T00:00:00Z", wantKey: "io.azurecr.lpm.v1.subject.eol.date", wantValue: "2025-01-01T00:00:00Z"},
+		{rawAnnotation: "value", wantErr: true},
+		{rawAnnotation: "=value", wantErr: true},
+		{rawAnnotation: ":value", wantErr: true},
+		{rawAnnotation: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		key, value, err := parseAnnotation(tt.rawAnnotation)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseAnnotation(%q) = %q, %q, want an error", tt.rawAnnotation, key, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAnnotation(%q) error = %v", tt.rawAnnotation, err)
+			continue
+		}
+		if key != tt.wantKey || value != tt.wantValue {
+			t.Errorf("parseAnnotation(%q) = %q, %q, want %q, %q", tt.rawAnnotation, key, value, tt.wantKey, tt.wantValue)
+		}
+	}
+}
+
+func TestRenderAnnotations(t *testing.T) {
+	data := annotationTemplateData{
+		SubjectRef:    "myregistry.azurecr.io/app:1",
+		SubjectDigest: "sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc",
+		Now:           "2023-06-01T10:00:00Z",
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "subject ref", value: "{{.SubjectRef}}", want: "myregistry.azurecr.io/app:1"},
+		{name: "subject digest", value: "image@{{ .SubjectDigest }}", want: "image@sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc"},
+		{name: "now", value: "{{.Now}}", want: "2023-06-01T10:00:00Z"},
+		{name: "several templates", value: "{{.SubjectRef}} at {{.Now}}", want: "myregistry.azurecr.io/app:1 at 2023-06-01T10:00:00Z"},
+		{name: "no template", value: "plain value", want: "plain value"},
+		{name: "literal braces", value: "use {{ and }} in Go templates", want: "use {{ and }} in Go templates"},
+		{name: "unclosed literal braces", value: "see {{ in the docs", want: "see {{ in the docs"},
+		{name: "unknown field", value: "{{.Subject}}", wantErr: true},
+		{name: "unclosed template", value: "{{.SubjectRef}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"key": tt.value}
+			err := renderAnnotations(annotations, data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("renderAnnotations(%q) = %q, want an error", tt.value, annotations["key"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if annotations["key"] != tt.want {
+				t.Errorf("renderAnnotations(%q) = %q, want %q", tt.value, annotations["key"], tt.want)
+			}
+			if got := hasTemplate(map[string]string{"key": tt.value}); got != (tt.value != tt.want) {
+				t.Errorf("hasTemplate(%q) = %v, want %v", tt.value, got, tt.value != tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigAnnotateAnnotationsFile(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	dir := t.TempDir()
+
+	tests := []struct {
+		name            string
+		annotationsFile string
+		annotations     []string
+		want            map[string]string
+		wantErr         bool
+	}{
+		{
+			name:            "YAML file",
+			annotationsFile: "date: 2025-01-01\nreason: \"end of support\"\nurl: https://example.com:8080/eol\n",
+			want:            map[string]string{"date": "2025-01-01", "reason": "end of support", "url": "https://example.com:8080/eol"},
+		},
+		{
+			name:            "JSON file",
+			annotationsFile: `{"date": "2025-01-01", "reason": "end of support"}`,
+			want:            map[string]string{"date": "2025-01-01", "reason": "end of support"},
+		},
+		{
+			name:            "flags override the file",
+			annotationsFile: "date: 2025-01-01\nreason: end of support\n",
+			annotations:     []string{"date=2026-01-01", "url: https://example.com/eol"},
+			want:            map[string]string{"date": "2026-01-01", "reason": "end of support", "url": "https://example.com/eol"},
+		},
+		{
+			name:            "not a map",
+			annotationsFile: "- date\n- reason\n",
+			wantErr:         true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotationsFile := filepath.Join(dir, fmt.Sprintf("annotations-%d.yaml", i))
+			if err := os.WriteFile(annotationsFile, []byte(tt.annotationsFile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var stdout, stderr bytes.Buffer
+			configAnnotateCmd := &configAnnotateCmd{
+				stdin:             strings.NewReader(""),
+				stdout:            &stdout,
+				stderr:            &stderr,
+				annotationsFile:   annotationsFile,
+				annotationSlice:   tt.annotations,
+				configMediaType:   mediaTypeForConfigEol,
+				manifestMediaType: mediaTypeForManifestEol,
+			}
+			err := configAnnotateCmd.run()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("run() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var manifest artifactManifest
+			if err := json.Unmarshal(stdout.Bytes(), &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(manifest.Config.Annotations, tt.want) {
+				t.Errorf("config annotations = %v, want %v", manifest.Config.Annotations, tt.want)
+			}
+		})
+	}
+}
@@ -4,26 +4,99 @@ Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
 */
 package main
 
+var annotationKeyForSubjectAuthors = "io.azurecr.lpm.v1.subject.authors"
+var annotationKeyForSubjectUrl = "io.azurecr.lpm.v1.subject.url"
+var annotationKeyForSubjectSource = "io.azurecr.lpm.v1.subject.source"
+var annotationKeyForSubjectVendor = "io.azurecr.lpm.v1.subject.vendor"
+var annotationKeyForSubjectRevision = "io.azurecr.lpm.v1.subject.revision"
+
+var annotationKeyForSubjectOwnership = "io.azurecr.lpm.v1.subject.ownership"
+
+var ownershipUpstream = "upstream"
+var ownershipNonUpstream = "non-upstream"
+
+// ownershipUnknown is the ownership of layers attributed without knowing the base image,
+// which cannot be told to be upstream or non-upstream.
+var ownershipUnknown = "unknown"
+
 var annotationsForUpstreamOwnership = map[string]string{
-	"io.azurecr.lpm.v1.subject.authors": "upstream",
-	"io.azurecr.lpm.v1.subject.url":     "upstream",
-	"io.azurecr.lpm.v1.subject.source":  "upstream",
-	"io.azurecr.lpm.v1.subject.vendor":  "upstream",
+	annotationKeyForSubjectOwnership: ownershipUpstream,
 }
 
 var annotationsForNonUpstreamOwnership = map[string]string{
-	"io.azurecr.lpm.v1.subject.authors": "non-upstream",
-	"io.azurecr.lpm.v1.subject.url":     "non-upstream",
-	"io.azurecr.lpm.v1.subject.source":  "non-upstream",
-	"io.azurecr.lpm.v1.subject.vendor":  "non-upstream",
+	annotationKeyForSubjectOwnership: ownershipNonUpstream,
+}
+
+var annotationsForUnknownOwnership = map[string]string{
+	annotationKeyForSubjectOwnership: ownershipUnknown,
 }
 
 var annotationKeyForSubjectOriginalDockerfileFullCommand = "io.azurecr.lpm.v1.subject.dockerfile.fullcommand"
+var annotationKeyForSubjectDockerfileStageName = "io.azurecr.lpm.v1.subject.dockerfile.stage.name"
+var annotationKeyForSubjectDockerfileStageIndex = "io.azurecr.lpm.v1.subject.dockerfile.stage.index"
+
+var annotationKeyForSubjectHistoryCreated = "io.azurecr.lpm.v1.subject.history.created"
+var annotationKeyForSubjectHistoryCreatedBy = "io.azurecr.lpm.v1.subject.history.createdby"
+var annotationKeyForSubjectHistoryComment = "io.azurecr.lpm.v1.subject.history.comment"
 
 var annotationKeyForSubjectMediaType = "io.azurecr.lpm.v1.subject.mediaType"
 var annotationKeyForSubjectDigest = "io.azurecr.lpm.v1.subject.digest"
 var annotationKeyForSubjectSize = "io.azurecr.lpm.v1.subject.size"
+var annotationKeyForSubjectPlatform = "io.azurecr.lpm.v1.subject.platform"
+var annotationKeyForSubjectBaseImageRef = "io.azurecr.lpm.v1.subject.base.ref"
+var annotationKeyForSubjectBaseImageDigest = "io.azurecr.lpm.v1.subject.base.digest"
+
+var annotationKeyForSubjectLineageDepth = "io.azurecr.lpm.v1.subject.lineage.depth"
+var annotationKeyForSubjectLineageChain = "io.azurecr.lpm.v1.subject.lineage.chain"
+var annotationKeyForSubjectLineageDockerfileFullCommand = "io.azurecr.lpm.v1.subject.lineage.dockerfile.fullcommand"
+
+// annotationKeyForDockerReferenceType marks the attestation manifests that BuildKit adds to image indexes.
+var annotationKeyForDockerReferenceType = "vnd.docker.reference.type"
+
+// annotationKeyForContainerdImageName is the image name that "docker save" (and containerd) records for each image of an OCI image layout.
+var annotationKeyForContainerdImageName = "io.containerd.image.name"
 
 var mediaTypeForManifestLpm = "application/io.azurecr.distribution.manifest.v2.lpm.v1+json"
 var mediaTypeForConfigLpm = "application/io.azurecr.container.image.v1.lpm.v1+json"
 var mediaTypeForLayerLpm = "application/io.azurecr.image.rootfs.diff.tar.gzip.lpm.v1+json"
+
+var mediaTypeForManifestEol = "application/io.azurecr.distribution.manifest.v2.eol.v1+json"
+var mediaTypeForConfigEol = "application/io.azurecr.container.image.v1.eol.v1+json"
+
+var annotationKeyForSubjectEolDate = "io.azurecr.eol.v1.subject.eol.date"
+var annotationKeyForSubjectEolReason = "io.azurecr.eol.v1.subject.eol.reason"
+var annotationKeyForSubjectEolDescription = "io.azurecr.eol.v1.subject.eol.description"
+var annotationKeyForSubjectEolSupportUrl = "io.azurecr.eol.v1.subject.eol.support.url"
+
+// eolReasons are the reasons that an end of life can be declared for.
+var eolReasons = []string{"end-of-maintenance", "end-of-support", "deprecated", "superseded", "security"}
+
+// inTotoStatementType is the type of in-toto attestation Statements (v1).
+var inTotoStatementType = "https://in-toto.io/Statement/v1"
+
+// predicateTypeForLpm is the in-toto predicate type that carries an lpm manifest's layer attribution.
+var predicateTypeForLpm = "https://azurecr.io/lpm/v1"
+
+// predicateTypeForSlsaProvenance is the in-toto predicate type of SLSA provenance (v1).
+var predicateTypeForSlsaProvenance = "https://slsa.dev/provenance/v1"
+
+// buildTypeForSlsaDockerfile is the SLSA build type of a Dockerfile build whose provenance is told by lpm.
+var buildTypeForSlsaDockerfile = "https://azurecr.io/lpm/dockerfile-build/v1"
+
+// builderIDForSlsa is the SLSA builder of the provenance told by lpm.
+var builderIDForSlsa = "https://github.com/johnsonshi/docker-tbuild/lpm"
+
+// mediaTypeForEmptyConfig is the OCI image-spec v1.1 media type of the empty config ("{}") of artifacts that have no config.
+var mediaTypeForEmptyConfig = "application/vnd.oci.empty.v1+json"
+
+// artifactTypeForCosignSignature is the artifact type of the cosign signatures of a manifest, stored as referrers of the signed manifest.
+var artifactTypeForCosignSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+// mediaTypeForCosignSimpleSigning is the media type of the payload signed by a cosign signature.
+var mediaTypeForCosignSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+// annotationKeyForCosignSignature is the annotation of a cosign signature's payload layer that holds the base64-encoded signature of the payload.
+var annotationKeyForCosignSignature = "dev.cosignproject.cosign/signature"
+
+// cosignSimpleSigningType is the type of the payload of a cosign signature of a container image (or any other manifest).
+var cosignSimpleSigningType = "cosign container image signature"
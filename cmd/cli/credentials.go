@@ -0,0 +1,190 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/pflag"
+	dockerauth "oras.land/oras-go/pkg/auth/docker"
+)
+
+// registryOptions are the options of the commands that talk to a registry.
+//
+// Credentials given with "--username" and "--password" (or "--password-stdin") are only used for the registries of the command's
+// subject and target refs, so that they are not sent to other registries (such as Docker Hub for base images).
+// Without them (and for every other registry), credentials are read from the Docker config file (~/.docker/config.json, or $DOCKER_CONFIG),
+// including its credsStore and credHelpers credential helpers, which is where "lpm login" and "docker login" store them.
+// Registries without stored credentials are accessed anonymously.
+//
+// How lpm connects to each registry (plain HTTP, TLS verification and client certificates) is read from the per-registry config file,
+// and the flags given on the command line apply to every registry on top of it.
+type registryOptions struct {
+	username      string
+	password      string
+	passwordStdin bool
+	// credentialHosts are the registry hosts that the credentials given on the command line are used for.
+	credentialHosts map[string]bool
+
+	registryConfig       registryConfig
+	registriesConfigFile string
+	registries           map[string]registryConfig
+
+	// transports are the HTTP transports built for each registry config, which are reused so that connections to registries are pooled.
+	transportsMutex sync.Mutex
+	transports      map[registryConfig]http.RoundTripper
+}
+
+// addRegistryFlags adds the flags of the registry options to a command's flags.
+func addRegistryFlags(f *pflag.FlagSet, registryOptions *registryOptions) {
+	f.StringVarP(&registryOptions.username, "username", "u", "", "(optional) username to use for authentication with the registry (default: credentials from the Docker config file, or anonymous access)")
+
+	f.StringVarP(&registryOptions.password, "password", "p", "", "(optional) password to use for authentication with the registry, prefer --password-stdin to keep the password out of the command line")
+
+	f.BoolVar(&registryOptions.passwordStdin, "password-stdin", false, "(optional) read the password to use for authentication with the registry from stdin")
+
+	f.BoolVar(&registryOptions.registryConfig.PlainHTTP, "plain-http", false, "(optional) connect to registries over plain HTTP instead of HTTPS (default: only for localhost registries without TLS settings)")
+
+	f.BoolVar(&registryOptions.registryConfig.Insecure, "insecure", false, "(optional) skip the verification of registries' TLS certificates")
+
+	f.StringVar(&registryOptions.registryConfig.CAFile, "ca-file", "", "(optional) PEM file of CA certificates to trust when verifying registries' TLS certificates, in addition to the system's")
+
+	f.StringVar(&registryOptions.registryConfig.CertFile, "cert-file", "", "(optional) PEM client certificate to authenticate to registries with (requires --key-file)")
+
+	f.StringVar(&registryOptions.registryConfig.KeyFile, "key-file", "", "(optional) PEM client key to authenticate to registries with (requires --cert-file)")
+
+	f.StringVar(&registryOptions.registriesConfigFile, "registry-config", "", "(optional) per-registry config file setting plainHTTP, insecure, caFile, certFile and keyFile for each registry host (default: ~/.config/lpm/registries.yaml if it exists)")
+}
+
+// complete validates the registry options, reads the per-registry config file,
+// and reads the password from stdin if "--password-stdin" is given.
+// hosts are the registry hosts of the command's subject and target refs, which the credentials given on the command line are used for
+// (empty hosts, such as the hosts of files and OCI image layouts, are ignored).
+func (registryOptions *registryOptions) complete(stdin io.Reader, hosts ...string) error {
+	registryOptions.credentialHosts = make(map[string]bool)
+	for _, host := range hosts {
+		if host != "" {
+			registryOptions.credentialHosts[canonicalRegistryHost(host)] = true
+		}
+	}
+
+	configFile, isDefault := registryOptions.registriesConfigFile, false
+	if configFile == "" {
+		configFile, isDefault = defaultRegistriesConfigFile(), true
+	}
+	registries, err := loadRegistriesConfigFile(configFile, isDefault)
+	if err != nil {
+		return err
+	}
+	registryOptions.registries = registries
+
+	if !registryOptions.passwordStdin {
+		if registryOptions.password != "" && registryOptions.username == "" {
+			return fmt.Errorf("--password requires --username")
+		}
+		return nil
+	}
+
+	if registryOptions.password != "" {
+		return fmt.Errorf("--password and --password-stdin are mutually exclusive")
+	}
+	if registryOptions.username == "" {
+		return fmt.Errorf("--password-stdin requires --username")
+	}
+
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	registryOptions.password = strings.TrimRight(string(b), "\r\n")
+	if registryOptions.password == "" {
+		return fmt.Errorf("no password read from stdin")
+	}
+
+	return nil
+}
+
+// hasCredentials returns whether credentials were given on the command line.
+func (registryOptions *registryOptions) hasCredentials() bool {
+	return registryOptions.username != "" || registryOptions.password != ""
+}
+
+// hasCredentialsFor returns whether credentials were given on the command line for the registry host.
+func (registryOptions *registryOptions) hasCredentialsFor(host string) bool {
+	return registryOptions.hasCredentials() && registryOptions.credentialHosts[canonicalRegistryHost(host)]
+}
+
+// registryHost returns the registry host of an image reference,
+// or an empty host if the reference is a file (or directory) or not a registry reference (such as an OCI image layout).
+func registryHost(ref string) string {
+	if ref == "" || strings.Contains(ref, "://") {
+		return ""
+	}
+	if _, err := os.Stat(ref); err == nil {
+		return ""
+	}
+	parsedRef, err := name.ParseReference(ref)
+	if err != nil {
+		return ""
+	}
+	return parsedRef.Context().RegistryStr()
+}
+
+// canonicalRegistryHost returns a registry host, with Docker Hub's several host names mapped to a single one.
+func canonicalRegistryHost(host string) string {
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return name.DefaultRegistry
+	}
+	return host
+}
+
+// configFor returns how to connect to the registry host, from the per-registry config file and the command line flags.
+func (registryOptions *registryOptions) configFor(host string) registryConfig {
+	config := registryOptions.registries[host]
+	flags := registryOptions.registryConfig
+	config.PlainHTTP = config.PlainHTTP || flags.PlainHTTP
+	config.Insecure = config.Insecure || flags.Insecure
+	if flags.CAFile != "" {
+		config.CAFile = flags.CAFile
+	}
+	if flags.CertFile != "" || flags.KeyFile != "" {
+		config.CertFile, config.KeyFile = flags.CertFile, flags.KeyFile
+	}
+	return config
+}
+
+// credential returns the username and password (or identity token, with an empty username) to use for the registry host.
+func (registryOptions *registryOptions) credential(host string) (string, string, error) {
+	if registryOptions.hasCredentialsFor(host) {
+		return registryOptions.username, registryOptions.password, nil
+	}
+
+	client, err := dockerauth.NewClient()
+	if err != nil {
+		return "", "", err
+	}
+	if dockerClient, ok := client.(*dockerauth.Client); ok {
+		// Registries without stored credentials are accessed anonymously.
+		username, password, _ := dockerClient.Credential(host)
+		return username, password, nil
+	}
+	return "", "", nil
+}
+
+// authenticator returns the go-containerregistry authenticator to use for the registry.
+func (registryOptions *registryOptions) authenticator(registry name.Registry) (authn.Authenticator, error) {
+	if registryOptions.hasCredentialsFor(registry.RegistryStr()) {
+		return authn.FromConfig(authn.AuthConfig{Username: registryOptions.username, Password: registryOptions.password}), nil
+	}
+	return authn.DefaultKeychain.Resolve(registry)
+}
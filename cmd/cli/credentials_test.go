@@ -0,0 +1,60 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryOptionsCredentialIsScopedToCommandHosts(t *testing.T) {
+	// Read the credentials of the other registries from an empty Docker config.
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	registryOptions := &registryOptions{username: "token-user", password: "token"}
+	if err := registryOptions.complete(strings.NewReader(""), registryHost("myregistry.azurecr.io/app:1"), registryHost("oci-layout://dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host         string
+		wantUsername string
+	}{
+		{host: "myregistry.azurecr.io", wantUsername: "token-user"},
+		{host: "docker.io"},
+		{host: "registry-1.docker.io"},
+		{host: "otherregistry.azurecr.io"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			username, _, err := registryOptions.credential(tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != tt.wantUsername {
+				t.Errorf("credential(%q) username = %q, want %q", tt.host, username, tt.wantUsername)
+			}
+		})
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "myregistry.azurecr.io/app:1", want: "myregistry.azurecr.io"},
+		{ref: "localhost:5000/app@sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc", want: "localhost:5000"},
+		{ref: "python:3.10", want: "index.docker.io"},
+		{ref: "oci-layout://dir:1", want: ""},
+		{ref: "docker-archive://image.tar", want: ""},
+		{ref: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := registryHost(tt.ref); got != tt.want {
+			t.Errorf("registryHost(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
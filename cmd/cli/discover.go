@@ -0,0 +1,219 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+type discoverCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	subjectImageRef string
+	artifactTypes   []string
+	format          string
+	output          string
+}
+
+func newDiscoverCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	discoverCmd := &discoverCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "discover",
+		Short: "discover the lpm and eol artifacts attached to a subject image as referrers",
+		Example: `lpm discover \
+[--username 					username] \
+[--password-stdin] \
+--subject-image-ref 			myregistry.myserver.io/myimage:latest (or myimage@digest) \
+[--artifact-type 				application/vnd.example.sbom.v1+json] \
+[--format 						tree|json] \
+[--output 						referrers.json]
+`,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return discoverCmd.run()
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &discoverCmd.registryOptions)
+
+	var subjectImageRefLongFlag = "subject-image-ref"
+	f.StringVarP(&discoverCmd.subjectImageRef, subjectImageRefLongFlag, "s", "", "subject image reference whose referrers are discovered")
+	cobraCmd.MarkFlagRequired(subjectImageRefLongFlag)
+
+	f.StringArrayVar(&discoverCmd.artifactTypes, "artifact-type", []string{}, "(optional) artifact type of the referrers to discover, can be repeated (default: lpm and eol artifacts)")
+
+	f.StringVar(&discoverCmd.format, "format", "tree", "(optional) output format, either 'tree' or 'json'")
+
+	f.StringVarP(&discoverCmd.output, "output", "o", "", "(optional) output file to write the discovered referrers to (default: stdout)")
+
+	return cobraCmd
+}
+
+// discoveredReferrer is a referrer of a subject manifest, together with its own referrers (such as signatures of an lpm manifest).
+type discoveredReferrer struct {
+	artifactDescriptor
+
+	// Referrers are the manifests that refer to this referrer.
+	Referrers []discoveredReferrer `json:"referrers,omitempty"`
+}
+
+// artifactTypeAliases maps the manifest artifact types of the artifacts generated by lpm to their config media types.
+// Registries that do not keep the manifest's "artifactType" field report the config's media type as the referrer's artifact type instead.
+var artifactTypeAliases = map[string]string{
+	mediaTypeForManifestLpm: mediaTypeForConfigLpm,
+	mediaTypeForManifestEol: mediaTypeForConfigEol,
+}
+
+func (discoverCmd *discoverCmd) run() error {
+	// Read the registry password from stdin if needed.
+	if err := discoverCmd.registryOptions.complete(discoverCmd.stdin, registryHost(discoverCmd.subjectImageRef)); err != nil {
+		return err
+	}
+
+	if discoverCmd.format != "tree" && discoverCmd.format != "json" {
+		return fmt.Errorf("unsupported output format '%s', expected 'tree' or 'json'", discoverCmd.format)
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if discoverCmd.output == "" {
+		out = discoverCmd.stdout
+	} else {
+		f, err := os.Create(discoverCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	// Discover lpm and eol artifacts unless other artifact types are given.
+	artifactTypes := discoverCmd.artifactTypes
+	if len(artifactTypes) == 0 {
+		artifactTypes = []string{mediaTypeForManifestLpm, mediaTypeForManifestEol}
+	}
+	wanted := make(map[string]bool)
+	for _, artifactType := range artifactTypes {
+		wanted[artifactType] = true
+		if alias, ok := artifactTypeAliases[artifactType]; ok {
+			wanted[alias] = true
+		}
+	}
+
+	ctx := context.Background()
+
+	// Resolve the subject image ref to the subject image manifest's digest.
+	registry, err := newRegistry(&discoverCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+	_, subjectDesc, err := registry.Resolve(ctx, discoverCmd.subjectImageRef)
+	if err != nil {
+		return err
+	}
+
+	remote, err := newRemoteRepository(ctx, discoverCmd.subjectImageRef, &discoverCmd.registryOptions, false)
+	if err != nil {
+		return err
+	}
+
+	// List the subject's referrers of the wanted artifact types.
+	descs, err := remote.referrers(ctx, subjectDesc.Digest, "")
+	if err != nil {
+		return err
+	}
+	discovered := make([]discoveredReferrer, 0)
+	for _, desc := range descs {
+		if !wanted[desc.ArtifactType] {
+			continue
+		}
+		// Also discover what refers to the referrer itself (of any artifact type).
+		nested, err := discoverCmd.discoverReferrers(ctx, remote, desc.Digest, map[digest.Digest]bool{subjectDesc.Digest: true})
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, discoveredReferrer{artifactDescriptor: desc, Referrers: nested})
+	}
+
+	if discoverCmd.format == "json" {
+		discoveredJsonString, err := json.MarshalIndent(discovered, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(discoveredJsonString)
+		return nil
+	}
+
+	fmt.Fprintf(out, "%s@%s\n", discoverCmd.subjectImageRef, subjectDesc.Digest)
+	writeReferrersTree(out, "", discovered)
+	return nil
+}
+
+// discoverReferrers recursively lists the referrers (of any artifact type) of a manifest.
+// visited holds the manifests already on the path from the subject, to stop on cycles.
+func (discoverCmd *discoverCmd) discoverReferrers(ctx context.Context, remote *remoteRepository, subject digest.Digest, visited map[digest.Digest]bool) ([]discoveredReferrer, error) {
+	if visited[subject] {
+		return nil, nil
+	}
+	visited[subject] = true
+	defer delete(visited, subject)
+
+	descs, err := remote.referrers(ctx, subject, "")
+	if err != nil {
+		return nil, err
+	}
+
+	discovered := make([]discoveredReferrer, 0)
+	for _, desc := range descs {
+		nested, err := discoverCmd.discoverReferrers(ctx, remote, desc.Digest, visited)
+		if err != nil {
+			return nil, err
+		}
+		discovered = append(discovered, discoveredReferrer{artifactDescriptor: desc, Referrers: nested})
+	}
+	return discovered, nil
+}
+
+// writeReferrersTree writes the referrers as a tree, with each referrer's annotations (sorted by key) and its own referrers below it.
+func writeReferrersTree(out io.Writer, indent string, referrers []discoveredReferrer) {
+	for i, r := range referrers {
+		branch, childIndent := "├── ", indent+"│   "
+		if i == len(referrers)-1 {
+			branch, childIndent = "└── ", indent+"    "
+		}
+		fmt.Fprintf(out, "%s%s%s %s\n", indent, branch, r.ArtifactType, r.Digest)
+
+		keys := make([]string, 0, len(r.Annotations))
+		for key := range r.Annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for k, key := range keys {
+			annotationBranch := "├── "
+			if k == len(keys)-1 && len(r.Referrers) == 0 {
+				annotationBranch = "└── "
+			}
+			fmt.Fprintf(out, "%s%s%s: %s\n", childIndent, annotationBranch, key, r.Annotations[key])
+		}
+
+		writeReferrersTree(out, childIndent, r.Referrers)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/asottile/dockerfile"
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// dockerfileStage is a single build stage of a (possibly multi-stage) Dockerfile.
+// A stage starts at its "FROM" command and ends right before the next "FROM" command.
+type dockerfileStage struct {
+	// index is the zero-based position of the stage in the Dockerfile.
+	index int
+	// name is the stage name given with "FROM <base> AS <name>" (empty for unnamed stages).
+	name string
+	// base is the image (or earlier stage name) the stage is built on.
+	base string
+	// from is the stage's "FROM" command.
+	from dockerfile.Command
+	// commands are the stage's commands after its "FROM" command.
+	commands []dockerfile.Command
+}
+
+// parseDockerfileStages splits the parsed Dockerfile commands into build stages.
+// Commands before the first "FROM" command (such as global "ARG" commands) do not belong to any stage and are skipped.
+func parseDockerfileStages(dockerfileCommands []dockerfile.Command) ([]dockerfileStage, error) {
+	stages := make([]dockerfileStage, 0)
+	for _, command := range dockerfileCommands {
+		if strings.ToUpper(command.Cmd) == "FROM" {
+			if len(command.Value) == 0 {
+				return nil, fmt.Errorf("invalid FROM command: %s", command.Original)
+			}
+			stage := dockerfileStage{
+				index: len(stages),
+				base:  command.Value[0],
+				from:  command,
+			}
+			// "FROM <base> AS <name>"
+			if len(command.Value) == 3 && strings.ToUpper(command.Value[1]) == "AS" {
+				stage.name = strings.ToLower(command.Value[2])
+			}
+			stages = append(stages, stage)
+			continue
+		}
+
+		if len(stages) == 0 {
+			continue
+		}
+		stages[len(stages)-1].commands = append(stages[len(stages)-1].commands, command)
+	}
+
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no FROM command found in Dockerfile")
+	}
+
+	return stages, nil
+}
+
+// findDockerfileStage returns the index of the stage referred to by target,
+// which is either a stage name or a zero-based stage index.
+// An empty target refers to the final stage, which is what "docker build" builds by default.
+func findDockerfileStage(stages []dockerfileStage, target string) (int, error) {
+	if target == "" {
+		return len(stages) - 1, nil
+	}
+
+	for i := range stages {
+		if stages[i].name != "" && stages[i].name == strings.ToLower(target) {
+			return i, nil
+		}
+	}
+
+	if i, err := strconv.Atoi(target); err == nil && i >= 0 && i < len(stages) {
+		return i, nil
+	}
+
+	return -1, fmt.Errorf("target stage '%s' not found in Dockerfile", target)
+}
+
+// dockerfileStageChain returns the stages that make up the target stage's image,
+// ordered from the root stage (built on an external base image) to the target stage.
+//
+// A stage built "FROM" an earlier stage inherits all of that stage's layers,
+// so the earlier stage's commands also produce layers in the target stage's image.
+// Builder stages that the target stage does not build on (for example, stages only referred to by "COPY --from")
+// leave no layers in the target stage's image and are not part of the chain.
+func dockerfileStageChain(stages []dockerfileStage, target string) ([]dockerfileStage, error) {
+	i, err := findDockerfileStage(stages, target)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []dockerfileStage{stages[i]}
+	for {
+		parent := -1
+		base := strings.ToLower(chain[0].base)
+		for j := chain[0].index - 1; j >= 0; j-- {
+			if stages[j].name != "" && stages[j].name == base {
+				parent = j
+				break
+			}
+		}
+		if parent < 0 {
+			break
+		}
+		chain = append([]dockerfileStage{stages[parent]}, chain...)
+	}
+
+	return chain, nil
+}
+
+// dockerfileLayerProduction tells whether a Dockerfile instruction produces a filesystem layer in the built image.
+type dockerfileLayerProduction int
+
+const (
+	// dockerfileProducesNoLayer instructions only change the image config (ENV, LABEL, CMD, ...).
+	dockerfileProducesNoLayer dockerfileLayerProduction = iota
+	// dockerfileProducesLayer instructions always produce a filesystem layer (RUN, COPY, ADD).
+	dockerfileProducesLayer
+	// dockerfileMayProduceLayer instructions only produce a filesystem layer in some cases.
+	// For example, WORKDIR produces a layer when the builder has to create the directory,
+	// depending on the builder and on whether the directory already exists.
+	dockerfileMayProduceLayer
+)
+
+// dockerfileInstructionLayerProduction returns whether the Dockerfile command produces a filesystem layer.
+func dockerfileInstructionLayerProduction(command dockerfile.Command) dockerfileLayerProduction {
+	switch strings.ToUpper(command.Cmd) {
+	case "RUN", "COPY", "ADD":
+		return dockerfileProducesLayer
+	case "WORKDIR":
+		return dockerfileMayProduceLayer
+	default:
+		// ENV, LABEL, EXPOSE, CMD, ENTRYPOINT, USER, ARG, STOPSIGNAL, HEALTHCHECK, SHELL, VOLUME, ONBUILD and MAINTAINER
+		// only change the image config.
+		return dockerfileProducesNoLayer
+	}
+}
+
+// dockerfileLayerCommands returns the indices of the commands that produce a filesystem layer in the built image.
+//
+// Commands that may or may not produce a layer (such as WORKDIR) are settled with the image config's history when available:
+// the n-th last such command in the Dockerfile is paired with the n-th last history entry created by the same instruction,
+// and produces a layer only if that history entry is not marked as an empty layer.
+// Without history, such commands are assumed to not produce a layer, which is the usual case.
+func dockerfileLayerCommands(commands []dockerfile.Command, history []goocispecv1.History) []int {
+	// Index the history entries of each instruction that may produce a layer, from the last entry to the first entry.
+	historyByInstruction := make(map[string][]goocispecv1.History)
+	for h := len(history) - 1; h >= 0; h-- {
+		instruction := historyInstruction(history[h])
+		historyByInstruction[instruction] = append(historyByInstruction[instruction], history[h])
+	}
+
+	produces := make([]bool, len(commands))
+	seen := make(map[string]int)
+	for d := len(commands) - 1; d >= 0; d-- {
+		switch dockerfileInstructionLayerProduction(commands[d]) {
+		case dockerfileProducesLayer:
+			produces[d] = true
+		case dockerfileMayProduceLayer:
+			instruction := strings.ToUpper(commands[d].Cmd)
+			entries := historyByInstruction[instruction]
+			if n := seen[instruction]; n < len(entries) {
+				produces[d] = !entries[n].EmptyLayer
+			}
+			seen[instruction]++
+		}
+	}
+
+	layerCommands := make([]int, 0)
+	for d := range commands {
+		if produces[d] {
+			layerCommands = append(layerCommands, d)
+		}
+	}
+	return layerCommands
+}
+
+// historyInstruction returns the Dockerfile instruction that created an image config history entry,
+// or an empty string if it cannot be told from the entry.
+//
+// The legacy builder records instructions as "/bin/sh -c #(nop) WORKDIR /app" (except for RUN),
+// while BuildKit records them as "WORKDIR /app".
+func historyInstruction(history goocispecv1.History) string {
+	createdBy := strings.TrimSpace(history.CreatedBy)
+	createdBy = strings.TrimSpace(strings.TrimPrefix(createdBy, "/bin/sh -c #(nop)"))
+	fields := strings.Fields(createdBy)
+	if len(fields) == 0 {
+		return ""
+	}
+	instruction := strings.ToUpper(fields[0])
+	for _, cmd := range dockerfile.AllCmds() {
+		if strings.ToUpper(cmd) == instruction {
+			return instruction
+		}
+	}
+	return ""
+}
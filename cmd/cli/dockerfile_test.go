@@ -0,0 +1,168 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/asottile/dockerfile"
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// parseTestDockerfileStages parses the Dockerfile content into build stages.
+func parseTestDockerfileStages(t *testing.T, content string) []dockerfileStage {
+	t.Helper()
+	commands, err := dockerfile.ParseReader(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages, err := parseDockerfileStages(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stages
+}
+
+func TestDockerfileStageChain(t *testing.T) {
+	stages := parseTestDockerfileStages(t, `ARG VERSION=3.10
+FROM python:${VERSION} AS base
+RUN pip install x
+FROM golang:1.18 AS builder
+RUN go build -o /app
+FROM base AS runtime
+COPY --from=builder /app /app
+FROM runtime
+CMD ["/app"]
+`)
+
+	tests := []struct {
+		name    string
+		target  string
+		want    []int
+		wantErr bool
+	}{
+		{name: "final stage", target: "", want: []int{0, 2, 3}},
+		{name: "named target", target: "runtime", want: []int{0, 2}},
+		{name: "named target in another case", target: "RUNTIME", want: []int{0, 2}},
+		{name: "indexed target", target: "2", want: []int{0, 2}},
+		{name: "root stage", target: "base", want: []int{0}},
+		{name: "builder stage left out of other chains", target: "builder", want: []int{1}},
+		{name: "indexed builder stage", target: "1", want: []int{1}},
+		{name: "unknown named target", target: "test", wantErr: true},
+		{name: "out of range indexed target", target: "4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := dockerfileStageChain(stages, tt.target)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("dockerfileStageChain(%q) = %d stages, want an error", tt.target, len(chain))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int, 0)
+			for _, stage := range chain {
+				got = append(got, stage.index)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dockerfileStageChain(%q) = stages %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerfileLayerCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		history    []goocispecv1.History
+		want       []int
+	}{
+		{
+			name:       "no history",
+			dockerfile: "FROM python:3.10\nWORKDIR /app\nRUN pip install x\nENV X=1\nCOPY . .\n",
+			want:       []int{1, 3},
+		},
+		{
+			name:       "legacy WORKDIR with empty layer",
+			dockerfile: "FROM python:3.10\nWORKDIR /app\nRUN pip install x\nENV X=1\nCOPY . .\n",
+			history: []goocispecv1.History{
+				{CreatedBy: "/bin/sh -c #(nop) WORKDIR /app", EmptyLayer: true},
+				{CreatedBy: "/bin/sh -c pip install x"},
+				{CreatedBy: "/bin/sh -c #(nop)  ENV X=1", EmptyLayer: true},
+				{CreatedBy: "/bin/sh -c #(nop) COPY dir:abc in . "},
+			},
+			want: []int{1, 3},
+		},
+		{
+			name:       "BuildKit WORKDIR without empty layer",
+			dockerfile: "FROM python:3.10\nWORKDIR /app\nRUN pip install x\nENV X=1\nCOPY . .\n",
+			history: []goocispecv1.History{
+				{CreatedBy: "WORKDIR /app", Comment: "buildkit.dockerfile.v0"},
+				{CreatedBy: "RUN /bin/sh -c pip install x # buildkit", Comment: "buildkit.dockerfile.v0"},
+				{CreatedBy: "ENV X=1", Comment: "buildkit.dockerfile.v0", EmptyLayer: true},
+				{CreatedBy: "COPY . . # buildkit", Comment: "buildkit.dockerfile.v0"},
+			},
+			want: []int{0, 1, 3},
+		},
+		{
+			name:       "history paired from the end past the base image's entries",
+			dockerfile: "FROM python:3.10\nWORKDIR /a\nRUN make a\nWORKDIR /b\nRUN make b\n",
+			history: []goocispecv1.History{
+				// Entry of the base image, which the Dockerfile's commands do not describe.
+				{CreatedBy: "WORKDIR /base"},
+				{CreatedBy: "WORKDIR /a", EmptyLayer: true},
+				{CreatedBy: "RUN /bin/sh -c make a # buildkit"},
+				{CreatedBy: "WORKDIR /b"},
+				{CreatedBy: "RUN /bin/sh -c make b # buildkit"},
+			},
+			want: []int{1, 2, 3},
+		},
+		{
+			name:       "fewer history entries than commands",
+			dockerfile: "FROM python:3.10\nWORKDIR /a\nWORKDIR /b\n",
+			history: []goocispecv1.History{
+				{CreatedBy: "WORKDIR /b"},
+			},
+			want: []int{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stages := parseTestDockerfileStages(t, tt.dockerfile)
+			if got := dockerfileLayerCommands(stages[0].commands, tt.history); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dockerfileLayerCommands() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryInstruction(t *testing.T) {
+	tests := []struct {
+		createdBy string
+		want      string
+	}{
+		{createdBy: "/bin/sh -c #(nop) WORKDIR /app", want: "WORKDIR"},
+		{createdBy: "/bin/sh -c #(nop)  COPY file:abc in / ", want: "COPY"},
+		{createdBy: `/bin/sh -c #(nop)  CMD ["bash"]`, want: "CMD"},
+		{createdBy: "/bin/sh -c apt-get update", want: ""},
+		{createdBy: "|1 VERSION=1 /bin/sh -c make", want: ""},
+		{createdBy: "WORKDIR /app", want: "WORKDIR"},
+		{createdBy: "RUN /bin/sh -c pip install x # buildkit", want: "RUN"},
+		{createdBy: "RUN |1 VERSION=1 /bin/sh -c make # buildkit", want: "RUN"},
+		{createdBy: "ADD file:a in / ", want: "ADD"},
+		{createdBy: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := historyInstruction(goocispecv1.History{CreatedBy: tt.createdBy}); got != tt.want {
+			t.Errorf("historyInstruction(%q) = %q, want %q", tt.createdBy, got, tt.want)
+		}
+	}
+}
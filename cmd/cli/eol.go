@@ -0,0 +1,421 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"oras.land/oras-go/pkg/content"
+)
+
+func newEolCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	cobraCmd := &cobra.Command{
+		Use:   "eol",
+		Short: "declare, read and check the end of life of images",
+	}
+
+	cobraCmd.AddCommand(
+		newEolSetCmd(stdin, stdout, stderr, args),
+		newEolGetCmd(stdin, stdout, stderr, args),
+		newEolCheckCmd(stdin, stdout, stderr, args),
+	)
+
+	return cobraCmd
+}
+
+// eolDeclaration is the end of life of an image, as declared by an eol artifact attached to the image.
+type eolDeclaration struct {
+	// Artifact is the digest of the eol artifact.
+	Artifact    string `json:"artifact"`
+	Date        string `json:"date"`
+	Reason      string `json:"reason,omitempty"`
+	Description string `json:"description,omitempty"`
+	SupportUrl  string `json:"supportUrl,omitempty"`
+}
+
+type eolSetCmd struct {
+	configAnnotateCmd configAnnotateCmd
+	date              string
+	reason            string
+	description       string
+	supportUrl        string
+}
+
+func newEolSetCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	eolSetCmd := &eolSetCmd{
+		configAnnotateCmd: configAnnotateCmd{
+			stdin:             stdin,
+			stdout:            stdout,
+			stderr:            stderr,
+			manifestMediaType: mediaTypeForManifestEol,
+			configMediaType:   mediaTypeForConfigEol,
+		},
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "set <image-ref>",
+		Short: "declare the end of life of an image by generating an eol artifact, and push it as a referrer of the image",
+		Example: `lpm eol set \
+[--username 					username] \
+[--password-stdin] \
+--date 							2025-01-01 \
+--reason 						end-of-maintenance \
+[--description 					"This image will no longer be maintained by the maintainer."] \
+[--support-url 					https://docs.microsoft.com/en-us/azure/container-registry/container-registry-eol] \
+[--file 						migration-guide.md:text/markdown] \
+[--lpm-manifest-artifact-ref 	myregistry.myserver.io/myimage-eol:latest (or myimage-eol@digest)] \
+[--attach] \
+[--sign-key 					eol-signing-key.pem] \
+[--output 						eol-output-copy.json] \
+myregistry.myserver.io/myimage:latest (or myimage@digest)
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return eolSetCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &eolSetCmd.configAnnotateCmd.registryOptions)
+
+	var dateLongFlag = "date"
+	f.StringVar(&eolSetCmd.date, dateLongFlag, "", "end of life date of the image, as an ISO 8601 date (such as 2025-01-01)")
+	cobraCmd.MarkFlagRequired(dateLongFlag)
+
+	var reasonLongFlag = "reason"
+	f.StringVar(&eolSetCmd.reason, reasonLongFlag, "", fmt.Sprintf("reason for the end of life of the image, one of '%s'", strings.Join(eolReasons, "', '")))
+	cobraCmd.MarkFlagRequired(reasonLongFlag)
+
+	f.StringVar(&eolSetCmd.description, "description", "", "(optional) description of the end of life of the image")
+
+	f.StringVar(&eolSetCmd.supportUrl, "support-url", "", "(optional) http or https URL of the support information about the end of life of the image")
+
+	f.StringArrayVar(&eolSetCmd.configAnnotateCmd.files, "file", []string{}, "(optional) file to ship with the eol artifact as a layer of it (such as a migration guide), as 'path[:mediaType]' (default mediaType: '"+content.DefaultBlobMediaType+"'), can be repeated")
+
+	f.StringVarP(&eolSetCmd.configAnnotateCmd.lpmManifestArtifactRef, "lpm-manifest-artifact-ref", "t", "", "(optional) target artifact ref in which the generated eol artifact will be pushed to as an ORAS referrer to the image")
+
+	f.BoolVar(&eolSetCmd.configAnnotateCmd.attach, "attach", false, "(optional) push the generated eol artifact to the image's repository as a referrer of the image, using the referrers API or the referrers tag schema on registries without it")
+
+	f.StringVar(&eolSetCmd.configAnnotateCmd.signKey, "sign-key", "", "(optional) PEM private key file (ECDSA, RSA or Ed25519) to sign the pushed eol artifact with, the cosign signature is pushed as a referrer of the eol artifact wherever the eol artifact is pushed")
+
+	f.StringVarP(&eolSetCmd.configAnnotateCmd.output, "output", "o", "", "(optional) output file to also write the generated eol artifact (default: stdout)")
+
+	return cobraCmd
+}
+
+func (eolSetCmd *eolSetCmd) run(imageRef string) error {
+	date, err := time.Parse("2006-01-02", eolSetCmd.date)
+	if err != nil {
+		return fmt.Errorf("invalid end of life date '%s', expected an ISO 8601 date such as '2025-01-01'", eolSetCmd.date)
+	}
+	if date.Before(time.Now()) {
+		fmt.Fprintf(eolSetCmd.configAnnotateCmd.stderr, "[!] Warning: end of life date %s has already passed\n", eolSetCmd.date)
+	}
+
+	if !containsString(eolReasons, eolSetCmd.reason) {
+		return fmt.Errorf("unsupported end of life reason '%s', expected one of '%s'", eolSetCmd.reason, strings.Join(eolReasons, "', '"))
+	}
+
+	annotations := map[string]string{
+		annotationKeyForSubjectEolDate:   eolSetCmd.date,
+		annotationKeyForSubjectEolReason: eolSetCmd.reason,
+	}
+	if eolSetCmd.description != "" {
+		annotations[annotationKeyForSubjectEolDescription] = eolSetCmd.description
+	}
+	if eolSetCmd.supportUrl != "" {
+		u, err := url.ParseRequestURI(eolSetCmd.supportUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid support URL '%s', expected an http or https URL", eolSetCmd.supportUrl)
+		}
+		annotations[annotationKeyForSubjectEolSupportUrl] = eolSetCmd.supportUrl
+	}
+
+	eolSetCmd.configAnnotateCmd.subjectImageRef = imageRef
+	return eolSetCmd.configAnnotateCmd.annotate(annotations, map[string]string{})
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type eolGetCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	format          string
+	output          string
+}
+
+func newEolGetCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	eolGetCmd := &eolGetCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "get <image-ref>",
+		Short: "show the end of life declared by the eol artifacts attached to an image",
+		Example: `lpm eol get \
+[--username 					username] \
+[--password-stdin] \
+[--format 						table|json] \
+[--output 						eol.json] \
+myregistry.myserver.io/myimage:latest (or myimage@digest)
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return eolGetCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &eolGetCmd.registryOptions)
+
+	f.StringVar(&eolGetCmd.format, "format", "table", "(optional) output format, either 'table' or 'json'")
+
+	f.StringVarP(&eolGetCmd.output, "output", "o", "", "(optional) output file to write the end of life declarations to (default: stdout)")
+
+	return cobraCmd
+}
+
+func (eolGetCmd *eolGetCmd) run(imageRef string) error {
+	// Read the registry password from stdin if needed.
+	if err := eolGetCmd.registryOptions.complete(eolGetCmd.stdin, registryHost(imageRef)); err != nil {
+		return err
+	}
+
+	if eolGetCmd.format != "table" && eolGetCmd.format != "json" {
+		return fmt.Errorf("unsupported output format '%s', expected 'table' or 'json'", eolGetCmd.format)
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if eolGetCmd.output == "" {
+		out = eolGetCmd.stdout
+	} else {
+		f, err := os.Create(eolGetCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&eolGetCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	_, declarations, err := resolveEolDeclarations(ctx, registry, &eolGetCmd.registryOptions, imageRef)
+	if err != nil {
+		return err
+	}
+
+	if eolGetCmd.format == "json" {
+		declarationsJsonString, err := json.MarshalIndent(declarations, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(declarationsJsonString)
+		return nil
+	}
+
+	if len(declarations) == 0 {
+		fmt.Fprintf(eolGetCmd.stderr, "[*] No end of life is declared for image '%s'\n", imageRef)
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tREASON\tDESCRIPTION\tSUPPORT URL\tARTIFACT")
+	for _, declaration := range declarations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", declaration.Date, declaration.Reason, declaration.Description, declaration.SupportUrl, declaration.Artifact)
+	}
+	w.Flush()
+
+	return nil
+}
+
+type eolCheckCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	warnDays        int
+}
+
+func newEolCheckCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	eolCheckCmd := &eolCheckCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "check <image-ref>",
+		Short: "fail if the end of life date of an image has passed, or is within the warning window",
+		Example: `lpm eol check \
+[--username 					username] \
+[--password-stdin] \
+[--warn-days 					30] \
+myregistry.myserver.io/myimage:latest (or myimage@digest)
+`,
+		Args: cobra.ExactArgs(1),
+		// A reached end of life is reported as an error, which is not a usage error.
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return eolCheckCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &eolCheckCmd.registryOptions)
+
+	f.IntVar(&eolCheckCmd.warnDays, "warn-days", 30, "(optional) number of days before the end of life date from which the check fails")
+
+	return cobraCmd
+}
+
+func (eolCheckCmd *eolCheckCmd) run(imageRef string) error {
+	// Read the registry password from stdin if needed.
+	if err := eolCheckCmd.registryOptions.complete(eolCheckCmd.stdin, registryHost(imageRef)); err != nil {
+		return err
+	}
+
+	if eolCheckCmd.warnDays < 0 {
+		return fmt.Errorf("--warn-days must not be negative")
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&eolCheckCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	imageDesc, declarations, err := resolveEolDeclarations(ctx, registry, &eolCheckCmd.registryOptions, imageRef)
+	if err != nil {
+		return err
+	}
+	if len(declarations) == 0 {
+		fmt.Fprintf(eolCheckCmd.stdout, "No end of life is declared for image '%s' with digest '%s'\n", imageRef, imageDesc.Digest)
+		return nil
+	}
+
+	return eolCheckCmd.checkDeclarations(imageRef, declarations, time.Now())
+}
+
+// checkDeclarations reports the end of life declarations of an image as of now,
+// and fails if any end of life date has passed, is within the warning window, or is invalid.
+func (eolCheckCmd *eolCheckCmd) checkDeclarations(imageRef string, declarations []eolDeclaration, now time.Time) error {
+	failed := false
+	for _, declaration := range declarations {
+		date, err := parseEolDate(declaration.Date)
+		if err != nil {
+			fmt.Fprintf(eolCheckCmd.stdout, "[!] Eol artifact '%s' has an invalid end of life date '%s'\n", declaration.Artifact, declaration.Date)
+			failed = true
+			continue
+		}
+		days := int(date.Sub(now).Hours() / 24)
+		switch {
+		case date.Before(now):
+			fmt.Fprintf(eolCheckCmd.stdout, "[!] End of life date %s (eol artifact '%s') has passed\n", declaration.Date, declaration.Artifact)
+			failed = true
+		case date.Before(now.AddDate(0, 0, eolCheckCmd.warnDays)):
+			fmt.Fprintf(eolCheckCmd.stdout, "[!] End of life date %s (eol artifact '%s') is %d days away, within the warning window of %d days\n", declaration.Date, declaration.Artifact, days, eolCheckCmd.warnDays)
+			failed = true
+		default:
+			fmt.Fprintf(eolCheckCmd.stdout, "End of life date %s (eol artifact '%s') is %d days away\n", declaration.Date, declaration.Artifact, days)
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("image '%s' has reached, or is within %d days of, its end of life", imageRef, eolCheckCmd.warnDays)
+	}
+	return nil
+}
+
+// resolveEolDeclarations resolves an image and reads the end of life declared by each eol artifact attached to it as a referrer.
+func resolveEolDeclarations(ctx context.Context, registry *content.Registry, registryOptions *registryOptions, imageRef string) (ocispecv1.Descriptor, []eolDeclaration, error) {
+	_, imageDesc, err := registry.Resolve(ctx, imageRef)
+	if err != nil {
+		return ocispecv1.Descriptor{}, nil, err
+	}
+	repository, err := repositoryOf(imageRef)
+	if err != nil {
+		return ocispecv1.Descriptor{}, nil, err
+	}
+	remote, err := newRemoteRepository(ctx, imageRef, registryOptions, false)
+	if err != nil {
+		return ocispecv1.Descriptor{}, nil, err
+	}
+	declarations, err := fetchEolDeclarations(ctx, registry, remote, repository, imageDesc.Digest)
+	if err != nil {
+		return ocispecv1.Descriptor{}, nil, err
+	}
+	return imageDesc, declarations, nil
+}
+
+// fetchEolDeclarations reads the end of life declared by each eol artifact that refers to a subject image of a repository.
+func fetchEolDeclarations(ctx context.Context, registry *content.Registry, remote *remoteRepository, repository string, subject digest.Digest) ([]eolDeclaration, error) {
+	eolDescs, err := remote.referrersOfType(ctx, subject, mediaTypeForManifestEol)
+	if err != nil {
+		return nil, err
+	}
+	declarations := make([]eolDeclaration, 0)
+	for _, eolDesc := range eolDescs {
+		eolRef := fmt.Sprintf("%s@%s", repository, eolDesc.Digest)
+		b, err := fetchContent(ctx, registry, eolRef, ocispecv1.Descriptor{MediaType: eolDesc.MediaType, Digest: eolDesc.Digest, Size: eolDesc.Size})
+		if err != nil {
+			return nil, err
+		}
+		var eolManifest artifactManifest
+		if err := json.Unmarshal(b, &eolManifest); err != nil {
+			return nil, err
+		}
+		annotations := eolManifest.Config.Annotations
+		declarations = append(declarations, eolDeclaration{
+			Artifact:    eolDesc.Digest.String(),
+			Date:        annotations[annotationKeyForSubjectEolDate],
+			Reason:      annotations[annotationKeyForSubjectEolReason],
+			Description: annotations[annotationKeyForSubjectEolDescription],
+			SupportUrl:  annotations[annotationKeyForSubjectEolSupportUrl],
+		})
+	}
+	return declarations, nil
+}
+
+// parseEolDate parses an end of life date, which is an ISO 8601 date (such as "2025-01-01") or an RFC 3339 date and time.
+func parseEolDate(date string) (time.Time, error) {
+	date = strings.TrimSpace(date)
+	if t, err := time.Parse("2006-01-02", date); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, date)
+}
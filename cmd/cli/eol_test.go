@@ -0,0 +1,131 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEolSetValidation(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	tests := []struct {
+		name       string
+		date       string
+		reason     string
+		supportUrl string
+		wantErr    string
+	}{
+		{name: "invalid date", date: "01/01/2025", reason: "deprecated", wantErr: "invalid end of life date '01/01/2025'"},
+		{name: "date and time", date: "2025-01-01T00:00:00Z", reason: "deprecated", wantErr: "invalid end of life date"},
+		{name: "empty reason", date: "2025-01-01", reason: "", wantErr: "unsupported end of life reason ''"},
+		{name: "unsupported reason", date: "2025-01-01", reason: "retired", wantErr: "unsupported end of life reason 'retired'"},
+		{name: "ftp support URL", date: "2025-01-01", reason: "deprecated", supportUrl: "ftp://example.com/eol", wantErr: "invalid support URL 'ftp://example.com/eol'"},
+		{name: "relative support URL", date: "2025-01-01", reason: "deprecated", supportUrl: "/eol", wantErr: "invalid support URL '/eol'"},
+		{name: "support URL without host", date: "2025-01-01", reason: "deprecated", supportUrl: "https://", wantErr: "invalid support URL 'https://'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			eolSetCmd := &eolSetCmd{
+				configAnnotateCmd: configAnnotateCmd{
+					stdin:             strings.NewReader(""),
+					stdout:            &stdout,
+					stderr:            &stderr,
+					manifestMediaType: mediaTypeForManifestEol,
+					configMediaType:   mediaTypeForConfigEol,
+				},
+				date:       tt.date,
+				reason:     tt.reason,
+				supportUrl: tt.supportUrl,
+			}
+			err := eolSetCmd.run("localhost:5000/app:1")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("run() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("run() wrote an eol artifact %q, want none", stdout.String())
+			}
+		})
+	}
+}
+
+func TestEolCheckDeclarations(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		date       string
+		warnDays   int
+		wantOutput string
+		wantErr    bool
+	}{
+		{name: "passed", date: "2024-12-31", warnDays: 30, wantOutput: "has passed", wantErr: true},
+		{name: "passed by a second", date: "2024-12-31T23:59:59Z", warnDays: 30, wantOutput: "has passed", wantErr: true},
+		{name: "today", date: "2025-01-01", warnDays: 30, wantOutput: "is 0 days away, within the warning window of 30 days", wantErr: true},
+		{name: "last day of the warning window", date: "2025-01-30", warnDays: 30, wantOutput: "is 29 days away, within the warning window of 30 days", wantErr: true},
+		{name: "end of the warning window", date: "2025-01-31", warnDays: 30, wantOutput: "is 30 days away\n"},
+		{name: "today without a warning window", date: "2025-01-01", warnDays: 0, wantOutput: "is 0 days away\n"},
+		{name: "invalid date", date: "next year", warnDays: 30, wantOutput: "invalid end of life date 'next year'", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			eolCheckCmd := &eolCheckCmd{
+				stdout:   &stdout,
+				warnDays: tt.warnDays,
+			}
+			declarations := []eolDeclaration{{Artifact: "sha256:eol", Date: tt.date, Reason: "deprecated"}}
+			err := eolCheckCmd.checkDeclarations("localhost:5000/app:1", declarations, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkDeclarations() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !strings.Contains(stdout.String(), tt.wantOutput) {
+				t.Errorf("checkDeclarations() output = %q, want it to contain %q", stdout.String(), tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestEolCheckFailsOnAnyDeclaration(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var stdout bytes.Buffer
+	eolCheckCmd := &eolCheckCmd{
+		stdout:   &stdout,
+		warnDays: 30,
+	}
+	declarations := []eolDeclaration{
+		{Artifact: "sha256:later", Date: "2026-01-01"},
+		{Artifact: "sha256:sooner", Date: "2025-01-15"},
+	}
+	if err := eolCheckCmd.checkDeclarations("localhost:5000/app:1", declarations, now); err == nil {
+		t.Fatal("checkDeclarations() error = nil, want an error for the declaration within the warning window")
+	}
+	for _, artifact := range []string{"sha256:later", "sha256:sooner"} {
+		if !strings.Contains(stdout.String(), artifact) {
+			t.Errorf("checkDeclarations() output = %q, want every declaration reported, missing %s", stdout.String(), artifact)
+		}
+	}
+}
+
+func TestEolCheckRejectsNegativeWarnDays(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	var stdout bytes.Buffer
+	eolCheckCmd := &eolCheckCmd{
+		stdin:    strings.NewReader(""),
+		stdout:   &stdout,
+		stderr:   &stdout,
+		warnDays: -1,
+	}
+	err := eolCheckCmd.run("localhost:5000/app:1")
+	if err == nil || !strings.Contains(err.Error(), "--warn-days must not be negative") {
+		t.Fatalf("run() error = %v, want a negative --warn-days error", err)
+	}
+}
@@ -0,0 +1,445 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+type exportCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	format          string
+	name            string
+	output          string
+}
+
+func newExportCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	exportCmd := &exportCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "export <lpm-manifest-artifact-ref | lpm-manifest-file>",
+		Short: "export the layer provenance metadata of an lpm manifest as an SBOM document (SPDX or CycloneDX)",
+		Example: `lpm export \
+[--username 					username] \
+[--password-stdin] \
+--format 						spdx-json|cyclonedx-json \
+[--name 						myregistry.myserver.io/myimage] \
+[--output 						lpm.spdx.json] \
+myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest, or lpm.json)
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return exportCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &exportCmd.registryOptions)
+
+	var formatLongFlag = "format"
+	f.StringVar(&exportCmd.format, formatLongFlag, "", "SBOM document format, either 'spdx-json' (SPDX 2.3) or 'cyclonedx-json' (CycloneDX 1.5)")
+	cobraCmd.MarkFlagRequired(formatLongFlag)
+
+	f.StringVar(&exportCmd.name, "name", "", "(optional) name of the subject image in the SBOM document (default: the repository of the lpm manifest artifact ref, or the subject image's digest for an lpm manifest file)")
+
+	f.StringVarP(&exportCmd.output, "output", "o", "", "(optional) output file to write the SBOM document to (default: stdout)")
+
+	return cobraCmd
+}
+
+// sbomComponent is the subject image (or one of its platform manifests, or one of its layers) as a component of an SBOM document.
+// The subject image is the root component, its layers (or, for a multi-platform subject image, its platform manifests) are its sub-components.
+type sbomComponent struct {
+	name      string
+	digest    digest.Digest
+	mediaType string
+	// annotations are the lpm annotations describing the component (for an image, the annotations of its config).
+	annotations map[string]string
+	components  []sbomComponent
+}
+
+func (exportCmd *exportCmd) run(refOrFile string) error {
+	if exportCmd.format != "spdx-json" && exportCmd.format != "cyclonedx-json" {
+		return fmt.Errorf("unsupported SBOM document format '%s', expected 'spdx-json' or 'cyclonedx-json'", exportCmd.format)
+	}
+
+	// Read the registry password from stdin if needed.
+	if err := exportCmd.registryOptions.complete(exportCmd.stdin, registryHost(refOrFile)); err != nil {
+		return err
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if exportCmd.output == "" {
+		out = exportCmd.stdout
+	} else {
+		f, err := os.Create(exportCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&exportCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	// Load the lpm manifest (or the lpm manifest of each platform of an lpm index).
+	loaded, lpmIndex, err := loadLpmManifests(ctx, registry, refOrFile)
+	if err != nil {
+		return err
+	}
+
+	// Make the component tree of the subject image.
+	name := exportCmd.name
+	if name == "" {
+		if _, err := os.Stat(refOrFile); err != nil {
+			name, _ = repositoryOf(refOrFile)
+		}
+	}
+	var root sbomComponent
+	if lpmIndex != nil {
+		root = sbomComponent{name: name, annotations: lpmIndex.Annotations}
+		if lpmIndex.Subject != nil {
+			root.digest, root.mediaType = lpmIndex.Subject.Digest, lpmIndex.Subject.MediaType
+		}
+		for _, l := range loaded {
+			component := newImageSbomComponent(name, l.manifest)
+			component.name = fmt.Sprintf("%s (%s)", component.name, l.platform)
+			root.components = append(root.components, component)
+		}
+	} else {
+		root = newImageSbomComponent(name, loaded[0].manifest)
+	}
+	if root.name == "" {
+		root.name = root.digest.String()
+	}
+
+	var document interface{}
+	if exportCmd.format == "spdx-json" {
+		document = newSpdxDocument(root)
+	} else {
+		document = newCycloneDXDocument(root)
+	}
+	documentJsonString, err := json.MarshalIndent(document, "", "	")
+	if err != nil {
+		return err
+	}
+	out.Write(documentJsonString)
+
+	return nil
+}
+
+// newImageSbomComponent returns the component of a subject image manifest, with a sub-component for each of its layers.
+func newImageSbomComponent(name string, lpmManifest artifactManifest) sbomComponent {
+	component := sbomComponent{name: name, annotations: lpmManifest.Config.Annotations}
+	if lpmManifest.Subject != nil {
+		component.digest, component.mediaType = lpmManifest.Subject.Digest, lpmManifest.Subject.MediaType
+	}
+	if component.name == "" {
+		component.name = component.digest.String()
+	}
+
+	for i, layer := range lpmManifest.Layers {
+		component.components = append(component.components, sbomComponent{
+			name:        fmt.Sprintf("layer %d", i),
+			digest:      digest.Digest(layer.Annotations[annotationKeyForSubjectDigest]),
+			mediaType:   layer.Annotations[annotationKeyForSubjectMediaType],
+			annotations: layer.Annotations,
+		})
+	}
+	return component
+}
+
+// sbomProperties returns the lpm annotations of a component that are not already told by the component's digest and media type,
+// sorted by key, such as its ownership, the Dockerfile command that created it and its lineage.
+func sbomProperties(component sbomComponent) [][2]string {
+	properties := make([][2]string, 0)
+	for key, value := range component.annotations {
+		switch key {
+		case annotationKeyForSubjectDigest, annotationKeyForSubjectMediaType:
+			continue
+		}
+		properties = append(properties, [2]string{key, value})
+	}
+	sort.Slice(properties, func(i, j int) bool { return properties[i][0] < properties[j][0] })
+	return properties
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// spdxDocument is an SPDX 2.3 document in JSON.
+// See https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	SPDXID                string           `json:"SPDXID"`
+	Name                  string           `json:"name"`
+	VersionInfo           string           `json:"versionInfo,omitempty"`
+	Supplier              string           `json:"supplier,omitempty"`
+	Originator            string           `json:"originator,omitempty"`
+	DownloadLocation      string           `json:"downloadLocation"`
+	FilesAnalyzed         bool             `json:"filesAnalyzed"`
+	Checksums             []spdxChecksum   `json:"checksums,omitempty"`
+	Homepage              string           `json:"homepage,omitempty"`
+	SourceInfo            string           `json:"sourceInfo,omitempty"`
+	Comment               string           `json:"comment,omitempty"`
+	PrimaryPackagePurpose string           `json:"primaryPackagePurpose,omitempty"`
+	Annotations           []spdxAnnotation `json:"annotations,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxAnnotation struct {
+	Annotator      string `json:"annotator"`
+	AnnotationDate string `json:"annotationDate"`
+	AnnotationType string `json:"annotationType"`
+	Comment        string `json:"comment"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// newSpdxDocument returns the SPDX document describing the subject image (the root component) as a package that contains a package for each layer.
+//
+// A package's supplier is the vendor that provides it (as recorded from the OCI image labels) and its originator is its authors.
+// Its ownership, the Dockerfile command that created it and its other lpm annotations are recorded as SPDX annotations ("key=value"),
+// and its ownership and command are summarized in its comment.
+func newSpdxDocument(root sbomComponent) spdxDocument {
+	created := time.Now().UTC().Format(time.RFC3339)
+	document := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              root.name,
+		DocumentNamespace: fmt.Sprintf("https://azurecr.io/lpm/spdx/%s-%s", strings.ReplaceAll(root.name, ":", "-"), newUUID()),
+		CreationInfo: spdxCreationInfo{
+			Created:  created,
+			Creators: []string{"Tool: lpm"},
+		},
+		Packages:      make([]spdxPackage, 0),
+		Relationships: make([]spdxRelationship, 0),
+	}
+
+	var addPackage func(component sbomComponent, id string, purpose string)
+	addPackage = func(component sbomComponent, id string, purpose string) {
+		p := spdxPackage{
+			SPDXID:                id,
+			Name:                  component.name,
+			Supplier:              "NOASSERTION",
+			DownloadLocation:      "NOASSERTION",
+			FilesAnalyzed:         false,
+			Homepage:              component.annotations[annotationKeyForSubjectUrl],
+			SourceInfo:            component.annotations[annotationKeyForSubjectSource],
+			PrimaryPackagePurpose: purpose,
+		}
+		if component.digest != "" {
+			p.VersionInfo = component.digest.String()
+			p.Checksums = []spdxChecksum{{Algorithm: strings.ToUpper(component.digest.Algorithm().String()), ChecksumValue: component.digest.Encoded()}}
+		}
+		if vendor := component.annotations[annotationKeyForSubjectVendor]; vendor != "" && vendor != ownershipUpstream && vendor != ownershipNonUpstream {
+			p.Supplier = "Organization: " + vendor
+		}
+		if authors := component.annotations[annotationKeyForSubjectAuthors]; authors != "" {
+			p.Originator = "Organization: " + authors
+		}
+		comment := make([]string, 0)
+		if ownership := layerOwnership(component.annotations); ownership != "" {
+			comment = append(comment, "ownership: "+ownership)
+		}
+		if command := component.annotations[annotationKeyForSubjectOriginalDockerfileFullCommand]; command != "" {
+			comment = append(comment, "command: "+command)
+		}
+		p.Comment = strings.Join(comment, "; ")
+		for _, property := range sbomProperties(component) {
+			p.Annotations = append(p.Annotations, spdxAnnotation{
+				Annotator:      "Tool: lpm",
+				AnnotationDate: created,
+				AnnotationType: "OTHER",
+				Comment:        property[0] + "=" + property[1],
+			})
+		}
+		document.Packages = append(document.Packages, p)
+
+		for i, child := range component.components {
+			childID := fmt.Sprintf("%s-%d", id, i)
+			childPurpose := "CONTAINER"
+			if len(child.components) == 0 {
+				childID = fmt.Sprintf("%s-Layer-%d", id, i)
+				childPurpose = "ARCHIVE"
+			}
+			addPackage(child, childID, childPurpose)
+			document.Relationships = append(document.Relationships, spdxRelationship{SPDXElementID: id, RelationshipType: "CONTAINS", RelatedSPDXElement: childID})
+		}
+	}
+
+	document.Relationships = append(document.Relationships, spdxRelationship{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Image"})
+	addPackage(root, "SPDXRef-Image", "CONTAINER")
+
+	return document
+}
+
+// cycloneDXDocument is a CycloneDX 1.5 BOM in JSON.
+// See https://cyclonedx.org/docs/1.5/json/
+type cycloneDXDocument struct {
+	BOMFormat    string            `json:"bomFormat"`
+	SpecVersion  string            `json:"specVersion"`
+	SerialNumber string            `json:"serialNumber"`
+	Version      int               `json:"version"`
+	Metadata     cycloneDXMetadata `json:"metadata"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     cycloneDXTools     `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTools struct {
+	Components []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type               string                  `json:"type"`
+	BOMRef             string                  `json:"bom-ref,omitempty"`
+	Supplier           *cycloneDXOrganization  `json:"supplier,omitempty"`
+	Author             string                  `json:"author,omitempty"`
+	Name               string                  `json:"name"`
+	Version            string                  `json:"version,omitempty"`
+	MimeType           string                  `json:"mime-type,omitempty"`
+	Hashes             []cycloneDXHash         `json:"hashes,omitempty"`
+	Properties         []cycloneDXProperty     `json:"properties,omitempty"`
+	Components         []cycloneDXComponent    `json:"components,omitempty"`
+	ExternalReferences []cycloneDXExternalLink `json:"externalReferences,omitempty"`
+}
+
+type cycloneDXOrganization struct {
+	Name string `json:"name"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXExternalLink struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// newCycloneDXDocument returns the CycloneDX BOM whose root component (its metadata's component) is the subject image,
+// with a sub-component for each layer.
+//
+// A component's supplier is the vendor that provides it (as recorded from the OCI image labels) and its author is its authors.
+// Its ownership, the Dockerfile command that created it and its other lpm annotations are recorded as CycloneDX properties.
+func newCycloneDXDocument(root sbomComponent) cycloneDXDocument {
+	var newComponent func(component sbomComponent, bomRef string, componentType string) cycloneDXComponent
+	newComponent = func(component sbomComponent, bomRef string, componentType string) cycloneDXComponent {
+		c := cycloneDXComponent{
+			Type:     componentType,
+			BOMRef:   bomRef,
+			Author:   component.annotations[annotationKeyForSubjectAuthors],
+			Name:     component.name,
+			MimeType: component.mediaType,
+		}
+		if component.digest != "" {
+			c.Hashes = []cycloneDXHash{{Alg: strings.ToUpper(strings.Replace(component.digest.Algorithm().String(), "sha", "SHA-", 1)), Content: component.digest.Encoded()}}
+			if componentType == "container" {
+				c.Version = component.digest.String()
+			}
+		}
+		if vendor := component.annotations[annotationKeyForSubjectVendor]; vendor != "" && vendor != ownershipUpstream && vendor != ownershipNonUpstream {
+			c.Supplier = &cycloneDXOrganization{Name: vendor}
+		}
+		if url := component.annotations[annotationKeyForSubjectUrl]; url != "" {
+			c.ExternalReferences = append(c.ExternalReferences, cycloneDXExternalLink{Type: "website", URL: url})
+		}
+		if source := component.annotations[annotationKeyForSubjectSource]; source != "" {
+			c.ExternalReferences = append(c.ExternalReferences, cycloneDXExternalLink{Type: "vcs", URL: source})
+		}
+		for _, property := range sbomProperties(component) {
+			c.Properties = append(c.Properties, cycloneDXProperty{Name: property[0], Value: property[1]})
+		}
+
+		for i, child := range component.components {
+			childType := "container"
+			if len(child.components) == 0 {
+				childType = "file"
+			}
+			c.Components = append(c.Components, newComponent(child, fmt.Sprintf("%s/%d", bomRef, i), childType))
+		}
+		return c
+	}
+
+	return cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools: cycloneDXTools{
+				Components: []cycloneDXComponent{{Type: "application", Name: "lpm"}},
+			},
+			Component: newComponent(root, "image", "container"),
+		},
+	}
+}
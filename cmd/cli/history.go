@@ -0,0 +1,79 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// modifyManifestWithHistoryOrigin annotates the image manifest layers with the image config history entries that created them.
+// This is used when the subject image's Dockerfile is not available.
+//
+// Every history entry that is not marked as an empty layer created exactly one layer, in order.
+// The history alone does not tell which layers were inherited from a base image,
+// so only the upstreamLayers bottom layers shared with the base image are attributed as "upstream",
+// and the other layers are attributed as "non-upstream".
+// Without a base image (upstreamLayers is -1), the ownership of every layer is "unknown".
+func modifyManifestWithHistoryOrigin(history []goocispecv1.History, upstreamLayers int, manifest *goocispecv1.Manifest) (*goocispecv1.Manifest, error) {
+	// Keep the history entries that created a layer.
+	layerHistory := make([]goocispecv1.History, 0)
+	for _, h := range history {
+		if !h.EmptyLayer {
+			layerHistory = append(layerHistory, h)
+		}
+	}
+	if len(layerHistory) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config history has %d non-empty entries but the image manifest has %d layers", len(layerHistory), len(manifest.Layers))
+	}
+
+	// Set ownership of the image manifest to "non-upstream".
+	manifest.Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
+	// Set ownership of the image manifest config to "non-upstream".
+	manifest.Config.Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
+
+	for m := range manifest.Layers {
+		if upstreamLayers < 0 {
+			manifest.Layers[m].Annotations = deepCopyMap(annotationsForUnknownOwnership)
+		} else if m < upstreamLayers {
+			manifest.Layers[m].Annotations = deepCopyMap(annotationsForUpstreamOwnership)
+		} else {
+			manifest.Layers[m].Annotations = deepCopyMap(annotationsForNonUpstreamOwnership)
+		}
+		manifest.Layers[m].Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = historyDockerfileCommand(layerHistory[m])
+		setHistoryAnnotations(manifest.Layers[m].Annotations, layerHistory[m])
+	}
+
+	return manifest, nil
+}
+
+// setHistoryAnnotations records the image config history entry that created a layer.
+func setHistoryAnnotations(annotations map[string]string, history goocispecv1.History) {
+	annotations[annotationKeyForSubjectHistoryCreatedBy] = history.CreatedBy
+	if !history.Created.Time.IsZero() {
+		annotations[annotationKeyForSubjectHistoryCreated] = history.Created.Time.UTC().Format(time.RFC3339)
+	}
+	if history.Comment != "" {
+		annotations[annotationKeyForSubjectHistoryComment] = history.Comment
+	}
+}
+
+// historyDockerfileCommand returns the Dockerfile command recorded in an image config history entry.
+//
+// The legacy builder records commands as "/bin/sh -c #(nop)  COPY file:abc in / " (RUN commands are recorded as "/bin/sh -c <command>"),
+// while BuildKit records them as "RUN /bin/sh -c <command> # buildkit".
+func historyDockerfileCommand(history goocispecv1.History) string {
+	createdBy := strings.TrimSpace(history.CreatedBy)
+	if strings.HasPrefix(createdBy, "/bin/sh -c #(nop)") {
+		return strings.TrimSpace(strings.TrimPrefix(createdBy, "/bin/sh -c #(nop)"))
+	}
+	if strings.HasPrefix(createdBy, "/bin/sh -c ") {
+		return "RUN " + createdBy
+	}
+	return strings.TrimSpace(strings.TrimSuffix(createdBy, "# buildkit"))
+}
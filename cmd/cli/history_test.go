@@ -0,0 +1,46 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestModifyManifestWithHistoryOriginOwnership(t *testing.T) {
+	history := []goocispecv1.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:a in / "},
+		{CreatedBy: `/bin/sh -c #(nop)  CMD ["bash"]`, EmptyLayer: true},
+		{CreatedBy: "RUN /bin/sh -c pip install x # buildkit"},
+	}
+
+	tests := []struct {
+		name           string
+		upstreamLayers int
+		want           []string
+	}{
+		{name: "without base image", upstreamLayers: -1, want: []string{ownershipUnknown, ownershipUnknown}},
+		{name: "base image without common layers", upstreamLayers: 0, want: []string{ownershipNonUpstream, ownershipNonUpstream}},
+		{name: "base image with a common layer", upstreamLayers: 1, want: []string{ownershipUpstream, ownershipNonUpstream}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := &goocispecv1.Manifest{Layers: make([]goocispecv1.Descriptor, 2)}
+			manifest, err := modifyManifestWithHistoryOrigin(history, tt.upstreamLayers, manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0)
+			for _, layer := range manifest.Layers {
+				got = append(got, layerOwnership(layer.Annotations))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("layer ownerships = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
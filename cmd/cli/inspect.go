@@ -0,0 +1,191 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+type inspectCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	format          string
+	output          string
+}
+
+func newInspectCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	inspectCmd := &inspectCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "inspect <lpm-manifest-artifact-ref | lpm-manifest-file>",
+		Short: "show the layer provenance metadata of an lpm manifest as a table",
+		Example: `lpm inspect \
+[--username 					username] \
+[--password-stdin] \
+[--format 						table|json|yaml] \
+[--output 						lpm-table.txt] \
+myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest, or lpm.json)
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return inspectCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &inspectCmd.registryOptions)
+
+	f.StringVar(&inspectCmd.format, "format", "table", "(optional) output format, either 'table', 'json' or 'yaml'")
+
+	f.StringVarP(&inspectCmd.output, "output", "o", "", "(optional) output file to write the layer table to (default: stdout)")
+
+	return cobraCmd
+}
+
+// lpmInspection is the layer table of an lpm manifest.
+type lpmInspection struct {
+	// Source is the file path or the reference that the lpm manifest was loaded from.
+	Source string `json:"source"`
+	// Platform is the subject image's platform if the lpm manifest belongs to an lpm index.
+	Platform string `json:"platform,omitempty"`
+	// Subject is the digest of the subject image manifest.
+	Subject string `json:"subject,omitempty"`
+	// Layers are the subject image's layers, from the bottom layer to the top layer.
+	Layers []lpmInspectionLayer `json:"layers"`
+}
+
+// lpmInspectionLayer is a row of the layer table of an lpm manifest.
+type lpmInspectionLayer struct {
+	Index         int    `json:"index"`
+	SubjectDigest string `json:"subjectDigest"`
+	Size          int64  `json:"size"`
+	Ownership     string `json:"ownership"`
+	Command       string `json:"command"`
+}
+
+func (inspectCmd *inspectCmd) run(refOrFile string) error {
+	// Read the registry password from stdin if needed.
+	if err := inspectCmd.registryOptions.complete(inspectCmd.stdin, registryHost(refOrFile)); err != nil {
+		return err
+	}
+
+	if inspectCmd.format != "table" && inspectCmd.format != "json" && inspectCmd.format != "yaml" {
+		return fmt.Errorf("unsupported output format '%s', expected 'table', 'json' or 'yaml'", inspectCmd.format)
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if inspectCmd.output == "" {
+		out = inspectCmd.stdout
+	} else {
+		f, err := os.Create(inspectCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&inspectCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	// Load the lpm manifest (or the lpm manifest of each platform of an lpm index).
+	loaded, _, err := loadLpmManifests(ctx, registry, refOrFile)
+	if err != nil {
+		return err
+	}
+
+	// Build the layer table of each lpm manifest from the layers' annotations.
+	inspections := make([]lpmInspection, 0)
+	for _, l := range loaded {
+		inspection := lpmInspection{
+			Source:   l.source,
+			Platform: l.platform,
+			Layers:   make([]lpmInspectionLayer, 0),
+		}
+		if l.manifest.Subject != nil {
+			inspection.Subject = l.manifest.Subject.Digest.String()
+		}
+		for i, layer := range l.manifest.Layers {
+			size, _ := strconv.ParseInt(layer.Annotations[annotationKeyForSubjectSize], 10, 64)
+			inspection.Layers = append(inspection.Layers, lpmInspectionLayer{
+				Index:         i,
+				SubjectDigest: layer.Annotations[annotationKeyForSubjectDigest],
+				Size:          size,
+				Ownership:     layerOwnership(layer.Annotations),
+				Command:       layerCommand(layer.Annotations),
+			})
+		}
+		inspections = append(inspections, inspection)
+	}
+
+	// A single lpm manifest is written as a single object, and the lpm manifests of an lpm index as a list.
+	var v interface{} = inspections
+	if len(inspections) == 1 && inspections[0].Platform == "" {
+		v = inspections[0]
+	}
+
+	switch inspectCmd.format {
+	case "json":
+		inspectionJsonString, err := json.MarshalIndent(v, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(inspectionJsonString)
+	case "yaml":
+		inspectionYamlString, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		out.Write(inspectionYamlString)
+	default:
+		for i, inspection := range inspections {
+			if i > 0 {
+				fmt.Fprintln(out)
+			}
+			writeLpmInspectionTable(out, inspection)
+		}
+	}
+
+	return nil
+}
+
+// writeLpmInspectionTable writes the layer table of an lpm manifest, preceded by the platform of its subject image (if any).
+func writeLpmInspectionTable(out io.Writer, inspection lpmInspection) {
+	if inspection.Platform != "" {
+		fmt.Fprintf(out, "PLATFORM: %s\n", inspection.Platform)
+	}
+	if inspection.Subject != "" {
+		fmt.Fprintf(out, "SUBJECT: %s\n", inspection.Subject)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tSUBJECT DIGEST\tSIZE\tOWNERSHIP\tCOMMAND")
+	for _, layer := range inspection.Layers {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", layer.Index, layer.SubjectDigest, layer.Size, layer.Ownership, layer.Command)
+	}
+	w.Flush()
+}
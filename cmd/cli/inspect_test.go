@@ -0,0 +1,47 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInspectLayerCommands(t *testing.T) {
+	var stdout bytes.Buffer
+	inspectCmd := &inspectCmd{
+		stdin:  strings.NewReader(""),
+		stdout: &stdout,
+		format: "json",
+	}
+	if err := inspectCmd.run(filepath.Join("testdata", "lpm-manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	var inspection lpmInspection
+	if err := json.Unmarshal(stdout.Bytes(), &inspection); err != nil {
+		t.Fatal(err)
+	}
+	commands := make([]string, 0)
+	for _, layer := range inspection.Layers {
+		commands = append(commands, layer.Ownership+" "+layer.Command)
+	}
+	// The upstream layers show the command of the base image's Dockerfile that they were inherited from,
+	// rather than the "FROM" command of the subject image's Dockerfile.
+	want := []string{
+		"upstream ADD rootfs.tar.xz /",
+		"upstream RUN apt-get update && apt-get install -y openssl",
+		"non-upstream RUN pip install -r requirements.txt",
+		"non-upstream COPY . /app",
+		"non-upstream RUN pip install -r requirements.txt",
+	}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("layer commands = %q, want %q", commands, want)
+	}
+}
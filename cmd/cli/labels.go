@@ -0,0 +1,115 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/asottile/dockerfile"
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// annotationKeysForImageLabels maps the OCI image labels that describe who provides an image
+// to the lpm annotations that record them for each layer.
+// See https://github.com/opencontainers/image-spec/blob/main/annotations.md#pre-defined-annotation-keys
+var annotationKeysForImageLabels = map[string]string{
+	"org.opencontainers.image.authors":  annotationKeyForSubjectAuthors,
+	"org.opencontainers.image.url":      annotationKeyForSubjectUrl,
+	"org.opencontainers.image.source":   annotationKeyForSubjectSource,
+	"org.opencontainers.image.vendor":   annotationKeyForSubjectVendor,
+	"org.opencontainers.image.revision": annotationKeyForSubjectRevision,
+}
+
+// setLabelAnnotations records the OCI image labels that describe who provides an image in the annotations.
+func setLabelAnnotations(annotations map[string]string, labels map[string]string) {
+	for label, key := range annotationKeysForImageLabels {
+		if value := labels[label]; value != "" {
+			annotations[key] = value
+		}
+	}
+}
+
+// configLabels returns the labels of an image config (or nil if there is no image config).
+func configLabels(config *goocispecv1.ConfigFile) map[string]string {
+	if config == nil {
+		return nil
+	}
+	return config.Config.Labels
+}
+
+// dockerfileLabels returns the labels set by the "LABEL" commands of the Dockerfile stage chain that makes up the target stage's image.
+// Later "LABEL" commands override earlier ones, as in the built image config.
+func dockerfileLabels(dockerfileCommands []dockerfile.Command, target string) (map[string]string, error) {
+	stages, err := parseDockerfileStages(dockerfileCommands)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := dockerfileStageChain(stages, target)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	for _, stage := range chain {
+		for _, command := range stage.commands {
+			if strings.ToUpper(command.Cmd) != "LABEL" {
+				continue
+			}
+			// "LABEL <key>=<value> <key>=<value> ..." is parsed into alternating keys and values.
+			for i := 0; i+1 < len(command.Value); i += 2 {
+				labels[unquoteDockerfileWord(command.Value[i])] = unquoteDockerfileWord(command.Value[i+1])
+			}
+		}
+	}
+	return labels, nil
+}
+
+// unquoteDockerfileWord removes the quotes around a quoted Dockerfile word.
+func unquoteDockerfileWord(word string) string {
+	if len(word) >= 2 && (word[0] == '"' || word[0] == '\'') && word[len(word)-1] == word[0] {
+		if unquoted, err := strconv.Unquote(`"` + word[1:len(word)-1] + `"`); err == nil {
+			return unquoted
+		}
+		return word[1 : len(word)-1]
+	}
+	return word
+}
+
+// ownLabels returns the labels that the subject image sets itself, leaving out the labels inherited unchanged from its base image.
+func ownLabels(subjectLabels map[string]string, baseLabels map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for label, value := range subjectLabels {
+		if baseValue, ok := baseLabels[label]; ok && baseValue == value {
+			continue
+		}
+		labels[label] = value
+	}
+	return labels
+}
+
+// modifyManifestWithLabels records who provides each layer in the image manifest layers' annotations.
+//
+// Upstream layers are provided by the base image, and are annotated with the base image config's labels.
+// Non-upstream layers are provided by the subject image, and are annotated with the labels that the subject image sets itself.
+// Layers of unknown ownership are not annotated with labels, since it is not known who provides them.
+// The image manifest and its config describe the subject image as a whole, and are annotated with all of the subject image's labels.
+func modifyManifestWithLabels(manifest *goocispecv1.Manifest, subjectLabels map[string]string, baseLabels map[string]string) *goocispecv1.Manifest {
+	setLabelAnnotations(manifest.Annotations, subjectLabels)
+	setLabelAnnotations(manifest.Config.Annotations, subjectLabels)
+
+	nonUpstreamLabels := ownLabels(subjectLabels, baseLabels)
+	for m := range manifest.Layers {
+		switch layerOwnership(manifest.Layers[m].Annotations) {
+		case ownershipUpstream:
+			setLabelAnnotations(manifest.Layers[m].Annotations, baseLabels)
+		case ownershipUnknown:
+		default:
+			setLabelAnnotations(manifest.Layers[m].Annotations, nonUpstreamLabels)
+		}
+	}
+
+	return manifest
+}
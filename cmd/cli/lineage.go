@@ -0,0 +1,99 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+// fetchBaseLpmManifest fetches the lpm manifest attached to the base image as a referrer (or nil if the base image has none).
+// When several lpm manifests are attached, the most recently created one is used.
+func fetchBaseLpmManifest(ctx context.Context, registry *content.Registry, base *baseImage, registryOptions *registryOptions) (*artifactManifest, error) {
+	remote, err := newRemoteRepository(ctx, base.repository, registryOptions, false)
+	if err != nil {
+		return nil, err
+	}
+	descs, err := remote.referrersOfType(ctx, base.desc.Digest, mediaTypeForManifestLpm)
+	if err != nil {
+		return nil, err
+	}
+	if len(descs) == 0 {
+		return nil, nil
+	}
+
+	desc := latestReferrer(descs)
+	b, err := fetchContent(ctx, registry, fmt.Sprintf("%s@%s", base.repository, desc.Digest), desc.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	var lpmManifest artifactManifest
+	if err := json.Unmarshal(b, &lpmManifest); err != nil {
+		return nil, err
+	}
+	return &lpmManifest, nil
+}
+
+// modifyManifestWithLineage records, for each layer, the chain of base images that the layer was inherited through.
+//
+// A layer created by the subject image itself has a lineage depth of 0.
+// A layer inherited from the base image has a lineage depth of 1 and a lineage chain made of the base image,
+// unless the base image's own lpm manifest tells that the base image inherited the layer from its own base image,
+// in which case the base image's lineage is followed through any number of "FROM" levels.
+// The lineage depth is always the number of base images in the lineage chain, so a base image whose lpm manifest
+// records no lineage and no base image ref ends the chain.
+// The attribution that the base image's lpm manifest records for a layer (such as its vendor and the command that created it)
+// is copied onto the layer, as it is more precise than the base image's labels.
+func modifyManifestWithLineage(manifest *goocispecv1.Manifest, upstreamLayers int, base *baseImage, baseLpmManifest *artifactManifest) *goocispecv1.Manifest {
+	for m := range manifest.Layers {
+		annotations := manifest.Layers[m].Annotations
+		if m >= upstreamLayers {
+			annotations[annotationKeyForSubjectLineageDepth] = "0"
+			continue
+		}
+
+		chain := []string{base.ref}
+		command := ""
+
+		// Follow the base image's lpm manifest if it describes the same layer.
+		if baseLpmManifest != nil && m < len(baseLpmManifest.Layers) {
+			baseAnnotations := baseLpmManifest.Layers[m].Annotations
+			if baseAnnotations[annotationKeyForSubjectDigest] == manifest.Layers[m].Digest.String() {
+				if layerOwnership(baseAnnotations) == ownershipUpstream {
+					if baseChain := baseAnnotations[annotationKeyForSubjectLineageChain]; baseChain != "" {
+						chain = append(chain, strings.Split(baseChain, ",")...)
+					} else if baseBaseRef := baseLpmManifest.Annotations[annotationKeyForSubjectBaseImageRef]; baseBaseRef != "" {
+						// lpm manifests generated before lineage was recorded only tell that the layer is inherited from their base image.
+						chain = append(chain, baseBaseRef)
+					}
+				}
+
+				command = baseAnnotations[annotationKeyForSubjectLineageDockerfileFullCommand]
+				if command == "" {
+					command = baseAnnotations[annotationKeyForSubjectOriginalDockerfileFullCommand]
+				}
+
+				for _, key := range annotationKeysForImageLabels {
+					if value, ok := baseAnnotations[key]; ok && value != ownershipUpstream && value != ownershipNonUpstream {
+						annotations[key] = value
+					}
+				}
+			}
+		}
+
+		annotations[annotationKeyForSubjectLineageDepth] = fmt.Sprint(len(chain))
+		annotations[annotationKeyForSubjectLineageChain] = strings.Join(chain, ",")
+		if command != "" {
+			annotations[annotationKeyForSubjectLineageDockerfileFullCommand] = command
+		}
+	}
+
+	return manifest
+}
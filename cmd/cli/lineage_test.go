@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"testing"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestModifyManifestWithLineage(t *testing.T) {
+	layerDigest := goocispecv1.Hash{Algorithm: "sha256", Hex: "7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc"}
+	base := &baseImage{ref: "myregistry.azurecr.io/base:1"}
+
+	// baseLpmManifest returns the base image's lpm manifest describing the inherited layer with the given annotations.
+	baseLpmManifest := func(manifestAnnotations map[string]string, layerAnnotations map[string]string) *artifactManifest {
+		layerAnnotations[annotationKeyForSubjectDigest] = layerDigest.String()
+		return &artifactManifest{Manifest: ocispecv1.Manifest{
+			Annotations: manifestAnnotations,
+			Layers:      []ocispecv1.Descriptor{{Annotations: layerAnnotations}},
+		}}
+	}
+
+	tests := []struct {
+		name            string
+		upstreamLayers  int
+		baseLpmManifest *artifactManifest
+		wantDepth       string
+		wantChain       string
+	}{
+		{
+			name:           "layer of the subject image",
+			upstreamLayers: 0,
+			wantDepth:      "0",
+		},
+		{
+			name:           "base image without lpm manifest",
+			upstreamLayers: 1,
+			wantDepth:      "1",
+			wantChain:      "myregistry.azurecr.io/base:1",
+		},
+		{
+			name:            "layer created by the base image",
+			upstreamLayers:  1,
+			baseLpmManifest: baseLpmManifest(nil, map[string]string{annotationKeyForSubjectOwnership: ownershipNonUpstream, annotationKeyForSubjectLineageDepth: "0"}),
+			wantDepth:       "1",
+			wantChain:       "myregistry.azurecr.io/base:1",
+		},
+		{
+			name:           "base image lpm manifest with lineage",
+			upstreamLayers: 1,
+			baseLpmManifest: baseLpmManifest(nil, map[string]string{
+				annotationKeyForSubjectOwnership:    ownershipUpstream,
+				annotationKeyForSubjectLineageDepth: "2",
+				annotationKeyForSubjectLineageChain: "myregistry.azurecr.io/middle:1,myregistry.azurecr.io/root:1",
+			}),
+			wantDepth: "3",
+			wantChain: "myregistry.azurecr.io/base:1,myregistry.azurecr.io/middle:1,myregistry.azurecr.io/root:1",
+		},
+		{
+			name:            "base image lpm manifest without lineage",
+			upstreamLayers:  1,
+			baseLpmManifest: baseLpmManifest(map[string]string{annotationKeyForSubjectBaseImageRef: "myregistry.azurecr.io/root:1"}, map[string]string{annotationKeyForSubjectOwnership: ownershipUpstream}),
+			wantDepth:       "2",
+			wantChain:       "myregistry.azurecr.io/base:1,myregistry.azurecr.io/root:1",
+		},
+		{
+			name:            "base image lpm manifest without lineage or base image ref",
+			upstreamLayers:  1,
+			baseLpmManifest: baseLpmManifest(nil, map[string]string{annotationKeyForSubjectOwnership: ownershipUpstream}),
+			wantDepth:       "1",
+			wantChain:       "myregistry.azurecr.io/base:1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := &goocispecv1.Manifest{Layers: []goocispecv1.Descriptor{{Digest: layerDigest, Annotations: map[string]string{}}}}
+			annotations := modifyManifestWithLineage(manifest, tt.upstreamLayers, base, tt.baseLpmManifest).Layers[0].Annotations
+			if got := annotations[annotationKeyForSubjectLineageDepth]; got != tt.wantDepth {
+				t.Errorf("lineage depth = %q, want %q", got, tt.wantDepth)
+			}
+			if got := annotations[annotationKeyForSubjectLineageChain]; got != tt.wantChain {
+				t.Errorf("lineage chain = %q, want %q", got, tt.wantChain)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	cliconfig "github.com/docker/cli/cli/config"
+	clitypes "github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/spf13/cobra"
+	dockerauth "oras.land/oras-go/pkg/auth/docker"
+)
+
+type loginCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+}
+
+func newLoginCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	loginCmd := &loginCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "login <registry>",
+		Short: "log in to a registry, storing the credentials in the Docker config file (or its credential helper)",
+		Example: `lpm login \
+--username 						username \
+--password-stdin \
+[--ca-file 						ca.pem] \
+myregistry.myserver.io
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return loginCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &loginCmd.registryOptions)
+
+	return cobraCmd
+}
+
+func (loginCmd *loginCmd) run(hostname string) error {
+	// Read the registry password from stdin if needed.
+	if err := loginCmd.registryOptions.complete(loginCmd.stdin, hostname); err != nil {
+		return err
+	}
+	if loginCmd.registryOptions.username == "" || loginCmd.registryOptions.password == "" {
+		return fmt.Errorf("--username and --password (or --password-stdin) are required to log in")
+	}
+
+	ctx := context.Background()
+
+	// The credentials are verified with the registry before they are stored,
+	// connecting to the registry as its per-registry config (and the command line flags) tells.
+	if err := loginCmd.verifyCredentials(ctx, hostname); err != nil {
+		return fmt.Errorf("login to '%s' failed: %w", hostname, err)
+	}
+
+	// The credentials are stored where "docker login" stores them,
+	// so that they are used by lpm (and docker) when no credentials are given.
+	configFile, err := cliconfig.Load(cliconfig.Dir())
+	if err != nil {
+		return err
+	}
+	serverAddress := hostname
+	if hostname == "docker.io" || hostname == "index.docker.io" || hostname == "registry-1.docker.io" {
+		// Docker Hub credentials are stored under the Docker Hub index server's address, as "docker login" does.
+		serverAddress = "https://index.docker.io/v1/"
+	}
+	err = configFile.GetCredentialsStore(serverAddress).Store(clitypes.AuthConfig{
+		Username:      loginCmd.registryOptions.username,
+		Password:      loginCmd.registryOptions.password,
+		ServerAddress: serverAddress,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(loginCmd.stdout, "Login succeeded for '%s'\n", hostname)
+	return nil
+}
+
+// verifyCredentials verifies the credentials given on the command line by authenticating to the registry's API base endpoint ("/v2/").
+func (loginCmd *loginCmd) verifyCredentials(ctx context.Context, hostname string) error {
+	config := loginCmd.registryOptions.configFor(hostname)
+	nameOptions := make([]name.Option, 0)
+	if config.usePlainHTTP(hostname) {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	registry, err := name.NewRegistry(hostname, nameOptions...)
+	if err != nil {
+		return err
+	}
+
+	roundTripper, err := loginCmd.registryOptions.transport(config)
+	if err != nil {
+		return err
+	}
+	authenticator := authn.FromConfig(authn.AuthConfig{Username: loginCmd.registryOptions.username, Password: loginCmd.registryOptions.password})
+	t, err := transport.NewWithContext(ctx, registry, authenticator, roundTripper, []string{})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", config.scheme(hostname), registry.RegistryStr()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return transport.CheckError(resp, http.StatusOK)
+}
+
+type logoutCmd struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func newLogoutCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	logoutCmd := &logoutCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "logout <registry>",
+		Short: "log out from a registry, removing the credentials stored by login",
+		Example: `lpm logout \
+myregistry.myserver.io
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return logoutCmd.run(args[0])
+		},
+	}
+
+	return cobraCmd
+}
+
+func (logoutCmd *logoutCmd) run(hostname string) error {
+	client, err := dockerauth.NewClient()
+	if err != nil {
+		return err
+	}
+
+	err = client.Logout(context.Background(), hostname)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(logoutCmd.stdout, "Removed login credentials for '%s'\n", hostname)
+	return nil
+}
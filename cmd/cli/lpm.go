@@ -0,0 +1,182 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+// loadedLpmManifest is an lpm manifest loaded from a file or from a registry.
+type loadedLpmManifest struct {
+	// source is the file path or the (digest) reference that the lpm manifest was loaded from.
+	source string
+	// platform is the platform of the subject image if the lpm manifest was loaded through an lpm index (or empty).
+	platform string
+	// manifest is the lpm manifest.
+	manifest artifactManifest
+}
+
+// loadLpmManifests loads the lpm manifest at refOrFile, which is either an lpm manifest file or an lpm manifest artifact ref.
+//
+// An lpm index (generated for a multi-platform subject image) is expanded into the lpm manifest of each platform,
+// which are fetched from the lpm index's repository, and is returned as well (or nil for a single lpm manifest).
+// lpm index files do not hold the platforms' lpm manifests, so they must be loaded from a registry instead.
+func loadLpmManifests(ctx context.Context, registry *content.Registry, refOrFile string) ([]loadedLpmManifest, *artifactIndex, error) {
+	// Read the lpm manifest from the file if it exists, or fetch it from the registry otherwise.
+	var manifestBytes []byte
+	fromFile := false
+	if _, err := os.Stat(refOrFile); err == nil {
+		manifestBytes, err = os.ReadFile(refOrFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		fromFile = true
+	} else {
+		manifestBytes, _, err = fetchManifest(ctx, registry, refOrFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return decodeLpmManifests(ctx, registry, refOrFile, manifestBytes, fromFile)
+}
+
+// decodeLpmManifests decodes the lpm manifest (or lpm index) manifestBytes loaded from refOrFile, as loadLpmManifests does.
+func decodeLpmManifests(ctx context.Context, registry *content.Registry, refOrFile string, manifestBytes []byte, fromFile bool) ([]loadedLpmManifest, *artifactIndex, error) {
+	if !isImageIndex(manifestBytes) {
+		var manifest artifactManifest
+		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+			return nil, nil, err
+		}
+		return []loadedLpmManifest{{source: refOrFile, manifest: manifest}}, nil, nil
+	}
+
+	if fromFile {
+		return nil, nil, fmt.Errorf("'%s' is an lpm index, load it from the registry or load the lpm manifest of each platform instead", refOrFile)
+	}
+
+	var index artifactIndex
+	if err := json.Unmarshal(manifestBytes, &index); err != nil {
+		return nil, nil, err
+	}
+	repository, err := repositoryOf(refOrFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Fetch the lpm manifest of each platform by digest, in the order of the lpm index.
+	loaded := make([]loadedLpmManifest, 0)
+	for _, desc := range index.Manifests {
+		ref := fmt.Sprintf("%s@%s", repository, desc.Digest)
+		b, err := fetchContent(ctx, registry, ref, desc.Descriptor)
+		if err != nil {
+			return nil, nil, err
+		}
+		var manifest artifactManifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, nil, err
+		}
+
+		platform := manifest.Annotations[annotationKeyForSubjectPlatform]
+		if platform == "" && desc.Platform != nil {
+			platform = platformString(&goocispecv1.Platform{OS: desc.Platform.OS, Architecture: desc.Platform.Architecture, Variant: desc.Platform.Variant})
+		}
+		loaded = append(loaded, loadedLpmManifest{source: ref, platform: platform, manifest: manifest})
+	}
+
+	return loaded, &index, nil
+}
+
+// layerOwnership returns the ownership ("upstream" or "non-upstream") recorded in an lpm layer's annotations.
+// lpm manifests generated before the ownership annotation was added recorded the ownership in the vendor annotation.
+func layerOwnership(annotations map[string]string) string {
+	if ownership, ok := annotations[annotationKeyForSubjectOwnership]; ok {
+		return ownership
+	}
+	return annotations[annotationKeyForSubjectVendor]
+}
+
+// selectLpmManifest returns the lpm manifest of the subject image that another document (such as a scan report or an SBOM) is about,
+// among the lpm manifests of the platforms of an lpm index: the lpm manifest of the given platform,
+// or otherwise the one whose subject image has the config digest imageID or one of the layer digests.
+func selectLpmManifest(loaded []loadedLpmManifest, platform string, imageID string, layerDigests []string) (loadedLpmManifest, error) {
+	if platform != "" {
+		for _, l := range loaded {
+			if l.platform == platform {
+				return l, nil
+			}
+		}
+		return loadedLpmManifest{}, fmt.Errorf("no lpm manifest for platform '%s'", platform)
+	}
+	if len(loaded) == 1 {
+		return loaded[0], nil
+	}
+
+	for _, l := range loaded {
+		if imageID != "" && l.manifest.Config.Annotations[annotationKeyForSubjectDigest] == imageID {
+			return l, nil
+		}
+	}
+	for _, l := range loaded {
+		indexes := lpmLayerIndexes(l.manifest)
+		for _, d := range layerDigests {
+			if _, ok := indexes[d]; ok && d != "" {
+				return l, nil
+			}
+		}
+	}
+	return loadedLpmManifest{}, fmt.Errorf("cannot tell the platform of the subject image, use --platform to select it")
+}
+
+// lpmLayerIndexes returns the index of each layer of an lpm manifest's subject image, by the layer's digest.
+func lpmLayerIndexes(lpmManifest artifactManifest) map[string]int {
+	indexes := make(map[string]int)
+	for i, layer := range lpmManifest.Layers {
+		indexes[layer.Annotations[annotationKeyForSubjectDigest]] = i
+	}
+	return indexes
+}
+
+// lpmLayerIndexesByDiffID returns the index of each layer of an lpm manifest's subject image, by the layer's DiffID.
+// lpm manifests record the layers' (compressed) digests, so each DiffID of the subject image's DiffIDs (from its config,
+// or as reported by a tool such as a scanner) is mapped to the layer at the same position.
+func lpmLayerIndexesByDiffID(lpmManifest artifactManifest, diffIDs []string) map[string]int {
+	indexes := make(map[string]int)
+	if len(diffIDs) != len(lpmManifest.Layers) {
+		return indexes
+	}
+	for i, diffID := range diffIDs {
+		indexes[diffID] = i
+	}
+	return indexes
+}
+
+// layerCommand returns the Dockerfile command that created a layer, as recorded in its lpm annotations:
+// the command of the subject image's Dockerfile, or of the Dockerfile of the image that the layer was inherited from,
+// or otherwise the layer's image history entry.
+// The subject image's Dockerfile command of an upstream layer is the "FROM" command of its base image,
+// so the command of the Dockerfile it was inherited from comes first.
+func layerCommand(annotations map[string]string) string {
+	keys := []string{
+		annotationKeyForSubjectOriginalDockerfileFullCommand,
+		annotationKeyForSubjectLineageDockerfileFullCommand,
+		annotationKeyForSubjectHistoryCreatedBy,
+	}
+	if layerOwnership(annotations) == ownershipUpstream {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	for _, key := range keys {
+		if command := annotations[key]; command != "" {
+			return command
+		}
+	}
+	return ""
+}
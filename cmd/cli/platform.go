@@ -0,0 +1,102 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// isImageIndex returns whether the manifest is an OCI image index or a Docker manifest list,
+// which describe multi-platform images.
+func isImageIndex(manifest []byte) bool {
+	var versioned struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifest, &versioned); err != nil {
+		return false
+	}
+
+	switch types.MediaType(versioned.MediaType) {
+	case types.OCIImageIndex, types.DockerManifestList:
+		return true
+	case "":
+		// The mediaType field is optional in OCI image indexes.
+		return versioned.Manifests != nil
+	default:
+		return false
+	}
+}
+
+// parsePlatforms parses platform filters in the "os/arch[/variant]" form.
+func parsePlatforms(rawPlatforms []string) ([]*goocispecv1.Platform, error) {
+	platforms := make([]*goocispecv1.Platform, 0)
+	for _, rawPlatform := range rawPlatforms {
+		platform, err := goocispecv1.ParsePlatform(rawPlatform)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, platform)
+	}
+	return platforms, nil
+}
+
+// platformMatches returns whether the platform matches any of the platform filters.
+// Every platform matches when there are no platform filters.
+// A platform filter without a variant matches all variants of its os and architecture.
+func platformMatches(platform *goocispecv1.Platform, platforms []*goocispecv1.Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	if platform == nil {
+		return false
+	}
+
+	for _, p := range platforms {
+		if p.OS != platform.OS || p.Architecture != platform.Architecture {
+			continue
+		}
+		if p.Variant != "" && p.Variant != platform.Variant {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// platformString returns the platform in the "os/arch[/variant]" form.
+func platformString(platform *goocispecv1.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+	return platform.String()
+}
+
+// toOCIPlatform converts a go-containerregistry platform into an OCI image-spec platform.
+func toOCIPlatform(platform *goocispecv1.Platform) *ocispecv1.Platform {
+	if platform == nil {
+		return nil
+	}
+	return &ocispecv1.Platform{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		OSVersion:    platform.OSVersion,
+		OSFeatures:   platform.OSFeatures,
+		Variant:      platform.Variant,
+	}
+}
+
+// platformOutputFile returns the output file of a platform next to the given output file.
+// For example, the output file of "linux/arm64/v8" next to "lpm.json" is "lpm-linux-arm64-v8.json".
+func platformOutputFile(output string, platform *goocispecv1.Platform) string {
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + "-" + strings.ReplaceAll(platformString(platform), "/", "-") + ext
+}
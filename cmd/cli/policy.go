@@ -0,0 +1,357 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/spf13/cobra"
+	"oras.land/oras-go/pkg/content"
+	"sigs.k8s.io/yaml"
+)
+
+func newPolicyCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	cobraCmd := &cobra.Command{
+		Use:   "policy",
+		Short: "evaluate policies against the lpm and eol artifacts of images",
+	}
+
+	cobraCmd.AddCommand(
+		newPolicyCheckCmd(stdin, stdout, stderr, args),
+	)
+
+	return cobraCmd
+}
+
+type policyCheckCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	policyFile      string
+	format          string
+	output          string
+}
+
+func newPolicyCheckCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	policyCheckCmd := &policyCheckCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "check <image-ref>",
+		Short: "check the lpm and eol artifacts attached to an image against a policy, and fail on any violation",
+		Example: `lpm policy check \
+[--username 					username] \
+[--password-stdin] \
+--policy 						policy.yaml \
+[--format 						text|json] \
+[--output 						violations.json] \
+myregistry.myserver.io/myimage:latest (or myimage@digest)
+`,
+		Args: cobra.ExactArgs(1),
+		// Violations are reported as an error, which is not a usage error.
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return policyCheckCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &policyCheckCmd.registryOptions)
+
+	var policyLongFlag = "policy"
+	f.StringVar(&policyCheckCmd.policyFile, policyLongFlag, "", "policy file (YAML or JSON) with the rules to check")
+	cobraCmd.MarkFlagRequired(policyLongFlag)
+
+	f.StringVar(&policyCheckCmd.format, "format", "text", "(optional) output format, either 'text' or 'json'")
+
+	f.StringVarP(&policyCheckCmd.output, "output", "o", "", "(optional) output file to write the violations to (default: stdout)")
+
+	return cobraCmd
+}
+
+// policy is a policy file, in YAML (or JSON). Rules that are not set are not checked. For example:
+//
+//	# The image must have an lpm manifest attached.
+//	requireLpm: true
+//	# No more than 3 non-upstream layers.
+//	maxNonUpstreamLayers: 3
+//	# The base image must be one of these (a repository, a reference with a tag or digest, or a pattern where '*' matches within a path segment).
+//	allowedBaseImages:
+//	  - mcr.microsoft.com/dotnet/runtime
+//	  - mcr.microsoft.com/cbl-mariner/*
+//	# If an end of life date is declared, it must be at least 90 days away.
+//	minEolDays: 90
+//	# Every non-upstream layer must have a Dockerfile command.
+//	requireCommands: true
+type policy struct {
+	RequireLpm           bool     `json:"requireLpm,omitempty"`
+	MaxNonUpstreamLayers *int     `json:"maxNonUpstreamLayers,omitempty"`
+	AllowedBaseImages    []string `json:"allowedBaseImages,omitempty"`
+	MinEolDays           *int     `json:"minEolDays,omitempty"`
+	RequireCommands      bool     `json:"requireCommands,omitempty"`
+}
+
+// policyViolation is a violation of a rule of a policy.
+type policyViolation struct {
+	Rule string `json:"rule"`
+	// Platform is the platform of the subject image that the violation was found in (for a multi-platform subject image).
+	Platform string `json:"platform,omitempty"`
+	Message  string `json:"message"`
+}
+
+// policyCheck is the result of checking an image against a policy.
+type policyCheck struct {
+	Policy string `json:"policy"`
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+	// LpmArtifacts and EolArtifacts are the digests of the lpm and eol artifacts that were checked.
+	LpmArtifacts []string          `json:"lpmArtifacts"`
+	EolArtifacts []string          `json:"eolArtifacts"`
+	Violations   []policyViolation `json:"violations"`
+}
+
+// loadPolicy reads a policy file, rejecting unknown rules.
+func loadPolicy(path string) (*policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p policy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid policy file '%s': %w", path, err)
+	}
+	if p.MaxNonUpstreamLayers != nil && *p.MaxNonUpstreamLayers < 0 {
+		return nil, fmt.Errorf("invalid policy file '%s': maxNonUpstreamLayers must not be negative", path)
+	}
+	if p.MinEolDays != nil && *p.MinEolDays < 0 {
+		return nil, fmt.Errorf("invalid policy file '%s': minEolDays must not be negative", path)
+	}
+	return &p, nil
+}
+
+func (policyCheckCmd *policyCheckCmd) run(imageRef string) error {
+	// Read the registry password from stdin if needed.
+	if err := policyCheckCmd.registryOptions.complete(policyCheckCmd.stdin, registryHost(imageRef)); err != nil {
+		return err
+	}
+
+	if policyCheckCmd.format != "text" && policyCheckCmd.format != "json" {
+		return fmt.Errorf("unsupported output format '%s', expected 'text' or 'json'", policyCheckCmd.format)
+	}
+
+	p, err := loadPolicy(policyCheckCmd.policyFile)
+	if err != nil {
+		return err
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if policyCheckCmd.output == "" {
+		out = policyCheckCmd.stdout
+	} else {
+		f, err := os.Create(policyCheckCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&policyCheckCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	check, err := checkPolicy(ctx, registry, &policyCheckCmd.registryOptions, p, imageRef, time.Now(), policyCheckCmd.stderr)
+	if err != nil {
+		return err
+	}
+	check.Policy = policyCheckCmd.policyFile
+
+	if policyCheckCmd.format == "json" {
+		checkJsonString, err := json.MarshalIndent(check, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(checkJsonString)
+	} else {
+		for _, violation := range check.Violations {
+			if violation.Platform != "" {
+				fmt.Fprintf(out, "[!] %s: platform '%s': %s\n", violation.Rule, violation.Platform, violation.Message)
+			} else {
+				fmt.Fprintf(out, "[!] %s: %s\n", violation.Rule, violation.Message)
+			}
+		}
+		if len(check.Violations) == 0 {
+			fmt.Fprintf(out, "Image '%s' with digest '%s' complies with policy '%s'\n", imageRef, check.Digest, policyCheckCmd.policyFile)
+		}
+	}
+
+	if len(check.Violations) > 0 {
+		return fmt.Errorf("image '%s' violates policy '%s' (%d violations found)", imageRef, policyCheckCmd.policyFile, len(check.Violations))
+	}
+	return nil
+}
+
+// checkPolicy gathers the lpm and eol artifacts attached to an image as referrers, and checks them against the policy's rules.
+// now is the time that end of life dates are compared with.
+// Warnings (such as an image with several lpm artifacts) are written to stderr.
+func checkPolicy(ctx context.Context, registry *content.Registry, registryOptions *registryOptions, p *policy, imageRef string, now time.Time, stderr io.Writer) (*policyCheck, error) {
+	_, imageDesc, err := registry.Resolve(ctx, imageRef)
+	if err != nil {
+		return nil, err
+	}
+	repository, err := repositoryOf(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := newRemoteRepository(ctx, imageRef, registryOptions, false)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &policyCheck{
+		Image:        imageRef,
+		Digest:       imageDesc.Digest.String(),
+		LpmArtifacts: make([]string, 0),
+		EolArtifacts: make([]string, 0),
+		Violations:   make([]policyViolation, 0),
+	}
+	violate := func(rule string, platform string, format string, a ...interface{}) {
+		check.Violations = append(check.Violations, policyViolation{Rule: rule, Platform: platform, Message: fmt.Sprintf(format, a...)})
+	}
+
+	// Check the lpm manifest (or the lpm manifest of each platform of an lpm index).
+	// An image analyzed several times has several lpm artifacts, the most recently created one is checked.
+	lpmDescs, err := remote.referrersOfType(ctx, imageDesc.Digest, mediaTypeForManifestLpm)
+	if err != nil {
+		return nil, err
+	}
+	if len(lpmDescs) > 1 {
+		fmt.Fprintf(stderr, "[!] Warning: image '%s' has %d lpm artifacts, checking the most recently created one ('%s')\n", imageRef, len(lpmDescs), latestReferrer(lpmDescs).Digest)
+	}
+	if len(lpmDescs) == 0 {
+		if p.RequireLpm {
+			violate("requireLpm", "", "no lpm artifact is attached to image '%s@%s'", repository, imageDesc.Digest)
+		}
+	} else {
+		lpmDesc := latestReferrer(lpmDescs)
+		check.LpmArtifacts = append(check.LpmArtifacts, lpmDesc.Digest.String())
+		loaded, _, err := loadLpmManifests(ctx, registry, fmt.Sprintf("%s@%s", repository, lpmDesc.Digest))
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range loaded {
+			checkLpmManifestPolicy(p, l, violate)
+		}
+	}
+
+	// Check the end of life dates of the eol artifacts.
+	declarations, err := fetchEolDeclarations(ctx, registry, remote, repository, imageDesc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	for _, declaration := range declarations {
+		check.EolArtifacts = append(check.EolArtifacts, declaration.Artifact)
+		if p.MinEolDays == nil {
+			continue
+		}
+		date, err := parseEolDate(declaration.Date)
+		if err != nil {
+			violate("minEolDays", "", "eol artifact '%s' has an invalid end of life date '%s'", declaration.Artifact, declaration.Date)
+			continue
+		}
+		if deadline := now.AddDate(0, 0, *p.MinEolDays); date.Before(deadline) {
+			days := int(date.Sub(now).Hours() / 24)
+			if date.Before(now) {
+				violate("minEolDays", "", "end of life date %s (eol artifact '%s') has passed", declaration.Date, declaration.Artifact)
+			} else {
+				violate("minEolDays", "", "end of life date %s (eol artifact '%s') is %d days away, expected at least %d days", declaration.Date, declaration.Artifact, days, *p.MinEolDays)
+			}
+		}
+	}
+
+	return check, nil
+}
+
+// checkLpmManifestPolicy checks an lpm manifest against the policy's rules about the subject image's layers and base image.
+// Layers of unknown ownership (analyzed without a base image) may be non-upstream or come from any base image,
+// so they are checked like non-upstream layers, and fail the rules that need their ownership to be known.
+func checkLpmManifestPolicy(p *policy, l loadedLpmManifest, violate func(rule string, platform string, format string, a ...interface{})) {
+	nonUpstreamLayers, upstreamLayers, unknownLayers := 0, 0, 0
+	for i, layer := range l.manifest.Layers {
+		ownership := layerOwnership(layer.Annotations)
+		switch ownership {
+		case ownershipNonUpstream:
+			nonUpstreamLayers++
+		case ownershipUnknown:
+			unknownLayers++
+		default:
+			upstreamLayers++
+			continue
+		}
+		if p.RequireCommands && layer.Annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] == "" {
+			violate("requireCommands", l.platform, "%s layer %d ('%s') has no Dockerfile command", ownership, i, layer.Annotations[annotationKeyForSubjectDigest])
+		}
+	}
+
+	if p.MaxNonUpstreamLayers != nil {
+		if nonUpstreamLayers > *p.MaxNonUpstreamLayers {
+			violate("maxNonUpstreamLayers", l.platform, "image has %d non-upstream layers, expected at most %d", nonUpstreamLayers, *p.MaxNonUpstreamLayers)
+		} else if nonUpstreamLayers+unknownLayers > *p.MaxNonUpstreamLayers {
+			violate("maxNonUpstreamLayers", l.platform, "image has %d layers of unknown ownership (analyzed without a base image) and %d non-upstream layers, expected at most %d non-upstream layers", unknownLayers, nonUpstreamLayers, *p.MaxNonUpstreamLayers)
+		}
+	}
+
+	if len(p.AllowedBaseImages) > 0 && (upstreamLayers > 0 || unknownLayers > 0) {
+		baseRef := l.manifest.Annotations[annotationKeyForSubjectBaseImageRef]
+		baseDigest := l.manifest.Annotations[annotationKeyForSubjectBaseImageDigest]
+		if baseRef == "" && upstreamLayers > 0 {
+			violate("allowedBaseImages", l.platform, "image has %d upstream layers from an unknown base image", upstreamLayers)
+		} else if baseRef == "" {
+			violate("allowedBaseImages", l.platform, "image has %d layers of unknown ownership (analyzed without a base image), which may come from any base image", unknownLayers)
+		} else if !baseImageAllowed(baseRef, baseDigest, p.AllowedBaseImages) {
+			violate("allowedBaseImages", l.platform, "base image '%s' is not in the allowed base images", baseRef)
+		}
+	}
+}
+
+// baseImageAllowed returns whether a base image (with the digest it was resolved to) matches any of the allowed base images.
+// An allowed base image matches the base image's reference (as written in the Dockerfile, or normalized such as "docker.io/library/python:3.10"),
+// its repository, or its repository with its digest, and may be a pattern where '*' matches any characters within a path segment.
+func baseImageAllowed(baseRef string, baseDigest string, allowedBaseImages []string) bool {
+	candidates := []string{baseRef}
+	if normalizedRef, err := normalizeImageRef(baseRef); err == nil {
+		candidates = append(candidates, normalizedRef)
+		if repository, err := repositoryOf(normalizedRef); err == nil {
+			candidates = append(candidates, repository)
+			if baseDigest != "" {
+				candidates = append(candidates, repository+"@"+baseDigest)
+			}
+		}
+	}
+	for _, allowed := range allowedBaseImages {
+		for _, candidate := range candidates {
+			if matched, _ := path.Match(allowed, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
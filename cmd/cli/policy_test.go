@@ -0,0 +1,168 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBaseImageAllowed(t *testing.T) {
+	baseDigest := "sha256:7173b809ca12ec5dee4506cd86be934c4596dd234ee82c0662eac04a8c2c71dc"
+
+	tests := []struct {
+		name       string
+		baseRef    string
+		baseDigest string
+		allowed    []string
+		want       bool
+	}{
+		{name: "short name matches itself", baseRef: "python:3.10", allowed: []string{"python:3.10"}, want: true},
+		{name: "short name matches normalized reference", baseRef: "python:3.10", allowed: []string{"docker.io/library/python:3.10"}, want: true},
+		{name: "short name matches normalized repository", baseRef: "python:3.10", allowed: []string{"docker.io/library/python"}, want: true},
+		{name: "short name matches repository pattern", baseRef: "python:3.10", allowed: []string{"docker.io/library/*"}, want: true},
+		{name: "short name matches digest pattern", baseRef: "python:3.10", baseDigest: baseDigest, allowed: []string{"docker.io/library/python@sha256:*"}, want: true},
+		{name: "short name without digest does not match digest pattern", baseRef: "python:3.10", allowed: []string{"docker.io/library/python@sha256:*"}, want: false},
+		{name: "short name does not match other repository", baseRef: "python:3.10", allowed: []string{"docker.io/library/golang"}, want: false},
+		{name: "user repository on Docker Hub", baseRef: "bitnami/python:3.10", allowed: []string{"docker.io/bitnami/python"}, want: true},
+		{name: "full name matches repository", baseRef: "mcr.microsoft.com/dotnet/runtime:6.0", allowed: []string{"mcr.microsoft.com/dotnet/runtime"}, want: true},
+		{name: "pattern does not match across path segments", baseRef: "mcr.microsoft.com/cbl-mariner/base/core:2.0", allowed: []string{"mcr.microsoft.com/cbl-mariner/*"}, want: false},
+		{name: "full name matches pattern of each path segment", baseRef: "mcr.microsoft.com/cbl-mariner/base/core:2.0", allowed: []string{"mcr.microsoft.com/cbl-mariner/*/*"}, want: true},
+		{name: "full name matches exact digest", baseRef: "mcr.microsoft.com/dotnet/runtime:6.0", baseDigest: baseDigest, allowed: []string{"mcr.microsoft.com/dotnet/runtime@" + baseDigest}, want: true},
+		{name: "full name does not match other digest", baseRef: "mcr.microsoft.com/dotnet/runtime:6.0", baseDigest: baseDigest, allowed: []string{"mcr.microsoft.com/dotnet/runtime@sha256:0000000000000000000000000000000000000000000000000000000000000000"}, want: false},
+		{name: "digest reference matches repository", baseRef: "python@" + baseDigest, allowed: []string{"docker.io/library/python"}, want: true},
+		{name: "no allowed base images", baseRef: "python:3.10", allowed: []string{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := baseImageAllowed(tt.baseRef, tt.baseDigest, tt.allowed); got != tt.want {
+				t.Errorf("baseImageAllowed(%q, %q, %q) = %v, want %v", tt.baseRef, tt.baseDigest, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLpmManifestPolicy(t *testing.T) {
+	// lpmManifest returns an lpm manifest of layers with the given ownerships (and a command for the non-upstream ones),
+	// analyzed against the given base image.
+	lpmManifest := func(baseRef string, ownerships ...string) loadedLpmManifest {
+		l := loadedLpmManifest{manifest: artifactManifest{Manifest: ocispecv1.Manifest{
+			Annotations: map[string]string{},
+			Layers:      []ocispecv1.Descriptor{},
+		}}}
+		if baseRef != "" {
+			l.manifest.Annotations[annotationKeyForSubjectBaseImageRef] = baseRef
+		}
+		for _, ownership := range ownerships {
+			annotations := map[string]string{annotationKeyForSubjectOwnership: ownership}
+			if ownership == ownershipNonUpstream {
+				annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = "RUN make"
+			}
+			l.manifest.Layers = append(l.manifest.Layers, ocispecv1.Descriptor{Annotations: annotations})
+		}
+		return l
+	}
+	maxOneNonUpstreamLayer := 1
+	p := &policy{
+		MaxNonUpstreamLayers: &maxOneNonUpstreamLayer,
+		AllowedBaseImages:    []string{"docker.io/library/python"},
+		RequireCommands:      true,
+	}
+
+	tests := []struct {
+		name           string
+		l              loadedLpmManifest
+		wantViolations []string
+	}{
+		{
+			name:           "compliant image",
+			l:              lpmManifest("python:3.10", ownershipUpstream, ownershipNonUpstream),
+			wantViolations: []string{},
+		},
+		{
+			name:           "too many non-upstream layers",
+			l:              lpmManifest("python:3.10", ownershipUpstream, ownershipNonUpstream, ownershipNonUpstream),
+			wantViolations: []string{"maxNonUpstreamLayers"},
+		},
+		{
+			name:           "base image not allowed",
+			l:              lpmManifest("golang:1.18", ownershipUpstream, ownershipNonUpstream),
+			wantViolations: []string{"allowedBaseImages"},
+		},
+		{
+			name:           "upstream layers from an unknown base image",
+			l:              lpmManifest("", ownershipUpstream, ownershipNonUpstream),
+			wantViolations: []string{"allowedBaseImages"},
+		},
+		{
+			name: "image analyzed without a base image",
+			// Layers of unknown ownership are not let through as upstream layers.
+			l:              lpmManifest("", ownershipUnknown, ownershipUnknown),
+			wantViolations: []string{"requireCommands", "requireCommands", "maxNonUpstreamLayers", "allowedBaseImages"},
+		},
+		{
+			name:           "single layer of unknown ownership",
+			l:              lpmManifest("", ownershipUnknown),
+			wantViolations: []string{"requireCommands", "allowedBaseImages"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := make([]string, 0)
+			checkLpmManifestPolicy(p, tt.l, func(rule string, platform string, format string, a ...interface{}) {
+				violations = append(violations, rule)
+			})
+			if !reflect.DeepEqual(violations, tt.wantViolations) {
+				t.Errorf("violated rules = %q, want %q", violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestCheckPolicyChecksLatestLpmArtifact(t *testing.T) {
+	ctx := context.Background()
+	_, host := newTestRegistry(t, false)
+	remote, err := newRemoteRepository(ctx, host+"/app:1", &registryOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := newRegistry(&registryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image was analyzed twice, and the lpm artifact of the second analysis is attached first.
+	image := testImageManifest("app", 2)
+	imageDesc := pushTestManifest(t, remote, "1", image)
+	var lpmDigests []string
+	for _, created := range []string{"2023-06-01T10:00:00Z", "2023-01-01T10:00:00Z"} {
+		lpmManifest := testLpmManifest(imageDesc, image)
+		lpmManifest.Annotations = map[string]string{ocispecv1.AnnotationCreated: created}
+		lpmDesc := pushTestManifest(t, remote, "", lpmManifest)
+		// As analyze does, the descriptor added to the referrers tag schema index carries the manifest's annotations.
+		lpmDesc.Annotations = lpmManifest.Annotations
+		if err := remote.attachReferrer(ctx, imageDesc.Digest, lpmDesc); err != nil {
+			t.Fatal(err)
+		}
+		lpmDigests = append(lpmDigests, lpmDesc.Digest.String())
+	}
+
+	var stderr bytes.Buffer
+	check, err := checkPolicy(ctx, registry, &registryOptions{}, &policy{RequireLpm: true}, host+"/app:1", time.Now(), &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lpmDigests[:1]; !reflect.DeepEqual(check.LpmArtifacts, want) {
+		t.Errorf("checked lpm artifacts = %q, want the most recently created one %q", check.LpmArtifacts, want)
+	}
+	if stderr.Len() == 0 {
+		t.Errorf("no warning about the image's several lpm artifacts")
+	}
+}
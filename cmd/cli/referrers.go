@@ -0,0 +1,420 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+	"oras.land/oras-go/pkg/oras"
+	orasregistry "oras.land/oras-go/pkg/registry"
+)
+
+// errManifestNotFound is returned when a manifest does not exist in the repository.
+var errManifestNotFound = errors.New("manifest not found")
+
+// remoteRepository talks to a repository of a registry through the OCI distribution API.
+//
+// It covers the parts of the OCI distribution spec v1.1 that the ORAS registry client does not support,
+// namely the referrers API and the referrers tag schema.
+// See https://github.com/opencontainers/distribution-spec/blob/v1.1.0/spec.md#listing-referrers
+type remoteRepository struct {
+	client     *http.Client
+	scheme     string
+	host       string
+	repository string
+}
+
+// newRemoteRepository creates a client for the repository of ref that authenticates with the registry options' credentials.
+// push tells whether the client needs push access to the repository (and not only pull access).
+func newRemoteRepository(ctx context.Context, ref string, registryOptions *registryOptions, push bool) (*remoteRepository, error) {
+	parsedRef, err := orasregistry.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	config := registryOptions.configFor(parsedRef.Host())
+	nameOptions := make([]name.Option, 0)
+	if config.usePlainHTTP(parsedRef.Host()) {
+		nameOptions = append(nameOptions, name.Insecure)
+	}
+	repository, err := name.NewRepository(parsedRef.Host()+"/"+parsedRef.Repository, nameOptions...)
+	if err != nil {
+		return nil, err
+	}
+	registry := repository.Registry
+
+	authenticator, err := registryOptions.authenticator(registry)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := transport.PullScope
+	if push {
+		scope = transport.PushScope
+	}
+	roundTripper, err := registryOptions.transport(config)
+	if err != nil {
+		return nil, err
+	}
+	t, err := transport.NewWithContext(ctx, registry, authenticator, roundTripper, []string{repository.Scope(scope)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &remoteRepository{
+		client:     &http.Client{Transport: t},
+		scheme:     config.scheme(parsedRef.Host()),
+		host:       parsedRef.Host(),
+		repository: parsedRef.Repository,
+	}, nil
+}
+
+// url returns the URL of a distribution API endpoint of the repository (such as "manifests/latest").
+func (r *remoteRepository) url(endpoint string) string {
+	return fmt.Sprintf("%s://%s/v2/%s/%s", r.scheme, r.host, r.repository, endpoint)
+}
+
+// fetchManifest fetches the manifest (or index) referred to by reference (a tag or a digest).
+// errManifestNotFound is returned when the manifest does not exist.
+func (r *remoteRepository) fetchManifest(ctx context.Context, reference string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url("manifests/"+reference), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join([]string{ocispecv1.MediaTypeImageIndex, ocispecv1.MediaTypeImageManifest}, ", "))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", errManifestNotFound
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, resp.Header.Get("Content-Type"), nil
+}
+
+// pushManifest pushes a manifest (or index) to the repository under reference (a tag or a digest).
+func (r *remoteRepository) pushManifest(ctx context.Context, reference string, mediaType string, manifest []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.url("manifests/"+reference), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return transport.CheckError(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted)
+}
+
+// referrersAPISupported returns whether the registry supports the referrers API.
+// Registries that support the referrers API answer with an (empty) image index even if the subject has no referrers.
+func (r *remoteRepository) referrersAPISupported(ctx context.Context, subject digest.Digest) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url("referrers/"+subject.String()), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, transport.CheckError(resp, http.StatusOK, http.StatusNotFound)
+	}
+}
+
+// referrers lists the manifests that refer to the subject manifest and have the given artifact type (or any artifact type if empty).
+// The referrers API is used when the registry supports it.
+// Otherwise, the referrers are read from the referrers tag schema ("<alg>-<ref>" tag).
+func (r *remoteRepository) referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]artifactDescriptor, error) {
+	supported, err := r.referrersAPISupported(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	descs := make([]artifactDescriptor, 0)
+	if supported {
+		endpoint := r.url("referrers/" + subject.String())
+		if artifactType != "" {
+			endpoint += "?artifactType=" + url.QueryEscape(artifactType)
+		}
+
+		// Follow the "Link" header through all pages of referrers.
+		for endpoint != "" {
+			index, next, err := r.referrersPage(ctx, endpoint)
+			if err != nil {
+				return nil, err
+			}
+			descs = append(descs, index.Manifests...)
+			endpoint = next
+		}
+	} else {
+		index, err := r.referrersTagIndex(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, index.Manifests...)
+	}
+
+	// Registries are not required to filter referrers by artifact type.
+	if artifactType == "" {
+		return descs, nil
+	}
+	filtered := make([]artifactDescriptor, 0)
+	for _, desc := range descs {
+		if desc.ArtifactType == artifactType {
+			filtered = append(filtered, desc)
+		}
+	}
+	return filtered, nil
+}
+
+// referrersOfType lists the referrers of the subject manifest that are lpm artifacts of the given manifest artifact type (such as lpm manifests),
+// including the referrers that registries without the manifest's "artifactType" field report with the artifact type's alias.
+func (r *remoteRepository) referrersOfType(ctx context.Context, subject digest.Digest, artifactType string) ([]artifactDescriptor, error) {
+	descs, err := r.referrers(ctx, subject, "")
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]artifactDescriptor, 0)
+	for _, desc := range descs {
+		if desc.ArtifactType == artifactType || (artifactTypeAliases[artifactType] != "" && desc.ArtifactType == artifactTypeAliases[artifactType]) {
+			filtered = append(filtered, desc)
+		}
+	}
+	return filtered, nil
+}
+
+// latestReferrer returns the most recently created referrer, going by the "org.opencontainers.image.created" annotation
+// that referrers carry from their manifest (the order in which referrers are listed is not defined).
+// Referrers without a valid creation time are older than any referrer with one,
+// and the last one listed is returned among referrers created at the same time.
+func latestReferrer(descs []artifactDescriptor) artifactDescriptor {
+	var latest artifactDescriptor
+	var latestCreated time.Time
+	for _, desc := range descs {
+		created, _ := time.Parse(time.RFC3339, desc.Annotations[ocispecv1.AnnotationCreated])
+		if !created.Before(latestCreated) {
+			latest, latestCreated = desc, created
+		}
+	}
+	return latest
+}
+
+// referrersPage fetches a single page of the referrers API and returns the URL of the next page (if any).
+func (r *remoteRepository) referrersPage(ctx context.Context, endpoint string) (*artifactIndex, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", ocispecv1.MediaTypeImageIndex)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+
+	var index artifactIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, "", err
+	}
+
+	next, err := nextPageURL(resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &index, next, nil
+}
+
+// nextPageURL returns the URL of the next page of a paginated distribution API response (if any),
+// which is given by the response's Link header, such as: Link: </v2/<name>/referrers/<digest>?n=...>; rel="next"
+func nextPageURL(resp *http.Response) (string, error) {
+	link := resp.Header.Get("Link")
+	start, end := strings.Index(link, "<"), strings.Index(link, ">")
+	if start < 0 || end <= start {
+		return "", nil
+	}
+	nextURL, err := resp.Request.URL.Parse(link[start+1 : end])
+	if err != nil {
+		return "", err
+	}
+	return nextURL.String(), nil
+}
+
+// tags lists the tags of the repository.
+func (r *remoteRepository) tags(ctx context.Context) ([]string, error) {
+	tags := make([]string, 0)
+	for endpoint := r.url("tags/list"); endpoint != ""; {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = transport.CheckError(resp, http.StatusOK)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		if err == nil {
+			endpoint, err = nextPageURL(resp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+	}
+	return tags, nil
+}
+
+// referrersTag returns the referrers tag schema tag of the subject digest ("<alg>-<ref>").
+func referrersTag(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Encoded()
+}
+
+// referrersTagIndex fetches the referrers tag schema index of the subject.
+// An empty index is returned when the subject has no referrers yet.
+func (r *remoteRepository) referrersTagIndex(ctx context.Context, subject digest.Digest) (*artifactIndex, error) {
+	index := &artifactIndex{
+		Index: ocispecv1.Index{
+			Versioned: ocispecs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecv1.MediaTypeImageIndex,
+		},
+		Manifests: []artifactDescriptor{},
+	}
+
+	b, _, err := r.fetchManifest(ctx, referrersTag(subject))
+	if err == errManifestNotFound {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// attachReferrer makes a manifest already pushed to the repository discoverable as a referrer of the subject manifest.
+//
+// Registries that support the referrers API index the manifest through its "subject" field when it is pushed,
+// so nothing else needs to be done.
+// On other registries, the manifest is added to the subject's referrers tag schema index.
+func (r *remoteRepository) attachReferrer(ctx context.Context, subject digest.Digest, referrer artifactDescriptor) error {
+	supported, err := r.referrersAPISupported(ctx, subject)
+	if err != nil {
+		return err
+	}
+	if supported {
+		return nil
+	}
+
+	index, err := r.referrersTagIndex(ctx, subject)
+	if err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		if desc.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return r.pushManifest(ctx, referrersTag(subject), ocispecv1.MediaTypeImageIndex, b)
+}
+
+// memoryStoreArtifactName is the name under which a generated artifact's root manifest is stored in an ORAS memory store before being pushed.
+var memoryStoreArtifactName = "artifact"
+
+// referrer is a manifest that refers to a subject manifest through its "subject" field.
+type referrer struct {
+	subject digest.Digest
+	desc    artifactDescriptor
+}
+
+// attachArtifact pushes the artifact stored in the memory store under memoryStoreArtifactName to the subject image's repository,
+// and makes each referrer discoverable from its subject manifest.
+// Progress is written to stderr, as stdout may hold the generated artifact.
+func attachArtifact(ctx context.Context, registry *content.Registry, memoryStore *content.Memory, subjectRef string, registryOptions *registryOptions, referrers []referrer, stderr io.Writer) error {
+	subjectRepository, err := repositoryOf(subjectRef)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "[*] Attaching to subject image '%s' as a referrer...\n", subjectRef)
+
+	// Push the artifact by digest to the subject image's repository.
+	// Referrers must be in the same repository as their subject.
+	desc, err := oras.Copy(ctx, memoryStore, memoryStoreArtifactName, registry, subjectRepository)
+	if err != nil {
+		return err
+	}
+
+	// Make each referrer discoverable from its subject.
+	remote, err := newRemoteRepository(ctx, subjectRef, registryOptions, true)
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		if err := remote.attachReferrer(ctx, r.subject, r.desc); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(stderr, "Attached to subject image '%s' with digest '%s'\n", subjectRef, desc.Digest)
+
+	return nil
+}
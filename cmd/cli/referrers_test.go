@@ -0,0 +1,344 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testRegistry is an in-memory registry that serves the manifest, tag listing and catalog endpoints of the OCI distribution API,
+// and the referrers API if referrersAPI is set (otherwise the referrers endpoint answers 404, as registries without it do).
+// The tags of the denied repositories cannot be listed.
+type testRegistry struct {
+	referrersAPI bool
+	denied       map[string]bool
+
+	lock      sync.Mutex
+	manifests map[string][]byte // by "<repository>@<digest>"
+	tags      map[string]digest.Digest
+}
+
+func newTestRegistry(t *testing.T, referrersAPI bool) (*testRegistry, string) {
+	// Read registry credentials from an empty Docker config.
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	reg := &testRegistry{
+		referrersAPI: referrersAPI,
+		denied:       make(map[string]bool),
+		manifests:    make(map[string][]byte),
+		tags:         make(map[string]digest.Digest),
+	}
+	server := httptest.NewServer(reg)
+	t.Cleanup(server.Close)
+	return reg, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	if r.URL.Path == "/v2/_catalog" {
+		reg.serveCatalog(w)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/tags/list") {
+		reg.serveTags(w, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list"))
+		return
+	}
+	if i := strings.LastIndex(r.URL.Path, "/manifests/"); i >= 0 {
+		reg.serveManifest(w, r, strings.TrimPrefix(r.URL.Path[:i], "/v2/"), r.URL.Path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(r.URL.Path, "/referrers/"); i >= 0 && reg.referrersAPI {
+		reg.serveReferrers(w, r, strings.TrimPrefix(r.URL.Path[:i], "/v2/"), digest.Digest(r.URL.Path[i+len("/referrers/"):]))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (reg *testRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repository string, reference string) {
+	switch r.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d := digest.FromBytes(b)
+		reg.manifests[repository+"@"+d.String()] = b
+		if _, err := digest.Parse(reference); err != nil {
+			reg.tags[repository+":"+reference] = d
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		d, err := digest.Parse(reference)
+		if err != nil {
+			d = reg.tags[repository+":"+reference]
+		}
+		b, ok := reg.manifests[repository+"@"+d.String()]
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(b, &versioned)
+		w.Header().Set("Content-Type", versioned.MediaType)
+		w.Header().Set("Docker-Content-Digest", d.String())
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (reg *testRegistry) serveCatalog(w http.ResponseWriter) {
+	repositories := make([]string, 0)
+	seen := make(map[string]bool)
+	for key := range reg.tags {
+		repository := key[:strings.LastIndex(key, ":")]
+		if !seen[repository] {
+			seen[repository] = true
+			repositories = append(repositories, repository)
+		}
+	}
+	for repository := range reg.denied {
+		if !seen[repository] {
+			seen[repository] = true
+			repositories = append(repositories, repository)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories})
+}
+
+func (reg *testRegistry) serveTags(w http.ResponseWriter, repository string) {
+	if reg.denied[repository] {
+		http.Error(w, `{"errors":[{"code":"DENIED","message":"access to the requested resource is not authorized"}]}`, http.StatusForbidden)
+		return
+	}
+	tags := make([]string, 0)
+	for key := range reg.tags {
+		if strings.HasPrefix(key, repository+":") {
+			tags = append(tags, strings.TrimPrefix(key, repository+":"))
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+}
+
+func (reg *testRegistry) serveReferrers(w http.ResponseWriter, r *http.Request, repository string, subject digest.Digest) {
+	index := artifactIndex{
+		Index:     ocispecv1.Index{Versioned: ocispecs.Versioned{SchemaVersion: 2}, MediaType: ocispecv1.MediaTypeImageIndex},
+		Manifests: []artifactDescriptor{},
+	}
+	for key, b := range reg.manifests {
+		if !strings.HasPrefix(key, repository+"@") {
+			continue
+		}
+		var manifest artifactManifest
+		if err := json.Unmarshal(b, &manifest); err != nil || manifest.Subject == nil || manifest.Subject.Digest != subject {
+			continue
+		}
+		// As the distribution spec says, the artifact type of manifests without one is their config's media type.
+		artifactType := manifest.ArtifactType
+		if artifactType == "" {
+			artifactType = manifest.Config.MediaType
+		}
+		if filter := r.URL.Query().Get("artifactType"); filter != "" && filter != artifactType {
+			continue
+		}
+		index.Manifests = append(index.Manifests, artifactDescriptor{
+			Descriptor:   ocispecv1.Descriptor{MediaType: manifest.MediaType, Digest: digest.FromBytes(b), Size: int64(len(b)), Annotations: manifest.Annotations},
+			ArtifactType: artifactType,
+		})
+	}
+	w.Header().Set("Content-Type", ocispecv1.MediaTypeImageIndex)
+	json.NewEncoder(w).Encode(index)
+}
+
+// pushTestManifest pushes a manifest to the remote repository under reference, and returns its descriptor.
+func pushTestManifest(t *testing.T, remote *remoteRepository, reference string, manifest artifactManifest) artifactDescriptor {
+	t.Helper()
+	manifest.Versioned = ocispecs.Versioned{SchemaVersion: 2}
+	manifest.MediaType = ocispecv1.MediaTypeImageManifest
+	b, desc, err := marshalArtifact(ocispecv1.MediaTypeImageManifest, manifest.ArtifactType, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reference == "" {
+		reference = desc.Digest.String()
+	}
+	if err := remote.pushManifest(context.Background(), reference, ocispecv1.MediaTypeImageManifest, b); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func TestReferrers(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		referrersAPI bool
+	}{
+		{name: "referrers API", referrersAPI: true},
+		{name: "referrers tag schema", referrersAPI: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			reg, host := newTestRegistry(t, tt.referrersAPI)
+			remote, err := newRemoteRepository(ctx, host+"/myimage:1", &registryOptions{}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			subject := pushTestManifest(t, remote, "1", artifactManifest{Manifest: ocispecv1.Manifest{
+				Config: ocispecv1.Descriptor{MediaType: ocispecv1.MediaTypeImageConfig, Digest: digest.FromString("config"), Size: 6},
+				Layers: []ocispecv1.Descriptor{},
+			}})
+
+			supported, err := remote.referrersAPISupported(ctx, subject.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if supported != tt.referrersAPI {
+				t.Fatalf("referrersAPISupported() = %v, want %v", supported, tt.referrersAPI)
+			}
+
+			descs, err := remote.referrers(ctx, subject.Digest, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(descs) != 0 {
+				t.Fatalf("referrers() of a subject without referrers = %d referrers, want 0", len(descs))
+			}
+
+			// An lpm manifest with an artifact type, and an eol artifact without one (the artifact type is then its config's media type).
+			subjectDesc := subject.Descriptor
+			lpm := pushTestManifest(t, remote, "", artifactManifest{
+				Manifest: ocispecv1.Manifest{
+					Config: ocispecv1.Descriptor{MediaType: mediaTypeForConfigLpm, Digest: digest.FromString("{}"), Size: 2},
+					Layers: []ocispecv1.Descriptor{},
+				},
+				ArtifactType: mediaTypeForManifestLpm,
+				Subject:      &subjectDesc,
+			})
+			eol := pushTestManifest(t, remote, "", artifactManifest{
+				Manifest: ocispecv1.Manifest{
+					Config: ocispecv1.Descriptor{MediaType: mediaTypeForConfigEol, Digest: digest.FromString("{}"), Size: 2},
+					Layers: []ocispecv1.Descriptor{},
+				},
+				Subject: &subjectDesc,
+			})
+			eol.ArtifactType = mediaTypeForConfigEol
+
+			// Attaching a referrer twice lists it once.
+			for _, referrer := range []artifactDescriptor{lpm, eol, lpm} {
+				if err := remote.attachReferrer(ctx, subject.Digest, referrer); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The referrers tag schema index is only pushed to registries without the referrers API.
+			_, hasTagIndex := reg.tags["myimage:"+referrersTag(subject.Digest)]
+			if hasTagIndex == tt.referrersAPI {
+				t.Errorf("referrers tag schema index pushed = %v, want %v", hasTagIndex, !tt.referrersAPI)
+			}
+
+			descs, err = remote.referrers(ctx, subject.Digest, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(descs) != 2 {
+				t.Fatalf("referrers() = %d referrers, want 2", len(descs))
+			}
+
+			descs, err = remote.referrers(ctx, subject.Digest, mediaTypeForManifestLpm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(descs) != 1 || descs[0].Digest != lpm.Digest {
+				t.Errorf("referrers() of type lpm = %v, want only '%s'", descs, lpm.Digest)
+			}
+
+			for _, want := range []struct {
+				artifactType string
+				digest       digest.Digest
+			}{
+				{artifactType: mediaTypeForManifestLpm, digest: lpm.Digest},
+				{artifactType: mediaTypeForManifestEol, digest: eol.Digest},
+			} {
+				descs, err := remote.referrersOfType(ctx, subject.Digest, want.artifactType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(descs) != 1 || descs[0].Digest != want.digest {
+					t.Errorf("referrersOfType(%s) = %v, want only '%s'", want.artifactType, descs, want.digest)
+				}
+			}
+		})
+	}
+}
+
+func TestLatestReferrer(t *testing.T) {
+	// referrer returns the descriptor of a referrer named name, created at the given time (if any).
+	referrer := func(name string, created string) artifactDescriptor {
+		desc := artifactDescriptor{Descriptor: ocispecv1.Descriptor{Digest: digest.FromString(name)}}
+		if created != "" {
+			desc.Annotations = map[string]string{ocispecv1.AnnotationCreated: created}
+		}
+		return desc
+	}
+
+	tests := []struct {
+		name  string
+		descs []artifactDescriptor
+		want  string
+	}{
+		{
+			name:  "listed from the newest",
+			descs: []artifactDescriptor{referrer("new", "2023-06-01T10:00:00Z"), referrer("old", "2023-01-01T10:00:00Z")},
+			want:  "new",
+		},
+		{
+			name:  "listed from the oldest",
+			descs: []artifactDescriptor{referrer("old", "2023-01-01T10:00:00Z"), referrer("new", "2023-06-01T10:00:00Z")},
+			want:  "new",
+		},
+		{
+			name:  "time zones",
+			descs: []artifactDescriptor{referrer("new", "2023-01-01T10:00:00-05:00"), referrer("old", "2023-01-01T12:00:00Z")},
+			want:  "new",
+		},
+		{
+			name:  "without creation time",
+			descs: []artifactDescriptor{referrer("created", "2023-01-01T10:00:00Z"), referrer("unknown", ""), referrer("invalid", "yesterday")},
+			want:  "created",
+		},
+		{
+			name:  "same creation time",
+			descs: []artifactDescriptor{referrer("first", ""), referrer("last", "")},
+			want:  "last",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := latestReferrer(tt.descs); got.Digest != digest.FromString(tt.want) {
+				t.Errorf("latestReferrer() = '%s', want referrer %q", got.Digest, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/containerd/containerd/remotes/docker"
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	digest "github.com/opencontainers/go-digest"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+	orasregistry "oras.land/oras-go/pkg/registry"
+)
+
+// newRegistry creates an ORAS registry store that authenticates with the registry options' credentials.
+// Without credentials, the ORAS registry store reads them from the Docker config file (or accesses registries anonymously).
+// Each registry is connected to as its per-registry config (and the command line flags) tells,
+// over plain HTTP or over HTTPS with the given CA certificates and client certificate.
+func newRegistry(registryOptions *registryOptions) (*content.Registry, error) {
+	hosts := func(host string) ([]docker.RegistryHost, error) {
+		config := registryOptions.configFor(host)
+		transport, err := registryOptions.transport(config)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Transport: transport}
+
+		plainHTTP := func(host string) (bool, error) {
+			return config.usePlainHTTP(host), nil
+		}
+
+		return docker.ConfigureDefaultRegistries(
+			docker.WithClient(client),
+			docker.WithAuthorizer(docker.NewDockerAuthorizer(docker.WithAuthClient(client), docker.WithAuthCreds(registryOptions.credential))),
+			docker.WithPlainHTTP(plainHTTP),
+		)(host)
+	}
+
+	return &content.Registry{Resolver: docker.NewResolver(docker.ResolverOptions{Hosts: hosts})}, nil
+}
+
+// fetchContent fetches the content (manifest or blob) described by desc from the repository of ref,
+// and verifies that the fetched content matches the descriptor's digest.
+func fetchContent(ctx context.Context, registry *content.Registry, ref string, desc ocispecv1.Descriptor) ([]byte, error) {
+	fetcher, err := registry.Fetcher(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if desc.Digest != "" && digest.FromBytes(b) != desc.Digest {
+		return nil, fmt.Errorf("content fetched from '%s' does not match digest '%s'", ref, desc.Digest)
+	}
+
+	return b, nil
+}
+
+// toOCIDescriptor converts a go-containerregistry descriptor into an OCI image-spec descriptor.
+func toOCIDescriptor(desc goocispecv1.Descriptor) ocispecv1.Descriptor {
+	return ocispecv1.Descriptor{
+		MediaType:   string(desc.MediaType),
+		Digest:      digest.Digest(desc.Digest.String()),
+		Size:        desc.Size,
+		URLs:        desc.URLs,
+		Annotations: desc.Annotations,
+	}
+}
+
+// fetchManifest resolves ref in the registry and fetches the manifest that it refers to.
+// The returned descriptor describes the fetched manifest as served by the registry.
+func fetchManifest(ctx context.Context, registry *content.Registry, ref string) ([]byte, ocispecv1.Descriptor, error) {
+	_, desc, err := registry.Resolve(ctx, ref)
+	if err != nil {
+		return nil, ocispecv1.Descriptor{}, err
+	}
+
+	b, err := fetchContent(ctx, registry, ref, desc)
+	if err != nil {
+		return nil, ocispecv1.Descriptor{}, err
+	}
+
+	return b, desc, nil
+}
+
+// repositoryOf returns the repository (registry host and repository name) of ref, without its tag or digest.
+func repositoryOf(ref string) (string, error) {
+	parsedRef, err := orasregistry.ParseReference(ref)
+	if err != nil {
+		return "", err
+	}
+	return parsedRef.Registry + "/" + parsedRef.Repository, nil
+}
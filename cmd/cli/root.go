@@ -23,7 +23,19 @@ func newRootCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []stri
 
 	cobraCmd.AddCommand(
 		newAnalyzeCmd(stdin, stdout, stderr, args),
+		newAuditCmd(stdin, stdout, stderr, args),
 		newConfigAnnotateCmd(stdin, stdout, stderr, args),
+		newDiscoverCmd(stdin, stdout, stderr, args),
+		newEolCmd(stdin, stdout, stderr, args),
+		newExportCmd(stdin, stdout, stderr, args),
+		newInspectCmd(stdin, stdout, stderr, args),
+		newPolicyCmd(stdin, stdout, stderr, args),
+		newSbomSplitCmd(stdin, stdout, stderr, args),
+		newSignCmd(stdin, stdout, stderr, args),
+		newTriageCmd(stdin, stdout, stderr, args),
+		newVerifyCmd(stdin, stdout, stderr, args),
+		newLoginCmd(stdin, stdout, stderr, args),
+		newLogoutCmd(stdin, stdout, stderr, args),
 	)
 
 	_ = flags.Parse(args)
@@ -0,0 +1,308 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+type sbomSplitCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	sbomFile        string
+	lpmRefOrFile    string
+	platform        string
+	outputDir       string
+	output          string
+}
+
+func newSbomSplitCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	sbomSplitCmd := &sbomSplitCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "sbom-split",
+		Short: "annotate the packages of a Syft SBOM with the ownership and Dockerfile command of their layers, or split the SBOM into an SBOM per ownership",
+		Example: `lpm sbom-split \
+[--username 					username] \
+[--password-stdin] \
+--sbom 							syft.json \
+--lpm 							myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest, or lpm.json) \
+[--platform 					linux/amd64] \
+[--output-dir 					sboms/ (writes sboms/upstream.syft.json and sboms/non-upstream.syft.json)] \
+[--output 						syft-lpm.json]
+`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return sbomSplitCmd.run()
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &sbomSplitCmd.registryOptions)
+
+	var sbomLongFlag = "sbom"
+	f.StringVar(&sbomSplitCmd.sbomFile, sbomLongFlag, "", "SBOM of the subject image in Syft JSON format ('syft -o syft-json')")
+	cobraCmd.MarkFlagRequired(sbomLongFlag)
+
+	var lpmLongFlag = "lpm"
+	f.StringVar(&sbomSplitCmd.lpmRefOrFile, lpmLongFlag, "", "lpm manifest (or lpm index) artifact ref, or lpm manifest file, of the subject image")
+	cobraCmd.MarkFlagRequired(lpmLongFlag)
+
+	f.StringVar(&sbomSplitCmd.platform, "platform", "", "(optional) platform (os/arch[/variant]) of the subject image of the SBOM, for an lpm index (default: the platform whose config matches the SBOM)")
+
+	f.StringVar(&sbomSplitCmd.outputDir, "output-dir", "", "(optional) directory to write an SBOM per ownership to, named '<ownership>.syft.json' (default: write a single annotated SBOM)")
+
+	f.StringVarP(&sbomSplitCmd.output, "output", "o", "", "(optional) output file to write the single annotated SBOM to (default: stdout)")
+
+	return cobraCmd
+}
+
+// syftDocument is a Syft JSON SBOM.
+// The SBOM is kept as decoded JSON (rather than decoded into structs) so that the fields lpm does not read are written back unchanged.
+type syftDocument map[string]interface{}
+
+// syftPackage is a package (a Syft "artifact") of a Syft SBOM, with the layer that lpm attributes it to.
+type syftPackage struct {
+	artifact  map[string]interface{}
+	ownership string
+}
+
+func (sbomSplitCmd *sbomSplitCmd) run() error {
+	if sbomSplitCmd.output != "" && sbomSplitCmd.outputDir != "" {
+		return fmt.Errorf("--output and --output-dir are mutually exclusive")
+	}
+
+	// Read the registry password from stdin if needed.
+	if err := sbomSplitCmd.registryOptions.complete(sbomSplitCmd.stdin, registryHost(sbomSplitCmd.lpmRefOrFile)); err != nil {
+		return err
+	}
+
+	sbom, err := loadSyftDocument(sbomSplitCmd.sbomFile)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&sbomSplitCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	// Load the lpm manifest (or the lpm manifest of each platform of an lpm index), and select the lpm manifest of the SBOM's subject image.
+	loaded, _, err := loadLpmManifests(ctx, registry, sbomSplitCmd.lpmRefOrFile)
+	if err != nil {
+		return err
+	}
+	imageID, diffIDs := sbom.imageIDAndDiffIDs()
+	l, err := selectLpmManifest(loaded, sbomSplitCmd.platform, imageID, nil)
+	if err != nil {
+		return err
+	}
+
+	packages, unattributed := sbom.annotatePackages(l.manifest, diffIDs)
+	if unattributed > 0 {
+		fmt.Fprintf(sbomSplitCmd.stderr, "[!] Warning: %d packages are in layers that are not in the lpm manifest, is it the lpm manifest of the SBOM's subject image?\n", unattributed)
+	}
+
+	// Write the single annotated SBOM.
+	if sbomSplitCmd.outputDir == "" {
+		var out io.Writer
+		if sbomSplitCmd.output == "" {
+			out = sbomSplitCmd.stdout
+		} else {
+			f, err := os.Create(sbomSplitCmd.output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		sbomJsonString, err := json.MarshalIndent(sbom, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(sbomJsonString)
+		return nil
+	}
+
+	// Write an SBOM per ownership.
+	if err := os.MkdirAll(sbomSplitCmd.outputDir, 0755); err != nil {
+		return err
+	}
+	for _, ownership := range []string{ownershipUpstream, ownershipNonUpstream, ownershipUnknown, ownershipUnattributed} {
+		owned := make([]interface{}, 0)
+		for _, p := range packages {
+			if p.ownership == ownership {
+				owned = append(owned, p.artifact)
+			}
+		}
+		if len(owned) == 0 && (ownership == ownershipUnknown || ownership == ownershipUnattributed) {
+			continue
+		}
+
+		path := filepath.Join(sbomSplitCmd.outputDir, ownership+".syft.json")
+		sbomJsonString, err := json.MarshalIndent(sbom.withPackages(owned), "", "	")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, sbomJsonString, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(sbomSplitCmd.stderr, "[*] Wrote %d %s packages to '%s'\n", len(owned), ownership, path)
+	}
+
+	return nil
+}
+
+// loadSyftDocument reads a Syft JSON SBOM.
+func loadSyftDocument(path string) (syftDocument, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Numbers are decoded as json.Number so that they are written back unchanged.
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var sbom syftDocument
+	if err := decoder.Decode(&sbom); err != nil {
+		return nil, fmt.Errorf("invalid SBOM '%s': %w", path, err)
+	}
+	if _, ok := sbom["artifacts"].([]interface{}); !ok {
+		return nil, fmt.Errorf("unsupported SBOM '%s', expected a Syft JSON SBOM with an 'artifacts' list", path)
+	}
+	return sbom, nil
+}
+
+// imageIDAndDiffIDs returns the config digest and the layer DiffIDs (from the bottom layer to the top layer) of the SBOM's subject image.
+func (sbom syftDocument) imageIDAndDiffIDs() (string, []string) {
+	source, _ := sbom["source"].(map[string]interface{})
+	target, _ := source["target"].(map[string]interface{})
+	imageID, _ := target["imageID"].(string)
+	diffIDs := make([]string, 0)
+	layers, _ := target["layers"].([]interface{})
+	for _, layer := range layers {
+		layer, _ := layer.(map[string]interface{})
+		diffID, _ := layer["digest"].(string)
+		diffIDs = append(diffIDs, diffID)
+	}
+	return imageID, diffIDs
+}
+
+// annotatePackages attributes each package of the SBOM to a layer of an lpm manifest's subject image,
+// and returns the packages with their ownership, and the number of packages that could not be attributed to a layer.
+//
+// Syft records the DiffID of the layer of each location that a package was found at.
+// Each location is annotated with the ownership and the Dockerfile command of its layer (using the lpm annotation keys),
+// and the package is attributed to the layer of its primary location (the first location if Syft does not tell which is primary).
+func (sbom syftDocument) annotatePackages(lpmManifest artifactManifest, diffIDs []string) ([]syftPackage, int) {
+	indexes := lpmLayerIndexesByDiffID(lpmManifest, diffIDs)
+
+	packages := make([]syftPackage, 0)
+	unattributed := 0
+	artifacts, _ := sbom["artifacts"].([]interface{})
+	for _, artifact := range artifacts {
+		artifact, ok := artifact.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := syftPackage{artifact: artifact, ownership: ownershipUnattributed}
+
+		locations, _ := artifact["locations"].([]interface{})
+		primaryOwnership, firstOwnership := "", ""
+		for _, location := range locations {
+			location, ok := location.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			layerID, _ := location["layerID"].(string)
+			i, ok := indexes[layerID]
+			if !ok {
+				continue
+			}
+
+			layerAnnotations := lpmManifest.Layers[i].Annotations
+			annotations, _ := location["annotations"].(map[string]interface{})
+			if annotations == nil {
+				annotations = make(map[string]interface{})
+				location["annotations"] = annotations
+			}
+			annotations[annotationKeyForSubjectOwnership] = layerOwnership(layerAnnotations)
+			if command := layerCommand(layerAnnotations); command != "" {
+				annotations[annotationKeyForSubjectOriginalDockerfileFullCommand] = command
+			}
+
+			if firstOwnership == "" {
+				firstOwnership = layerOwnership(layerAnnotations)
+			}
+			if primaryOwnership == "" && annotations["evidence"] == "primary" {
+				primaryOwnership = layerOwnership(layerAnnotations)
+			}
+		}
+
+		switch {
+		case primaryOwnership != "":
+			p.ownership = primaryOwnership
+		case firstOwnership != "":
+			p.ownership = firstOwnership
+		default:
+			unattributed++
+		}
+		packages = append(packages, p)
+	}
+
+	return packages, unattributed
+}
+
+// withPackages returns a copy of the SBOM with only the given packages (Syft artifacts),
+// and without the relationships of the packages that are left out.
+func (sbom syftDocument) withPackages(artifacts []interface{}) syftDocument {
+	kept := make(map[interface{}]bool)
+	for _, artifact := range artifacts {
+		if artifact, ok := artifact.(map[string]interface{}); ok {
+			kept[artifact["id"]] = true
+		}
+	}
+	left := make(map[interface{}]bool)
+	all, _ := sbom["artifacts"].([]interface{})
+	for _, artifact := range all {
+		if artifact, ok := artifact.(map[string]interface{}); ok && !kept[artifact["id"]] {
+			left[artifact["id"]] = true
+		}
+	}
+
+	relationships := make([]interface{}, 0)
+	all, _ = sbom["artifactRelationships"].([]interface{})
+	for _, relationship := range all {
+		if relationship, ok := relationship.(map[string]interface{}); ok && (left[relationship["parent"]] || left[relationship["child"]]) {
+			continue
+		}
+		relationships = append(relationships, relationship)
+	}
+
+	split := make(syftDocument)
+	for key, value := range sbom {
+		split[key] = value
+	}
+	split["artifacts"] = artifacts
+	split["artifactRelationships"] = relationships
+	return split
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSyftDocumentAnnotatePackages(t *testing.T) {
+	lpmManifest := loadTestLpmManifest(t)
+
+	tests := []struct {
+		name    string
+		diffIDs func(diffIDs []string) []string
+		// wantOwnerships are the ownerships of the packages by name.
+		wantOwnerships   map[string]string
+		wantUnattributed int
+	}{
+		{
+			name: "SBOM of the lpm manifest's subject image",
+			wantOwnerships: map[string]string{
+				// Found in an upstream layer.
+				"openssl": ownershipUpstream,
+				// Found in an upstream and a non-upstream layer, attributed to the layer of its primary location.
+				"flask": ownershipNonUpstream,
+				// Found in a non-upstream and an upstream layer without a primary location, attributed to the layer of its first location.
+				"jinja2": ownershipNonUpstream,
+				// Found in a layer that is not in the lpm manifest.
+				"vendored": ownershipUnattributed,
+			},
+			wantUnattributed: 1,
+		},
+		{
+			name: "SBOM of an image with other layers",
+			// DiffIDs cannot be matched by position when the SBOM's image has another number of layers.
+			diffIDs: func(diffIDs []string) []string { return diffIDs[:4] },
+			wantOwnerships: map[string]string{
+				"openssl":  ownershipUnattributed,
+				"flask":    ownershipUnattributed,
+				"jinja2":   ownershipUnattributed,
+				"vendored": ownershipUnattributed,
+			},
+			wantUnattributed: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sbom, err := loadSyftDocument(filepath.Join("testdata", "syft.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			imageID, diffIDs := sbom.imageIDAndDiffIDs()
+			if want := "sha256:9999999999999999999999999999999999999999999999999999999999999999"; imageID != want {
+				t.Errorf("imageID = %q, want %q", imageID, want)
+			}
+			if len(diffIDs) != len(lpmManifest.Layers) {
+				t.Fatalf("%d DiffIDs, want %d", len(diffIDs), len(lpmManifest.Layers))
+			}
+			if tt.diffIDs != nil {
+				diffIDs = tt.diffIDs(diffIDs)
+			}
+
+			packages, unattributed := sbom.annotatePackages(lpmManifest, diffIDs)
+			if unattributed != tt.wantUnattributed {
+				t.Errorf("unattributed = %d, want %d", unattributed, tt.wantUnattributed)
+			}
+			ownerships := make(map[string]string)
+			for _, p := range packages {
+				ownerships[p.artifact["name"].(string)] = p.ownership
+			}
+			if !reflect.DeepEqual(ownerships, tt.wantOwnerships) {
+				t.Errorf("ownerships = %v, want %v", ownerships, tt.wantOwnerships)
+			}
+		})
+	}
+}
+
+func TestSyftDocumentAnnotatePackagesLocations(t *testing.T) {
+	lpmManifest := loadTestLpmManifest(t)
+	sbom, err := loadSyftDocument(filepath.Join("testdata", "syft.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, diffIDs := sbom.imageIDAndDiffIDs()
+	sbom.annotatePackages(lpmManifest, diffIDs)
+
+	// Each location of flask is annotated with the ownership and the command of its own layer, keeping Syft's annotations.
+	flask := sbom["artifacts"].([]interface{})[1].(map[string]interface{})
+	locations := flask["locations"].([]interface{})
+	want := []map[string]interface{}{
+		{
+			"evidence":                       "supporting",
+			annotationKeyForSubjectOwnership: ownershipUpstream,
+			annotationKeyForSubjectOriginalDockerfileFullCommand: "ADD rootfs.tar.xz /",
+		},
+		{
+			"evidence":                       "primary",
+			annotationKeyForSubjectOwnership: ownershipNonUpstream,
+			annotationKeyForSubjectOriginalDockerfileFullCommand: "RUN pip install -r requirements.txt",
+		},
+	}
+	for i := range want {
+		annotations := locations[i].(map[string]interface{})["annotations"]
+		if !reflect.DeepEqual(annotations, want[i]) {
+			t.Errorf("annotations of location %d = %v, want %v", i, annotations, want[i])
+		}
+	}
+
+	// Locations in layers that are not in the lpm manifest are left as they are.
+	vendored := sbom["artifacts"].([]interface{})[3].(map[string]interface{})
+	annotations := vendored["locations"].([]interface{})[0].(map[string]interface{})["annotations"]
+	if want := map[string]interface{}{"evidence": "primary"}; !reflect.DeepEqual(annotations, want) {
+		t.Errorf("annotations of unattributed location = %v, want %v", annotations, want)
+	}
+}
+
+func TestSyftDocumentWithPackages(t *testing.T) {
+	sbom, err := loadSyftDocument(filepath.Join("testdata", "syft.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts := sbom["artifacts"].([]interface{})
+
+	// Only the relationships between the kept packages are kept.
+	split := sbom.withPackages([]interface{}{artifacts[1], artifacts[2]})
+	if len(split["artifacts"].([]interface{})) != 2 {
+		t.Errorf("split SBOM has %d packages, want 2", len(split["artifacts"].([]interface{})))
+	}
+	relationships := split["artifactRelationships"].([]interface{})
+	if len(relationships) != 1 || relationships[0].(map[string]interface{})["parent"] != "flask-id" {
+		t.Errorf("split SBOM relationships = %v, want only the flask to jinja2 relationship", relationships)
+	}
+
+	// The SBOM itself is left unchanged.
+	if len(sbom["artifacts"].([]interface{})) != 4 || len(sbom["artifactRelationships"].([]interface{})) != 2 {
+		t.Errorf("withPackages() changed the SBOM")
+	}
+}
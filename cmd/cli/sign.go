@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+type signCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	key             string
+}
+
+func newSignCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	signCmd := &signCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "sign <lpm-manifest-artifact-ref>",
+		Short: "sign an lpm manifest (or lpm index, or eol artifact) with a local key, and attach the cosign signature to it as a referrer",
+		Example: `lpm sign \
+[--username 					username] \
+[--password-stdin] \
+--key 							lpm-signing-key.pem \
+myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest)
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return signCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &signCmd.registryOptions)
+
+	var keyLongFlag = "key"
+	f.StringVar(&signCmd.key, keyLongFlag, "", "PEM private key file (ECDSA, RSA or Ed25519) to sign with")
+	cobraCmd.MarkFlagRequired(keyLongFlag)
+
+	return cobraCmd
+}
+
+func (signCmd *signCmd) run(ref string) error {
+	// Read the registry password from stdin if needed.
+	if err := signCmd.registryOptions.complete(signCmd.stdin, registryHost(ref)); err != nil {
+		return err
+	}
+
+	key, err := loadSigningKey(signCmd.key)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&signCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	// Only sign the artifacts made by lpm.
+	b, desc, err := fetchManifest(ctx, registry, ref)
+	if err != nil {
+		return err
+	}
+	var artifactType string
+	if isImageIndex(b) {
+		var index artifactIndex
+		if err := json.Unmarshal(b, &index); err != nil {
+			return err
+		}
+		artifactType = index.ArtifactType
+	} else {
+		var manifest artifactManifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return err
+		}
+		artifactType = artifactTypeOf(manifest)
+	}
+	if !isLpmArtifactType(artifactType) {
+		return fmt.Errorf("'%s' is not an lpm or eol artifact (artifact type '%s')", ref, artifactType)
+	}
+
+	return pushSignature(ctx, registry, ref, &signCmd.registryOptions, desc, key, signCmd.stderr)
+}
@@ -0,0 +1,375 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+	"oras.land/oras-go/pkg/oras"
+)
+
+// lpm signs lpm manifests (and lpm indexes) with cosign signatures made with local keys.
+//
+// The signature is stored as a referrer of the signed manifest, in the same repository,
+// the way "cosign sign --registry-referrers-mode=oci-1-1" stores it:
+// an OCI image manifest of artifact type artifactTypeForCosignSignature with an empty config,
+// whose single layer is the signed payload (a cosign "simple signing" payload naming the signed manifest's digest)
+// annotated with the base64-encoded signature of the payload.
+// See https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md
+
+// signingKey is a local private key to sign with.
+type signingKey struct {
+	path   string
+	signer crypto.Signer
+}
+
+// trustedKey is a local public key (or the public key of a certificate) that signatures are verified against.
+type trustedKey struct {
+	path      string
+	publicKey crypto.PublicKey
+}
+
+// simpleSigningPayload is the payload of a cosign signature.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// loadSigningKey reads a PEM private key (PKCS #8, or SEC 1 EC, or PKCS #1 RSA) from a file.
+// ECDSA, RSA and Ed25519 keys are supported.
+func loadSigningKey(path string) (*signingKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found in '%s'", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("encrypted private key '%s' is not supported, use an unencrypted PEM private key", path)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block '%s' in '%s', expected a private key", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key '%s': %w", path, err)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey, ed25519.PrivateKey:
+		return &signingKey{path: path, signer: key.(crypto.Signer)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T in '%s', expected an ECDSA, RSA or Ed25519 key", key, path)
+	}
+}
+
+// sign signs a payload: the SHA-256 digest of the payload for ECDSA (ASN.1 signature) and RSA (PKCS #1 v1.5 signature) keys,
+// and the payload itself for Ed25519 keys, as cosign does.
+func (key *signingKey) sign(payload []byte) ([]byte, error) {
+	if ed25519Key, ok := key.signer.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(ed25519Key, payload), nil
+	}
+	h := sha256.Sum256(payload)
+	return key.signer.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+// loadTrustedKeys reads the trusted keys from PEM files of public keys or certificates.
+// A directory is read as all the files in it.
+// Each file may hold several keys or certificates.
+func loadTrustedKeys(paths []string) ([]trustedKey, error) {
+	files := make([]string, 0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	keys := make([]trustedKey, 0)
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+			var publicKey crypto.PublicKey
+			switch block.Type {
+			case "PUBLIC KEY":
+				publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				cert, err = x509.ParseCertificate(block.Bytes)
+				if err == nil {
+					publicKey = cert.PublicKey
+				}
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted key '%s': %w", file, err)
+			}
+			keys = append(keys, trustedKey{path: file, publicKey: publicKey})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM public key or certificate found in '%s'", strings.Join(paths, "', '"))
+	}
+	return keys, nil
+}
+
+// verify verifies the signature of a payload made by signingKey.sign.
+func (key trustedKey) verify(payload []byte, signature []byte) bool {
+	h := sha256.Sum256(payload)
+	switch publicKey := key.publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(publicKey, h[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, h[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(publicKey, payload, signature)
+	default:
+		return false
+	}
+}
+
+// newSignatureArtifact signs a manifest in a repository,
+// and returns a memory store holding the signature manifest (under memoryStoreArtifactName), its empty config and its payload.
+func newSignatureArtifact(repository string, signed ocispecv1.Descriptor, key *signingKey) (*content.Memory, artifactDescriptor, error) {
+	var payload simpleSigningPayload
+	payload.Critical.Identity.DockerReference = repository
+	payload.Critical.Image.DockerManifestDigest = signed.Digest.String()
+	payload.Critical.Type = cosignSimpleSigningType
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, artifactDescriptor{}, err
+	}
+	signature, err := key.sign(payloadBytes)
+	if err != nil {
+		return nil, artifactDescriptor{}, err
+	}
+
+	config := []byte("{}")
+	configDesc := ocispecv1.Descriptor{
+		MediaType: mediaTypeForEmptyConfig,
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	payloadDesc := ocispecv1.Descriptor{
+		MediaType: mediaTypeForCosignSimpleSigning,
+		Digest:    digest.FromBytes(payloadBytes),
+		Size:      int64(len(payloadBytes)),
+		Annotations: map[string]string{
+			annotationKeyForCosignSignature: base64.StdEncoding.EncodeToString(signature),
+		},
+	}
+	subject := ocispecv1.Descriptor{MediaType: signed.MediaType, Digest: signed.Digest, Size: signed.Size}
+	manifest, manifestDesc, err := marshalArtifact(ocispecv1.MediaTypeImageManifest, artifactTypeForCosignSignature, artifactManifest{
+		Manifest: ocispecv1.Manifest{
+			Versioned: ocispecs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecv1.MediaTypeImageManifest,
+			Config:    configDesc,
+			Layers:    []ocispecv1.Descriptor{payloadDesc},
+		},
+		ArtifactType: artifactTypeForCosignSignature,
+		Subject:      &subject,
+	})
+	if err != nil {
+		return nil, artifactDescriptor{}, err
+	}
+
+	memoryStore := content.NewMemory()
+	memoryStore.Set(configDesc, config)
+	memoryStore.Set(payloadDesc, payloadBytes)
+	if err := memoryStore.StoreManifest(memoryStoreArtifactName, manifestDesc.Descriptor, manifest); err != nil {
+		return nil, artifactDescriptor{}, err
+	}
+	return memoryStore, manifestDesc, nil
+}
+
+// pushSignature signs a manifest already pushed to a registry,
+// and pushes the signature to the manifest's repository as a referrer of the manifest.
+// ref is a reference to the signed manifest (or to its repository).
+func pushSignature(ctx context.Context, registry *content.Registry, ref string, registryOptions *registryOptions, signed ocispecv1.Descriptor, key *signingKey, stderr io.Writer) error {
+	repository, err := repositoryOf(ref)
+	if err != nil {
+		return err
+	}
+	memoryStore, signatureDesc, err := newSignatureArtifact(repository, signed, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "[*] Signing '%s@%s' with key '%s'...\n", repository, signed.Digest, key.path)
+
+	if _, err := oras.Copy(ctx, memoryStore, memoryStoreArtifactName, registry, repository); err != nil {
+		return err
+	}
+	remote, err := newRemoteRepository(ctx, ref, registryOptions, true)
+	if err != nil {
+		return err
+	}
+	if err := remote.attachReferrer(ctx, signed.Digest, signatureDesc); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "Signed '%s@%s' with signature '%s'\n", repository, signed.Digest, signatureDesc.Digest)
+	return nil
+}
+
+// writeSignatureToOCILayout signs a manifest of an OCI image layout,
+// and writes the signature into the OCI image layout as a referrer of the manifest.
+func writeSignatureToOCILayout(dir string, name string, signed ocispecv1.Descriptor, key *signingKey, stderr io.Writer) error {
+	memoryStore, signatureDesc, err := newSignatureArtifact(name, signed, key)
+	if err != nil {
+		return err
+	}
+	if err := writeToOCILayout(dir, memoryStore, []referrer{{subject: signed.Digest, desc: signatureDesc}}); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Signed '%s' in OCI image layout '%s' with signature '%s'\n", signed.Digest, dir, signatureDesc.Digest)
+	return nil
+}
+
+// verifySignatures verifies the cosign signatures of a manifest in a registry against the trusted keys,
+// and returns the trusted key that a valid signature was made with.
+// An error is returned if the manifest has no signature made with a trusted key.
+func verifySignatures(ctx context.Context, registry *content.Registry, ref string, registryOptions *registryOptions, signed ocispecv1.Descriptor, trustedKeys []trustedKey) (trustedKey, error) {
+	repository, err := repositoryOf(ref)
+	if err != nil {
+		return trustedKey{}, err
+	}
+	remote, err := newRemoteRepository(ctx, ref, registryOptions, false)
+	if err != nil {
+		return trustedKey{}, err
+	}
+	// Registries that do not keep the manifest's "artifactType" field report the empty config's media type as the signatures' artifact type,
+	// so the referrers with that artifact type are also checked for being signatures.
+	descs, err := remote.referrers(ctx, signed.Digest, "")
+	if err != nil {
+		return trustedKey{}, err
+	}
+
+	// The manifest is verified if any of its signatures is valid and made with a trusted key.
+	signatures := 0
+	problems := make([]string, 0)
+	for _, desc := range descs {
+		if desc.ArtifactType != artifactTypeForCosignSignature && desc.ArtifactType != mediaTypeForEmptyConfig {
+			continue
+		}
+		signatureRef := fmt.Sprintf("%s@%s", repository, desc.Digest)
+		key, err := verifySignature(ctx, registry, signatureRef, desc.Descriptor, signed, trustedKeys)
+		if err == errNotSignature {
+			continue
+		}
+		signatures++
+		if err == nil {
+			return key, nil
+		}
+		problems = append(problems, fmt.Sprintf("signature '%s': %s", desc.Digest, err))
+	}
+	if signatures == 0 {
+		return trustedKey{}, fmt.Errorf("'%s@%s' is not signed", repository, signed.Digest)
+	}
+	return trustedKey{}, fmt.Errorf("'%s@%s' has no valid signature from a trusted key (%s)", repository, signed.Digest, strings.Join(problems, "; "))
+}
+
+// errNotSignature is returned when a referrer is not a cosign signature.
+var errNotSignature = errors.New("not a cosign signature")
+
+// verifySignature verifies a single cosign signature of a manifest against the trusted keys.
+func verifySignature(ctx context.Context, registry *content.Registry, signatureRef string, signatureDesc ocispecv1.Descriptor, signed ocispecv1.Descriptor, trustedKeys []trustedKey) (trustedKey, error) {
+	b, err := fetchContent(ctx, registry, signatureRef, signatureDesc)
+	if err != nil {
+		return trustedKey{}, err
+	}
+	var manifest artifactManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return trustedKey{}, err
+	}
+	if artifactTypeOf(manifest) != artifactTypeForCosignSignature {
+		return trustedKey{}, errNotSignature
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != signed.Digest {
+		return trustedKey{}, fmt.Errorf("does not refer to '%s'", signed.Digest)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != mediaTypeForCosignSimpleSigning {
+		return trustedKey{}, fmt.Errorf("expected a single '%s' layer", mediaTypeForCosignSimpleSigning)
+	}
+	payloadDesc := manifest.Layers[0]
+
+	// The payload is verified against its digest when fetched.
+	payloadBytes, err := fetchContent(ctx, registry, signatureRef, payloadDesc)
+	if err != nil {
+		return trustedKey{}, err
+	}
+	var payload simpleSigningPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return trustedKey{}, fmt.Errorf("invalid payload: %w", err)
+	}
+	if payload.Critical.Image.DockerManifestDigest != signed.Digest.String() {
+		return trustedKey{}, fmt.Errorf("payload signs '%s' instead", payload.Critical.Image.DockerManifestDigest)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(payloadDesc.Annotations[annotationKeyForCosignSignature])
+	if err != nil || len(signature) == 0 {
+		return trustedKey{}, fmt.Errorf("missing or invalid '%s' annotation", annotationKeyForCosignSignature)
+	}
+	for _, key := range trustedKeys {
+		if key.verify(payloadBytes, signature) {
+			return key, nil
+		}
+	}
+	return trustedKey{}, fmt.Errorf("not made with a trusted key")
+}
@@ -0,0 +1,501 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+// Image references with these prefixes are read from the local file system instead of a registry.
+var (
+	// imageRefPrefixForOCILayout is the prefix of an image in an OCI image layout directory ("oci-layout://path[:tag]").
+	// See https://github.com/opencontainers/image-spec/blob/v1.1.0/image-layout.md
+	imageRefPrefixForOCILayout = "oci-layout://"
+	// imageRefPrefixForDockerArchive is the prefix of an image in a "docker save" tarball ("docker-archive://file.tar[:tag]").
+	imageRefPrefixForDockerArchive = "docker-archive://"
+)
+
+// imageSource reads an image's manifests and blobs from where the image is stored.
+type imageSource interface {
+	// resolve returns the image manifest (or index) that the image reference refers to, together with its descriptor.
+	resolve(ctx context.Context) ([]byte, ocispecv1.Descriptor, error)
+	// fetch returns the content (manifest or config) of the image described by desc.
+	fetch(ctx context.Context, desc ocispecv1.Descriptor) ([]byte, error)
+}
+
+// openImageSource opens the image that ref refers to,
+// which is an image in a registry, an image in an OCI image layout ("oci-layout://path[:tag]"),
+// or an image in a "docker save" tarball ("docker-archive://file.tar[:tag]").
+func openImageSource(registry *content.Registry, ref string) (imageSource, error) {
+	switch {
+	case strings.HasPrefix(ref, imageRefPrefixForOCILayout):
+		dir, tag := splitLocalImageRef(strings.TrimPrefix(ref, imageRefPrefixForOCILayout))
+		source, err := openOCILayout(dir, tag, func(name string) ([]byte, error) {
+			return os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		})
+		if err != nil {
+			return nil, err
+		}
+		source.dir = dir
+		return source, nil
+	case strings.HasPrefix(ref, imageRefPrefixForDockerArchive):
+		file, tag := splitLocalImageRef(strings.TrimPrefix(ref, imageRefPrefixForDockerArchive))
+		return openDockerArchive(file, tag)
+	default:
+		return &registryImageSource{registry: registry, ref: ref}, nil
+	}
+}
+
+// splitLocalImageRef splits a local image reference ("path[:tag]") into its path and its tag.
+// Since both paths and tags may contain ':', the path is the longest prefix that exists on the file system.
+func splitLocalImageRef(ref string) (string, string) {
+	for i := len(ref); i > 0; i = strings.LastIndex(ref[:i], ":") {
+		if _, err := os.Stat(ref[:i]); err == nil {
+			return ref[:i], strings.TrimPrefix(ref[i:], ":")
+		}
+	}
+	return ref, ""
+}
+
+// registryImageSource reads an image from a registry.
+type registryImageSource struct {
+	registry *content.Registry
+	ref      string
+}
+
+func (s *registryImageSource) resolve(ctx context.Context) ([]byte, ocispecv1.Descriptor, error) {
+	return fetchManifest(ctx, s.registry, s.ref)
+}
+
+func (s *registryImageSource) fetch(ctx context.Context, desc ocispecv1.Descriptor) ([]byte, error) {
+	return fetchContent(ctx, s.registry, s.ref, desc)
+}
+
+// ociLayoutImageSource reads an image from an OCI image layout,
+// which is either a directory or the content of a tarball (such as saved by "docker save" since Docker v25).
+type ociLayoutImageSource struct {
+	// dir is the OCI image layout directory (or "" for an OCI image layout in a tarball).
+	dir string
+	// readFile reads a file of the OCI image layout by its slash-separated path (such as "index.json").
+	readFile func(name string) ([]byte, error)
+	// desc describes the image's manifest (or index) in the OCI image layout's index.
+	desc ocispecv1.Descriptor
+}
+
+// openOCILayout opens the image of an OCI image layout whose "org.opencontainers.image.ref.name" annotation is tag.
+// Without a tag, the OCI image layout must hold a single image; artifacts (manifests with an artifact type or a subject,
+// such as the lpm manifests and signatures written into the layout) are not counted.
+func openOCILayout(name string, tag string, readFile func(name string) ([]byte, error)) (*ociLayoutImageSource, error) {
+	if _, err := readFile(ocispecv1.ImageLayoutFile); err != nil {
+		return nil, fmt.Errorf("'%s' is not an OCI image layout: %w", name, err)
+	}
+	indexBytes, err := readFile("index.json")
+	if err != nil {
+		return nil, err
+	}
+	var index artifactIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, fmt.Errorf("invalid index of OCI image layout '%s': %w", name, err)
+	}
+
+	candidates := make([]artifactDescriptor, 0)
+	for _, desc := range index.Manifests {
+		if tag != "" {
+			if desc.Annotations[ocispecv1.AnnotationRefName] == tag || desc.Annotations[annotationKeyForContainerdImageName] == tag {
+				candidates = append(candidates, desc)
+			}
+		} else if desc.ArtifactType == "" {
+			isReferrer, err := hasSubject(desc.Descriptor, readFile)
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest '%s' in OCI image layout '%s': %w", desc.Digest, name, err)
+			}
+			if !isReferrer {
+				candidates = append(candidates, desc)
+			}
+		}
+	}
+	switch {
+	case len(candidates) == 0 && tag != "":
+		return nil, fmt.Errorf("no image tagged '%s' in OCI image layout '%s'", tag, name)
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("no image in OCI image layout '%s'", name)
+	case len(candidates) > 1:
+		return nil, fmt.Errorf("OCI image layout '%s' holds %d images, select one with '%s:<tag>'", name, len(candidates), name)
+	}
+
+	return &ociLayoutImageSource{readFile: readFile, desc: candidates[0].Descriptor}, nil
+}
+
+// hasSubject returns whether the manifest (or index) described by desc in an OCI image layout refers to a subject manifest.
+func hasSubject(desc ocispecv1.Descriptor, readFile func(name string) ([]byte, error)) (bool, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return false, err
+	}
+	b, err := readFile(path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return false, err
+	}
+	var manifest artifactManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return false, err
+	}
+	return manifest.Subject != nil, nil
+}
+
+// isLpmArtifactType returns whether an artifact type is the type of an artifact made by lpm (such as an lpm manifest).
+func isLpmArtifactType(artifactType string) bool {
+	for manifestType, configType := range artifactTypeAliases {
+		if artifactType == manifestType || artifactType == configType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ociLayoutImageSource) resolve(ctx context.Context) ([]byte, ocispecv1.Descriptor, error) {
+	b, err := s.fetch(ctx, s.desc)
+	if err != nil {
+		return nil, ocispecv1.Descriptor{}, err
+	}
+	return b, s.desc, nil
+}
+
+func (s *ociLayoutImageSource) fetch(_ context.Context, desc ocispecv1.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	b, err := s.readFile(path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return nil, err
+	}
+	if desc.Digest.Algorithm().FromBytes(b) != desc.Digest {
+		return nil, fmt.Errorf("blob '%s' of OCI image layout does not match its digest", desc.Digest)
+	}
+	return b, nil
+}
+
+// dockerArchiveManifest is an entry of the "manifest.json" file of a "docker save" tarball.
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// dockerArchiveImageSource reads an image from a "docker save" tarball saved by Docker before v25,
+// which holds the image's config and layers but not its image manifest.
+//
+// The image manifest is made from the tarball's config and layers (as the Docker daemon does when pushing the image),
+// but since layers are usually compressed when pushed, its digest (and its layers' digests) differ from the image manifest pushed to a registry.
+type dockerArchiveImageSource struct {
+	manifest     []byte
+	manifestDesc ocispecv1.Descriptor
+	config       []byte
+}
+
+// openDockerArchive opens the image of a "docker save" tarball tagged tag (such as "myimage:latest").
+// Without a tag, the tarball must hold a single image.
+// Tarballs saved by Docker v25 or later are read as an OCI image layout, which holds the image manifest.
+func openDockerArchive(file string, tag string) (imageSource, error) {
+	readFile := func(name string) ([]byte, error) {
+		return readTarFile(file, name)
+	}
+	if _, err := readFile(ocispecv1.ImageLayoutFile); err == nil {
+		return openOCILayout(file, tag, readFile)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// Select the image from the tarball's manifest.
+	manifestJsonBytes, err := readFile("manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a \"docker save\" tarball: %w", file, err)
+	}
+	var manifests []dockerArchiveManifest
+	if err := json.Unmarshal(manifestJsonBytes, &manifests); err != nil {
+		return nil, fmt.Errorf("invalid manifest of \"docker save\" tarball '%s': %w", file, err)
+	}
+	candidates := make([]dockerArchiveManifest, 0)
+	for _, m := range manifests {
+		if tag == "" || dockerArchiveHasTag(m, tag) {
+			candidates = append(candidates, m)
+		}
+	}
+	switch {
+	case len(candidates) == 0 && tag != "":
+		return nil, fmt.Errorf("no image tagged '%s' in \"docker save\" tarball '%s'", tag, file)
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("no image in \"docker save\" tarball '%s'", file)
+	case len(candidates) > 1:
+		return nil, fmt.Errorf("\"docker save\" tarball '%s' holds %d images, select one with '%s:<tag>'", file, len(candidates), file)
+	}
+	m := candidates[0]
+
+	// Read the image's config, and describe the image's layers from their content.
+	config, err := readFile(path.Clean(m.Config))
+	if err != nil {
+		return nil, err
+	}
+	layerDescs, err := describeTarFiles(file, m.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make the image manifest.
+	manifest := ocispecv1.Manifest{
+		Versioned: ocispecs.Versioned{SchemaVersion: 2},
+		MediaType: string(types.DockerManifestSchema2),
+		Config: ocispecv1.Descriptor{
+			MediaType: string(types.DockerConfigJSON),
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: layerDescs,
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerArchiveImageSource{
+		manifest: manifestBytes,
+		manifestDesc: ocispecv1.Descriptor{
+			MediaType: manifest.MediaType,
+			Digest:    digest.FromBytes(manifestBytes),
+			Size:      int64(len(manifestBytes)),
+		},
+		config: config,
+	}, nil
+}
+
+// dockerArchiveHasTag returns whether an image of a "docker save" tarball is tagged tag,
+// comparing the fully qualified forms of the tags (so that "myimage:latest" matches "docker.io/library/myimage:latest").
+func dockerArchiveHasTag(m dockerArchiveManifest, tag string) bool {
+	normalizedTag, err := normalizeImageRef(tag)
+	if err != nil {
+		normalizedTag = tag
+	}
+	for _, repoTag := range m.RepoTags {
+		if repoTag == tag {
+			return true
+		}
+		if normalizedRepoTag, err := normalizeImageRef(repoTag); err == nil && normalizedRepoTag == normalizedTag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *dockerArchiveImageSource) resolve(_ context.Context) ([]byte, ocispecv1.Descriptor, error) {
+	return s.manifest, s.manifestDesc, nil
+}
+
+func (s *dockerArchiveImageSource) fetch(_ context.Context, desc ocispecv1.Descriptor) ([]byte, error) {
+	switch desc.Digest {
+	case s.manifestDesc.Digest:
+		return s.manifest, nil
+	case digest.FromBytes(s.config):
+		return s.config, nil
+	}
+	return nil, fmt.Errorf("content '%s' not found in \"docker save\" tarball", desc.Digest)
+}
+
+// readTarFile reads the file named name (a slash-separated path) from the tarball file.
+// An error wrapping fs.ErrNotExist is returned when the tarball has no such file.
+func readTarFile(file string, name string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Since the tarball is a file, the tar reader seeks past the content of the files that are not read.
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Clean(hdr.Name) == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// describeTarFiles returns a layer descriptor for each of the named files of the tarball file,
+// with the digest and size of the file's content, and the media type of a compressed or uncompressed layer.
+func describeTarFiles(file string, names []string) ([]ocispecv1.Descriptor, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[path.Clean(name)] = true
+	}
+
+	descs := make(map[string]ocispecv1.Descriptor)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !wanted[name] {
+			continue
+		}
+
+		// Layers compressed with gzip start with the gzip magic number.
+		h := sha256.New()
+		magic := make([]byte, 2)
+		n, err := io.ReadFull(tr, magic)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		h.Write(magic[:n])
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+
+		mediaType := types.DockerUncompressedLayer
+		if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			mediaType = types.DockerLayer
+		}
+		descs[name] = ocispecv1.Descriptor{
+			MediaType: string(mediaType),
+			Digest:    digest.NewDigest(digest.SHA256, h),
+			Size:      hdr.Size,
+		}
+	}
+
+	layerDescs := make([]ocispecv1.Descriptor, 0)
+	for _, name := range names {
+		desc, ok := descs[path.Clean(name)]
+		if !ok {
+			return nil, fmt.Errorf("layer '%s' not found in \"docker save\" tarball '%s'", name, file)
+		}
+		layerDescs = append(layerDescs, desc)
+	}
+	return layerDescs, nil
+}
+
+// writeToOCILayout writes the artifacts stored in the memory store into an OCI image layout directory,
+// and adds each referrer to the OCI image layout's index, so that it can be discovered through its subject.
+// Referrers already in the index (such as an lpm manifest written again for an unchanged image) are not added twice.
+func writeToOCILayout(dir string, memoryStore *content.Memory, referrers []referrer) error {
+	for _, r := range referrers {
+		if err := writeBlobsToOCILayout(dir, memoryStore, r.desc.Descriptor); err != nil {
+			return err
+		}
+	}
+
+	// Add the referrers to the index, keeping the rest of the index as it is.
+	indexFile := filepath.Join(dir, "index.json")
+	indexBytes, err := os.ReadFile(indexFile)
+	if err != nil {
+		return err
+	}
+	var index map[string]json.RawMessage
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return err
+	}
+	var manifests []json.RawMessage
+	if index["manifests"] != nil {
+		if err := json.Unmarshal(index["manifests"], &manifests); err != nil {
+			return err
+		}
+	}
+	indexed := make(map[digest.Digest]bool)
+	for _, m := range manifests {
+		var desc ocispecv1.Descriptor
+		if err := json.Unmarshal(m, &desc); err != nil {
+			return err
+		}
+		indexed[desc.Digest] = true
+	}
+	for _, r := range referrers {
+		if indexed[r.desc.Digest] {
+			continue
+		}
+		indexed[r.desc.Digest] = true
+		b, err := json.Marshal(r.desc)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, b)
+	}
+	index["manifests"], err = json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+	indexBytes, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(indexFile, indexBytes, 0644)
+}
+
+// writeBlobsToOCILayout writes the manifest (or index) described by desc, together with its config, layers and manifests,
+// from the memory store into the blobs of an OCI image layout directory.
+func writeBlobsToOCILayout(dir string, memoryStore *content.Memory, desc ocispecv1.Descriptor) error {
+	_, b, ok := memoryStore.Get(desc)
+	if !ok {
+		return fmt.Errorf("content '%s' not found", desc.Digest)
+	}
+	blobDir := filepath.Join(dir, "blobs", desc.Digest.Algorithm().String())
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(blobDir, desc.Digest.Encoded()), b, 0644); err != nil {
+		return err
+	}
+
+	children := make([]ocispecv1.Descriptor, 0)
+	switch desc.MediaType {
+	case ocispecv1.MediaTypeImageManifest:
+		var manifest ocispecv1.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return err
+		}
+		children = append(append(children, manifest.Config), manifest.Layers...)
+	case ocispecv1.MediaTypeImageIndex:
+		var index ocispecv1.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return err
+		}
+		children = append(children, index.Manifests...)
+	}
+	for _, child := range children {
+		if err := writeBlobsToOCILayout(dir, memoryStore, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/content"
+)
+
+// storeTestManifest stores a manifest and its config in the memory store, and returns the manifest's descriptor.
+func storeTestManifest(t *testing.T, memoryStore *content.Memory, manifest artifactManifest) artifactDescriptor {
+	t.Helper()
+	configBytes := []byte("{}")
+	manifest.Versioned = ocispecs.Versioned{SchemaVersion: 2}
+	manifest.MediaType = ocispecv1.MediaTypeImageManifest
+	manifest.Config.Digest = digest.FromBytes(configBytes)
+	manifest.Config.Size = int64(len(configBytes))
+	manifest.Layers = []ocispecv1.Descriptor{}
+	memoryStore.Set(manifest.Config, configBytes)
+
+	b, desc, err := marshalArtifact(ocispecv1.MediaTypeImageManifest, manifest.ArtifactType, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryStore.Set(desc.Descriptor, b)
+	return desc
+}
+
+// newTestOCILayout writes an OCI image layout holding a single untagged image into a temporary directory.
+func newTestOCILayout(t *testing.T) (string, artifactDescriptor) {
+	t.Helper()
+	dir := t.TempDir()
+	memoryStore := content.NewMemory()
+	image := storeTestManifest(t, memoryStore, artifactManifest{Manifest: ocispecv1.Manifest{Config: ocispecv1.Descriptor{MediaType: ocispecv1.MediaTypeImageConfig}}})
+	if err := writeBlobsToOCILayout(dir, memoryStore, image.Descriptor); err != nil {
+		t.Fatal(err)
+	}
+
+	layoutBytes, _ := json.Marshal(ocispecv1.ImageLayout{Version: ocispecv1.ImageLayoutVersion})
+	if err := os.WriteFile(filepath.Join(dir, ocispecv1.ImageLayoutFile), layoutBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	indexBytes, _ := json.Marshal(ocispecv1.Index{
+		Versioned: ocispecs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecv1.MediaTypeImageIndex,
+		Manifests: []ocispecv1.Descriptor{image.Descriptor},
+	})
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), indexBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, image
+}
+
+func TestOpenOCILayoutSkipsArtifacts(t *testing.T) {
+	dir, image := newTestOCILayout(t)
+	subject := image.Descriptor
+
+	memoryStore := content.NewMemory()
+	referrers := []referrer{
+		// An lpm manifest, with an artifact type.
+		{subject: subject.Digest, desc: storeTestManifest(t, memoryStore, artifactManifest{
+			Manifest:     ocispecv1.Manifest{Config: ocispecv1.Descriptor{MediaType: mediaTypeForConfigLpm}},
+			ArtifactType: mediaTypeForManifestLpm,
+			Subject:      &subject,
+		})},
+		// A signature written without an artifact type in the index, only found through its subject.
+		{subject: subject.Digest, desc: artifactDescriptor{Descriptor: storeTestManifest(t, memoryStore, artifactManifest{
+			Manifest: ocispecv1.Manifest{Config: ocispecv1.Descriptor{MediaType: mediaTypeForEmptyConfig}},
+			Subject:  &subject,
+		}).Descriptor}},
+	}
+	if err := writeToOCILayout(dir, memoryStore, referrers); err != nil {
+		t.Fatal(err)
+	}
+
+	// The referrers are not counted as images of the untagged OCI image layout.
+	source, err := openOCILayout(dir, "", func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, name))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.desc.Digest != subject.Digest {
+		t.Errorf("openOCILayout() opened '%s', want image '%s'", source.desc.Digest, subject.Digest)
+	}
+}
+
+func TestWriteToOCILayoutAddsReferrersOnce(t *testing.T) {
+	dir, image := newTestOCILayout(t)
+	subject := image.Descriptor
+
+	memoryStore := content.NewMemory()
+	lpm := storeTestManifest(t, memoryStore, artifactManifest{
+		Manifest:     ocispecv1.Manifest{Config: ocispecv1.Descriptor{MediaType: mediaTypeForConfigLpm}},
+		ArtifactType: mediaTypeForManifestLpm,
+		Subject:      &subject,
+	})
+
+	// Writing the same referrer again (as for an image analyzed twice) adds it to the index once.
+	for _, referrers := range [][]referrer{
+		{{subject: subject.Digest, desc: lpm}},
+		{{subject: subject.Digest, desc: lpm}, {subject: subject.Digest, desc: lpm}},
+	} {
+		if err := writeToOCILayout(dir, memoryStore, referrers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexBytes, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index ocispecv1.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("index holds %d manifests, want 2 (the image and its lpm manifest)", len(index.Manifests))
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"sigs.k8s.io/yaml"
+)
+
+// registryConfig is how lpm connects to a registry.
+type registryConfig struct {
+	// PlainHTTP connects to the registry over plain HTTP instead of HTTPS.
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+	// Insecure skips the verification of the registry's TLS certificate.
+	Insecure bool `json:"insecure,omitempty"`
+	// CAFile is a PEM file of CA certificates to trust (in addition to the system's) when verifying the registry's TLS certificate.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are a PEM client certificate and key to authenticate to the registry with (mutual TLS).
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// registriesConfigFile is the per-registry config file, in YAML (or JSON). For example:
+//
+//	registries:
+//	  localhost:5000:
+//	    plainHTTP: true
+//	  registry.internal.example.com:
+//	    caFile: /etc/ssl/certs/internal-ca.pem
+//	    certFile: /etc/lpm/client.pem
+//	    keyFile: /etc/lpm/client-key.pem
+type registriesConfigFile struct {
+	// Registries maps registry hosts (with their port, if any) to how lpm connects to them.
+	Registries map[string]registryConfig `json:"registries"`
+}
+
+// defaultRegistriesConfigFile returns the path of the per-registry config file used when none is given
+// ("$XDG_CONFIG_HOME/lpm/registries.yaml", usually "~/.config/lpm/registries.yaml").
+func defaultRegistriesConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lpm", "registries.yaml")
+}
+
+// loadRegistriesConfigFile reads the per-registry config file.
+// A missing default config file is the same as an empty config file.
+func loadRegistriesConfigFile(path string, isDefault bool) (map[string]registryConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) && isDefault {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var configFile registriesConfigFile
+	if err := yaml.Unmarshal(b, &configFile); err != nil {
+		return nil, fmt.Errorf("invalid registry config file '%s': %w", path, err)
+	}
+	return configFile.Registries, nil
+}
+
+// usePlainHTTP returns whether to connect to the registry host over plain HTTP.
+// Registries on localhost are connected to over plain HTTP, unless TLS settings are configured for them.
+func (config registryConfig) usePlainHTTP(host string) bool {
+	if config.PlainHTTP {
+		return true
+	}
+	if config.Insecure || config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" {
+		return false
+	}
+	isLocalhost, _ := docker.MatchLocalhost(host)
+	return isLocalhost
+}
+
+// scheme returns the URL scheme ("http" or "https") to connect to the registry host with.
+func (config registryConfig) scheme(host string) string {
+	if config.usePlainHTTP(host) {
+		return "http"
+	}
+	return "https"
+}
+
+// tlsConfig returns the TLS client config to connect to a registry with.
+func (config registryConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	if config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate found in '%s'", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("a client certificate requires both a certificate file and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// transport returns the HTTP transport to connect to a registry with.
+func (config registryConfig) transport() (http.RoundTripper, error) {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// transport returns the HTTP transport to connect to a registry with config.
+// A transport is built once for each registry config and reused, so that connections to the registry are pooled
+// across the registry stores and remote repositories of a command (which may be used concurrently).
+func (registryOptions *registryOptions) transport(config registryConfig) (http.RoundTripper, error) {
+	registryOptions.transportsMutex.Lock()
+	defer registryOptions.transportsMutex.Unlock()
+
+	if transport, ok := registryOptions.transports[config]; ok {
+		return transport, nil
+	}
+	transport, err := config.transport()
+	if err != nil {
+		return nil, err
+	}
+	if registryOptions.transports == nil {
+		registryOptions.transports = make(map[registryConfig]http.RoundTripper)
+	}
+	registryOptions.transports[config] = transport
+	return transport, nil
+}
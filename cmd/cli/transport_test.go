@@ -0,0 +1,106 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestRegistryOptionsTransportIsReused(t *testing.T) {
+	registryOptions := &registryOptions{}
+
+	plainHTTP, err := registryOptions.transport(registryConfig{PlainHTTP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insecure, err := registryOptions.transport(registryConfig{Insecure: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainHTTP == insecure {
+		t.Error("transport() returned the same transport for different registry configs")
+	}
+
+	// Commands such as audit build registry stores and remote repositories from several goroutines.
+	var wg sync.WaitGroup
+	transports := make([]http.RoundTripper, 8)
+	for i := range transports {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			transports[i], _ = registryOptions.transport(registryConfig{PlainHTTP: true})
+		}(i)
+	}
+	wg.Wait()
+	for i, transport := range transports {
+		if transport != plainHTTP {
+			t.Errorf("transport() call %d returned a new transport for the same registry config", i)
+		}
+	}
+
+	if _, err := registryOptions.transport(registryConfig{CertFile: "client.pem"}); err == nil {
+		t.Error("transport() error = nil, want an error for a client certificate without a key file")
+	}
+}
+
+func TestRemoteRepositoriesShareConnections(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	reg := &testRegistry{
+		denied:    make(map[string]bool),
+		manifests: make(map[string][]byte),
+		tags:      make(map[string]digest.Digest),
+	}
+	// Count the connections that requests are served on, by their client address.
+	// (Connecting to a remote repository also probes the plain HTTP registry over HTTPS, on connections that serve no request.)
+	var lock sync.Mutex
+	connections := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		connections[r.RemoteAddr] = true
+		lock.Unlock()
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ctx := context.Background()
+	registryOptions := &registryOptions{}
+	remote, err := newRemoteRepository(ctx, host+"/myimage:1", registryOptions, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestManifest(t, remote, "1", testImageManifest("myimage", 1))
+
+	registry, err := newRegistry(registryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		remote, err := newRemoteRepository(ctx, host+"/myimage:1", registryOptions, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := remote.fetchManifest(ctx, "1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := registry.Resolve(ctx, host+"/myimage:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(connections) != 1 {
+		t.Errorf("registry connections = %d, want a single pooled connection", len(connections))
+	}
+}
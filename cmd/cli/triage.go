@@ -0,0 +1,430 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+type triageCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	scanFile        string
+	lpmRefOrFile    string
+	platform        string
+	format          string
+	output          string
+}
+
+func newTriageCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	triageCmd := &triageCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "triage",
+		Short: "attribute the findings of a vulnerability scan (Trivy or Grype JSON report) to the subject image's layers, grouped by ownership and Dockerfile command",
+		Example: `lpm triage \
+[--username 					username] \
+[--password-stdin] \
+--scan 							trivy-report.json (or grype-report.json) \
+--lpm 							myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest, or lpm.json) \
+[--platform 					linux/amd64] \
+[--format 						table|json|yaml] \
+[--output 						triage.txt]
+`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return triageCmd.run()
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &triageCmd.registryOptions)
+
+	var scanLongFlag = "scan"
+	f.StringVar(&triageCmd.scanFile, scanLongFlag, "", "vulnerability scan report of the subject image, in Trivy ('trivy image --format json') or Grype ('grype -o json') JSON format")
+	cobraCmd.MarkFlagRequired(scanLongFlag)
+
+	var lpmLongFlag = "lpm"
+	f.StringVar(&triageCmd.lpmRefOrFile, lpmLongFlag, "", "lpm manifest (or lpm index) artifact ref, or lpm manifest file, of the scanned subject image")
+	cobraCmd.MarkFlagRequired(lpmLongFlag)
+
+	f.StringVar(&triageCmd.platform, "platform", "", "(optional) platform (os/arch[/variant]) of the scanned subject image, for an lpm index (default: the platform whose layers match the scan report)")
+
+	f.StringVar(&triageCmd.format, "format", "table", "(optional) output format, either 'table', 'json' or 'yaml'")
+
+	f.StringVarP(&triageCmd.output, "output", "o", "", "(optional) output file to write the triage to (default: stdout)")
+
+	return cobraCmd
+}
+
+// scanReport is a vulnerability scan report of a subject image, read from a Trivy or Grype JSON report.
+type scanReport struct {
+	// scanner is either "trivy" or "grype".
+	scanner string
+	// imageID is the digest of the scanned image's config (if the scanner reports it).
+	imageID string
+	// diffIDs are the DiffIDs of the scanned image's layers, from the bottom layer to the top layer (if the scanner reports them).
+	diffIDs  []string
+	findings []scanFinding
+}
+
+// scanFinding is a vulnerability that a scanner found in a package of a layer.
+type scanFinding struct {
+	ID               string `json:"id"`
+	Severity         string `json:"severity"`
+	Package          string `json:"package"`
+	InstalledVersion string `json:"installedVersion,omitempty"`
+	FixedVersion     string `json:"fixedVersion,omitempty"`
+	// Target is the file or OS that the package was found in.
+	Target string `json:"target,omitempty"`
+	// LayerDigest and LayerDiffID are the (compressed) digest and the DiffID of the layer the package was found in, as reported by the scanner.
+	LayerDigest string `json:"layerDigest,omitempty"`
+	LayerDiffID string `json:"layerDiffID,omitempty"`
+}
+
+// trivyReport is the part of a Trivy JSON report (schema version 2) that lpm reads.
+type trivyReport struct {
+	SchemaVersion int `json:"SchemaVersion"`
+	Metadata      struct {
+		ImageID string   `json:"ImageID"`
+		DiffIDs []string `json:"DiffIDs"`
+	} `json:"Metadata"`
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+			Layer            struct {
+				Digest string `json:"Digest"`
+				DiffID string `json:"DiffID"`
+			} `json:"Layer"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// grypeReport is the part of a Grype JSON report that lpm reads.
+// Grype identifies layers by their DiffIDs.
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID       string `json:"id"`
+			Severity string `json:"severity"`
+			Fix      struct {
+				Versions []string `json:"versions"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name      string `json:"name"`
+			Version   string `json:"version"`
+			Locations []struct {
+				Path    string `json:"path"`
+				LayerID string `json:"layerID"`
+			} `json:"locations"`
+		} `json:"artifact"`
+	} `json:"matches"`
+	Source struct {
+		Target struct {
+			ImageID string `json:"imageID"`
+			Layers  []struct {
+				Digest string `json:"digest"`
+			} `json:"layers"`
+		} `json:"target"`
+	} `json:"source"`
+}
+
+// loadScanReport reads a Trivy or Grype JSON report, telling them apart by their top-level fields.
+func loadScanReport(path string) (*scanReport, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("invalid scan report '%s': %w", path, err)
+	}
+
+	if _, ok := fields["matches"]; ok {
+		var grype grypeReport
+		if err := json.Unmarshal(b, &grype); err != nil {
+			return nil, fmt.Errorf("invalid Grype report '%s': %w", path, err)
+		}
+		report := &scanReport{scanner: "grype", imageID: grype.Source.Target.ImageID}
+		for _, layer := range grype.Source.Target.Layers {
+			report.diffIDs = append(report.diffIDs, layer.Digest)
+		}
+		for _, match := range grype.Matches {
+			finding := scanFinding{
+				ID:               match.Vulnerability.ID,
+				Severity:         strings.ToUpper(match.Vulnerability.Severity),
+				Package:          match.Artifact.Name,
+				InstalledVersion: match.Artifact.Version,
+				FixedVersion:     strings.Join(match.Vulnerability.Fix.Versions, ", "),
+			}
+			// A package found in several layers is attributed to each of them.
+			if len(match.Artifact.Locations) == 0 {
+				report.findings = append(report.findings, finding)
+			}
+			for _, location := range match.Artifact.Locations {
+				finding.Target, finding.LayerDiffID = location.Path, location.LayerID
+				report.findings = append(report.findings, finding)
+			}
+		}
+		return report, nil
+	}
+
+	if _, ok := fields["SchemaVersion"]; ok {
+		var trivy trivyReport
+		if err := json.Unmarshal(b, &trivy); err != nil {
+			return nil, fmt.Errorf("invalid Trivy report '%s': %w", path, err)
+		}
+		if trivy.SchemaVersion != 2 {
+			return nil, fmt.Errorf("unsupported Trivy report schema version %d in '%s', expected 2", trivy.SchemaVersion, path)
+		}
+		report := &scanReport{scanner: "trivy", imageID: trivy.Metadata.ImageID, diffIDs: trivy.Metadata.DiffIDs}
+		for _, result := range trivy.Results {
+			for _, vulnerability := range result.Vulnerabilities {
+				report.findings = append(report.findings, scanFinding{
+					ID:               vulnerability.VulnerabilityID,
+					Severity:         vulnerability.Severity,
+					Package:          vulnerability.PkgName,
+					InstalledVersion: vulnerability.InstalledVersion,
+					FixedVersion:     vulnerability.FixedVersion,
+					Target:           result.Target,
+					LayerDigest:      vulnerability.Layer.Digest,
+					LayerDiffID:      vulnerability.Layer.DiffID,
+				})
+			}
+		}
+		return report, nil
+	}
+
+	return nil, fmt.Errorf("unsupported scan report '%s', expected a Trivy or Grype JSON report", path)
+}
+
+// triage is the findings of a vulnerability scan, attributed to the subject image's layers.
+type triage struct {
+	Scanner string `json:"scanner"`
+	// Subject is the digest of the scanned subject image manifest.
+	Subject  string `json:"subject,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	// Groups are the findings grouped by the ownership and the Dockerfile command of the layers they were found in,
+	// the non-upstream groups first.
+	Groups []triageGroup `json:"groups"`
+}
+
+// triageGroup is the findings in the layers with the same ownership that were created by the same Dockerfile command.
+type triageGroup struct {
+	// Ownership is "upstream", "non-upstream", or "unattributed" for the findings whose layer is not in the lpm manifest.
+	Ownership string `json:"ownership"`
+	Command   string `json:"command,omitempty"`
+	// Layers are the indexes of the layers the findings were found in.
+	Layers   []int         `json:"layers"`
+	Findings []scanFinding `json:"findings"`
+}
+
+// ownershipUnattributed is the ownership of the findings whose layer could not be found in the lpm manifest.
+var ownershipUnattributed = "unattributed"
+
+func (triageCmd *triageCmd) run() error {
+	// Read the registry password from stdin if needed.
+	if err := triageCmd.registryOptions.complete(triageCmd.stdin, registryHost(triageCmd.lpmRefOrFile)); err != nil {
+		return err
+	}
+
+	if triageCmd.format != "table" && triageCmd.format != "json" && triageCmd.format != "yaml" {
+		return fmt.Errorf("unsupported output format '%s', expected 'table', 'json' or 'yaml'", triageCmd.format)
+	}
+
+	report, err := loadScanReport(triageCmd.scanFile)
+	if err != nil {
+		return err
+	}
+
+	// Set output writer.
+	var out io.Writer
+	if triageCmd.output == "" {
+		out = triageCmd.stdout
+	} else {
+		f, err := os.Create(triageCmd.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&triageCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	// Load the lpm manifest (or the lpm manifest of each platform of an lpm index).
+	loaded, _, err := loadLpmManifests(ctx, registry, triageCmd.lpmRefOrFile)
+	if err != nil {
+		return err
+	}
+	layerDigests := make([]string, 0)
+	for _, finding := range report.findings {
+		layerDigests = append(layerDigests, finding.LayerDigest)
+	}
+	l, err := selectLpmManifest(loaded, triageCmd.platform, report.imageID, layerDigests)
+	if err != nil {
+		return err
+	}
+
+	t := triageFindings(l.manifest, report)
+	t.Platform = l.platform
+	if len(t.Groups) > 0 && t.Groups[len(t.Groups)-1].Ownership == ownershipUnattributed {
+		fmt.Fprintf(triageCmd.stderr, "[!] Warning: %d findings are in layers that are not in the lpm manifest, is it the lpm manifest of the scanned image?\n", len(t.Groups[len(t.Groups)-1].Findings))
+	}
+
+	switch triageCmd.format {
+	case "json":
+		triageJsonString, err := json.MarshalIndent(t, "", "	")
+		if err != nil {
+			return err
+		}
+		out.Write(triageJsonString)
+	case "yaml":
+		triageYamlString, err := yaml.Marshal(t)
+		if err != nil {
+			return err
+		}
+		out.Write(triageYamlString)
+	default:
+		writeTriageTable(out, t)
+	}
+
+	return nil
+}
+
+// triageFindings attributes each finding of a scan report to a layer of an lpm manifest's subject image, and groups them.
+//
+// A finding is attributed to a layer by the layer's digest, or otherwise by the layer's DiffID:
+// lpm manifests record the layers' (compressed) digests, so a DiffID is mapped to the layer at the same position
+// in the list of DiffIDs of the scanned image that the scanner reports.
+func triageFindings(lpmManifest artifactManifest, report *scanReport) triage {
+	t := triage{Scanner: report.scanner, Groups: make([]triageGroup, 0)}
+	if lpmManifest.Subject != nil {
+		t.Subject = lpmManifest.Subject.Digest.String()
+	}
+
+	digests := lpmLayerIndexes(lpmManifest)
+	diffIDs := lpmLayerIndexesByDiffID(lpmManifest, report.diffIDs)
+
+	groups := make(map[[2]string]*triageGroup)
+	keys := make([][2]string, 0)
+	for _, finding := range report.findings {
+		i, ok := digests[finding.LayerDigest]
+		if !ok || finding.LayerDigest == "" {
+			i, ok = diffIDs[finding.LayerDiffID]
+		}
+
+		key := [2]string{ownershipUnattributed, ""}
+		if ok {
+			annotations := lpmManifest.Layers[i].Annotations
+			key = [2]string{layerOwnership(annotations), layerCommand(annotations)}
+		}
+		group, exists := groups[key]
+		if !exists {
+			group = &triageGroup{Ownership: key[0], Command: key[1], Layers: make([]int, 0), Findings: make([]scanFinding, 0)}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		if ok && !containsInt(group.Layers, i) {
+			group.Layers = append(group.Layers, i)
+		}
+		group.Findings = append(group.Findings, finding)
+	}
+
+	// Non-upstream groups come first (they are ours to remediate), then upstream groups, then the unattributed findings,
+	// and the groups of the same ownership are ordered by their bottom layer.
+	ownershipOrder := map[string]int{ownershipNonUpstream: 0, ownershipUpstream: 1, ownershipUnattributed: 3}
+	rank := func(ownership string) int {
+		if r, ok := ownershipOrder[ownership]; ok {
+			return r
+		}
+		return 2
+	}
+	for _, key := range keys {
+		sort.Ints(groups[key].Layers)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := groups[keys[i]], groups[keys[j]]
+		if rank(a.Ownership) != rank(b.Ownership) {
+			return rank(a.Ownership) < rank(b.Ownership)
+		}
+		return len(a.Layers) > 0 && len(b.Layers) > 0 && a.Layers[0] < b.Layers[0]
+	})
+	for _, key := range keys {
+		t.Groups = append(t.Groups, *groups[key])
+	}
+
+	return t
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTriageTable writes the findings of each group as a table, preceded by the group's ownership, layers and command.
+func writeTriageTable(out io.Writer, t triage) {
+	if t.Platform != "" {
+		fmt.Fprintf(out, "PLATFORM: %s\n", t.Platform)
+	}
+	if t.Subject != "" {
+		fmt.Fprintf(out, "SUBJECT: %s\n", t.Subject)
+	}
+
+	for _, group := range t.Groups {
+		fmt.Fprintln(out)
+		layers := make([]string, 0)
+		for _, i := range group.Layers {
+			layers = append(layers, fmt.Sprint(i))
+		}
+		fmt.Fprintf(out, "OWNERSHIP: %s (%d findings)\n", group.Ownership, len(group.Findings))
+		if len(layers) > 0 {
+			fmt.Fprintf(out, "LAYERS: %s\n", strings.Join(layers, ", "))
+		}
+		if group.Command != "" {
+			fmt.Fprintf(out, "COMMAND: %s\n", group.Command)
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSEVERITY\tPACKAGE\tINSTALLED\tFIXED\tTARGET")
+		for _, finding := range group.Findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", finding.ID, finding.Severity, finding.Package, finding.InstalledVersion, finding.FixedVersion, finding.Target)
+		}
+		w.Flush()
+	}
+}
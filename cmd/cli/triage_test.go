@@ -0,0 +1,101 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// loadTestLpmManifest loads the lpm manifest of the testdata directory.
+func loadTestLpmManifest(t *testing.T) artifactManifest {
+	t.Helper()
+	loaded, _, err := loadLpmManifests(context.Background(), nil, filepath.Join("testdata", "lpm-manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded[0].manifest
+}
+
+func TestTriageFindings(t *testing.T) {
+	lpmManifest := loadTestLpmManifest(t)
+
+	tests := []struct {
+		name        string
+		scanFile    string
+		diffIDs     func(diffIDs []string) []string
+		wantScanner string
+		// wantGroups are the groups as "<ownership> <layers> <command>: <finding IDs>", in order.
+		wantGroups []string
+	}{
+		{
+			name:        "Trivy report",
+			scanFile:    "trivy.json",
+			wantScanner: "trivy",
+			wantGroups: []string{
+				"non-upstream [2 4] RUN pip install -r requirements.txt: [CVE-2023-30861 CVE-2024-22195]",
+				"upstream [0] ADD rootfs.tar.xz /: [CVE-2022-1304]",
+				"upstream [1] RUN apt-get update && apt-get install -y openssl: [CVE-2022-3602]",
+				"unattributed [] : [CVE-2022-40897]",
+			},
+		},
+		{
+			name:     "Trivy report of an image with other layers",
+			scanFile: "trivy.json",
+			// DiffIDs cannot be matched by position when the scanned image has another number of layers,
+			// so only the findings reported with a layer digest are attributed.
+			diffIDs:     func(diffIDs []string) []string { return diffIDs[:4] },
+			wantScanner: "trivy",
+			wantGroups: []string{
+				"upstream [0] ADD rootfs.tar.xz /: [CVE-2022-1304]",
+				"upstream [1] RUN apt-get update && apt-get install -y openssl: [CVE-2022-3602]",
+				"unattributed [] : [CVE-2023-30861 CVE-2024-22195 CVE-2022-40897]",
+			},
+		},
+		{
+			name:        "Grype report",
+			scanFile:    "grype.json",
+			wantScanner: "grype",
+			wantGroups: []string{
+				"non-upstream [2 4] RUN pip install -r requirements.txt: [CVE-2023-30861 CVE-2023-30861]",
+				"upstream [1] RUN apt-get update && apt-get install -y openssl: [CVE-2022-3602]",
+				"unattributed [] : [CVE-2022-40897]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := loadScanReport(filepath.Join("testdata", tt.scanFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.diffIDs != nil {
+				report.diffIDs = tt.diffIDs(report.diffIDs)
+			}
+
+			triage := triageFindings(lpmManifest, report)
+			if triage.Scanner != tt.wantScanner {
+				t.Errorf("scanner = %q, want %q", triage.Scanner, tt.wantScanner)
+			}
+			if triage.Subject != lpmManifest.Subject.Digest.String() {
+				t.Errorf("subject = %q, want %q", triage.Subject, lpmManifest.Subject.Digest)
+			}
+			groups := make([]string, 0)
+			for _, group := range triage.Groups {
+				ids := make([]string, 0)
+				for _, finding := range group.Findings {
+					ids = append(ids, finding.ID)
+				}
+				groups = append(groups, fmt.Sprintf("%s %v %s: %v", group.Ownership, group.Layers, group.Command, ids))
+			}
+			if !reflect.DeepEqual(groups, tt.wantGroups) {
+				t.Errorf("groups = %q, want %q", groups, tt.wantGroups)
+			}
+		})
+	}
+}
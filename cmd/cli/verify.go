@@ -0,0 +1,293 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	goocispecv1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"oras.land/oras-go/pkg/content"
+)
+
+type verifyCmd struct {
+	stdin           io.Reader
+	stdout          io.Writer
+	stderr          io.Writer
+	registryOptions registryOptions
+	subjectImageRef string
+	trustedKeys     []string
+}
+
+func newVerifyCmd(stdin io.Reader, stdout io.Writer, stderr io.Writer, args []string) *cobra.Command {
+	verifyCmd := &verifyCmd{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	cobraCmd := &cobra.Command{
+		Use:   "verify <lpm-manifest-artifact-ref | lpm-manifest-file>",
+		Short: "verify that an lpm manifest still matches the subject image that it describes (and that it is signed with a trusted key)",
+		Example: `lpm verify \
+[--username 					username] \
+[--password-stdin] \
+--subject-image-ref 			myregistry.myserver.io/myimage:latest (or myimage@digest) \
+[--trusted-key 					lpm-signing-key.pub (or a directory of trusted keys)] \
+myregistry.myserver.io/myimage-lpm:latest (or myimage-lpm@digest, or lpm.json)
+`,
+		Args: cobra.ExactArgs(1),
+		// Drift is reported as an error, which is not a usage error.
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			return verifyCmd.run(args[0])
+		},
+	}
+
+	f := cobraCmd.Flags()
+
+	addRegistryFlags(f, &verifyCmd.registryOptions)
+
+	var subjectImageRefLongFlag = "subject-image-ref"
+	f.StringVarP(&verifyCmd.subjectImageRef, subjectImageRefLongFlag, "s", "", "subject image reference that the lpm manifest is verified against")
+	cobraCmd.MarkFlagRequired(subjectImageRefLongFlag)
+
+	f.StringArrayVar(&verifyCmd.trustedKeys, "trusted-key", []string{}, "(optional) PEM public key or certificate file (or directory of them) trusted to sign lpm manifests, can be repeated; when given, the lpm manifest must have a cosign signature made with a trusted key (default: signatures are not verified)")
+
+	return cobraCmd
+}
+
+func (verifyCmd *verifyCmd) run(refOrFile string) error {
+	// Read the registry password from stdin if needed.
+	if err := verifyCmd.registryOptions.complete(verifyCmd.stdin, registryHost(refOrFile), registryHost(verifyCmd.subjectImageRef)); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// Create a registry store.
+	registry, err := newRegistry(&verifyCmd.registryOptions)
+	if err != nil {
+		return err
+	}
+
+	// Load the lpm manifest (or the lpm manifest of each platform of an lpm index).
+	// An lpm manifest artifact ref is resolved once, and the lpm manifest is fetched by that digest,
+	// so that the verified signatures are those of the lpm manifest that is checked (even if its tag is moved meanwhile).
+	var loaded []loadedLpmManifest
+	var lpmIndex *artifactIndex
+	var lpmDesc ocispecv1.Descriptor
+	lpmRef := refOrFile
+	_, statErr := os.Stat(refOrFile)
+	if statErr == nil {
+		loaded, lpmIndex, err = loadLpmManifests(ctx, registry, refOrFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, lpmDesc, err = registry.Resolve(ctx, refOrFile)
+		if err != nil {
+			return err
+		}
+		repository, err := repositoryOf(refOrFile)
+		if err != nil {
+			return err
+		}
+		lpmRef = fmt.Sprintf("%s@%s", repository, lpmDesc.Digest)
+		b, err := fetchContent(ctx, registry, lpmRef, lpmDesc)
+		if err != nil {
+			return err
+		}
+		loaded, lpmIndex, err = decodeLpmManifests(ctx, registry, lpmRef, b, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Verify the lpm manifest's (or lpm index's) signatures against the trusted keys.
+	// Only lpm manifests in a registry are signed, since an lpm manifest file's content differs from the pushed lpm manifest.
+	if len(verifyCmd.trustedKeys) > 0 {
+		if statErr == nil {
+			return fmt.Errorf("signatures can only be verified for lpm manifest artifact refs, not for lpm manifest file '%s'", refOrFile)
+		}
+		trustedKeys, err := loadTrustedKeys(verifyCmd.trustedKeys)
+		if err != nil {
+			return err
+		}
+		key, err := verifySignatures(ctx, registry, lpmRef, &verifyCmd.registryOptions, lpmDesc, trustedKeys)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(verifyCmd.stdout, "Verified signature of lpm manifest '%s' with trusted key '%s'\n", refOrFile, key.path)
+	}
+
+	drifts, subjectDesc, err := lpmDrifts(ctx, registry, loaded, lpmIndex, verifyCmd.subjectImageRef)
+	if err != nil {
+		return err
+	}
+
+	for _, drift := range drifts {
+		fmt.Fprintf(verifyCmd.stdout, "[!] %s\n", drift)
+	}
+	if len(drifts) > 0 {
+		return fmt.Errorf("lpm manifest '%s' does not match subject image '%s' (%d differences found)", refOrFile, verifyCmd.subjectImageRef, len(drifts))
+	}
+
+	fmt.Fprintf(verifyCmd.stdout, "Verified lpm manifest '%s' against subject image '%s' with digest '%s'\n", refOrFile, verifyCmd.subjectImageRef, subjectDesc.Digest)
+	return nil
+}
+
+// lpmDrifts fetches the subject image manifest (or index) as it is now in the registry,
+// and returns how the lpm manifest (or lpm index) differs from it, together with the subject image's descriptor.
+func lpmDrifts(ctx context.Context, registry *content.Registry, loaded []loadedLpmManifest, lpmIndex *artifactIndex, subjectImageRef string) ([]string, ocispecv1.Descriptor, error) {
+	subjectBytes, subjectDesc, err := fetchManifest(ctx, registry, subjectImageRef)
+	if err != nil {
+		return nil, ocispecv1.Descriptor{}, err
+	}
+
+	if isImageIndex(subjectBytes) {
+		drifts, err := verifyIndex(ctx, registry, loaded, lpmIndex, subjectImageRef, subjectBytes, subjectDesc)
+		return drifts, subjectDesc, err
+	}
+	if lpmIndex != nil {
+		return []string{fmt.Sprintf("lpm index describes a multi-platform image but subject image '%s' is a single-platform image", subjectImageRef)}, subjectDesc, nil
+	}
+	subjectManifest, err := goocispecv1.ParseManifest(bytes.NewReader(subjectBytes))
+	if err != nil {
+		return nil, ocispecv1.Descriptor{}, err
+	}
+	return verifyLpmManifest(loaded[0].manifest, subjectDesc, subjectManifest), subjectDesc, nil
+}
+
+// verifyIndex verifies the lpm manifests of an lpm index against the platform manifests of a multi-platform subject image.
+// Each lpm manifest is verified against the subject image's platform manifest of the same platform
+// (or, for a single lpm manifest, the platform manifest that it refers to as its subject).
+func verifyIndex(ctx context.Context, registry *content.Registry, loaded []loadedLpmManifest, lpmIndex *artifactIndex, subjectImageRef string, subjectIndexBytes []byte, subjectIndexDesc ocispecv1.Descriptor) ([]string, error) {
+	subjectIndex, err := goocispecv1.ParseIndexManifest(bytes.NewReader(subjectIndexBytes))
+	if err != nil {
+		return nil, err
+	}
+	subjectRepository, err := repositoryOf(subjectImageRef)
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := make([]string, 0)
+	if lpmIndex != nil {
+		drifts = append(drifts, verifySubjectDescriptor("lpm index", lpmIndex.Subject, subjectIndexDesc)...)
+	}
+
+	for _, l := range loaded {
+		// Find the subject image's platform manifest that the lpm manifest describes.
+		var subjectManifestDesc *goocispecv1.Descriptor
+		for i, desc := range subjectIndex.Manifests {
+			if l.platform != "" && desc.Platform != nil && platformString(desc.Platform) == l.platform {
+				subjectManifestDesc = &subjectIndex.Manifests[i]
+				break
+			}
+			if l.platform == "" && l.manifest.Subject != nil && desc.Digest.String() == l.manifest.Subject.Digest.String() {
+				subjectManifestDesc = &subjectIndex.Manifests[i]
+				break
+			}
+		}
+		if subjectManifestDesc == nil {
+			drifts = append(drifts, fmt.Sprintf("%s: no matching platform manifest in subject image '%s'", l.source, subjectImageRef))
+			continue
+		}
+
+		// Fetch the platform's subject image manifest by digest.
+		subjectManifestRef := fmt.Sprintf("%s@%s", subjectRepository, subjectManifestDesc.Digest)
+		subjectManifestBytes, err := fetchContent(ctx, registry, subjectManifestRef, toOCIDescriptor(*subjectManifestDesc))
+		if err != nil {
+			return nil, err
+		}
+		subjectManifest, err := goocispecv1.ParseManifest(bytes.NewReader(subjectManifestBytes))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, drift := range verifyLpmManifest(l.manifest, toOCIDescriptor(*subjectManifestDesc), subjectManifest) {
+			if l.platform != "" {
+				drift = fmt.Sprintf("platform '%s': %s", l.platform, drift)
+			}
+			drifts = append(drifts, drift)
+		}
+	}
+
+	return drifts, nil
+}
+
+// verifyLpmManifest compares an lpm manifest with the subject image manifest that it describes,
+// and returns a description of each difference found.
+//
+// The lpm manifest's subject descriptor (if any) must match the subject image manifest's descriptor,
+// and the subject config and each subject layer recorded in the lpm manifest's annotations
+// must match the subject image manifest's config and layers (in the same order).
+func verifyLpmManifest(lpmManifest artifactManifest, subjectDesc ocispecv1.Descriptor, subjectManifest *goocispecv1.Manifest) []string {
+	drifts := make([]string, 0)
+
+	// Verify the subject image manifest.
+	drifts = append(drifts, verifySubjectDescriptor("lpm manifest", lpmManifest.Subject, subjectDesc)...)
+	if mediaType := lpmManifest.Annotations[annotationKeyForSubjectMediaType]; mediaType != "" && mediaType != subjectDesc.MediaType {
+		drifts = append(drifts, fmt.Sprintf("lpm manifest: subject mediaType is '%s' but the subject image manifest's mediaType is '%s'", mediaType, subjectDesc.MediaType))
+	}
+
+	// Verify the subject image config.
+	drifts = append(drifts, verifySubjectAnnotations("config", lpmManifest.Config.Annotations, subjectManifest.Config)...)
+
+	// Verify the subject image layers, from the bottom layer to the top layer.
+	if len(lpmManifest.Layers) != len(subjectManifest.Layers) {
+		drifts = append(drifts, fmt.Sprintf("lpm manifest has %d layers but the subject image manifest has %d layers", len(lpmManifest.Layers), len(subjectManifest.Layers)))
+	}
+	for i := 0; i < len(lpmManifest.Layers) && i < len(subjectManifest.Layers); i++ {
+		drifts = append(drifts, verifySubjectAnnotations(fmt.Sprintf("layer %d", i), lpmManifest.Layers[i].Annotations, subjectManifest.Layers[i])...)
+	}
+
+	return drifts
+}
+
+// verifySubjectDescriptor compares the subject descriptor of an lpm manifest (or lpm index) with the subject image's descriptor.
+// lpm manifests generated before the subject field was recorded have no subject descriptor to compare,
+// so only their subject annotations are compared.
+func verifySubjectDescriptor(what string, lpmSubject *ocispecv1.Descriptor, subjectDesc ocispecv1.Descriptor) []string {
+	if lpmSubject == nil {
+		return []string{}
+	}
+
+	drifts := make([]string, 0)
+	if lpmSubject.Digest != subjectDesc.Digest {
+		drifts = append(drifts, fmt.Sprintf("%s: subject digest is '%s' but the subject image's digest is '%s'", what, lpmSubject.Digest, subjectDesc.Digest))
+	}
+	if lpmSubject.Size != subjectDesc.Size {
+		drifts = append(drifts, fmt.Sprintf("%s: subject size is %d but the subject image's size is %d", what, lpmSubject.Size, subjectDesc.Size))
+	}
+	if lpmSubject.MediaType != subjectDesc.MediaType {
+		drifts = append(drifts, fmt.Sprintf("%s: subject mediaType is '%s' but the subject image's mediaType is '%s'", what, lpmSubject.MediaType, subjectDesc.MediaType))
+	}
+	return drifts
+}
+
+// verifySubjectAnnotations compares the subject digest, size and mediaType annotations of an lpm config or layer descriptor
+// with the subject image's config or layer descriptor.
+func verifySubjectAnnotations(what string, annotations map[string]string, subjectDesc goocispecv1.Descriptor) []string {
+	expected := map[string]string{
+		annotationKeyForSubjectDigest:    subjectDesc.Digest.String(),
+		annotationKeyForSubjectSize:      fmt.Sprint(subjectDesc.Size),
+		annotationKeyForSubjectMediaType: string(subjectDesc.MediaType),
+	}
+
+	drifts := make([]string, 0)
+	for _, key := range []string{annotationKeyForSubjectDigest, annotationKeyForSubjectSize, annotationKeyForSubjectMediaType} {
+		if annotations[key] != expected[key] {
+			drifts = append(drifts, fmt.Sprintf("%s: '%s' is '%s' but the subject image's is '%s'", what, key, annotations[key], expected[key]))
+		}
+	}
+	return drifts
+}
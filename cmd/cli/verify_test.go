@@ -0,0 +1,193 @@
+/*
+Copyright © 2022 Johnson Shi <Johnson.Shi@microsoft.com>
+
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	ocispecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testImageManifest returns an image manifest with a config and the given number of layers, whose digests are made from name.
+func testImageManifest(name string, layers int) artifactManifest {
+	manifest := artifactManifest{Manifest: ocispecv1.Manifest{
+		Config: ocispecv1.Descriptor{MediaType: ocispecv1.MediaTypeImageConfig, Digest: digest.FromString(name + "/config"), Size: 100},
+		Layers: []ocispecv1.Descriptor{},
+	}}
+	for i := 0; i < layers; i++ {
+		manifest.Layers = append(manifest.Layers, ocispecv1.Descriptor{
+			MediaType: ocispecv1.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString(fmt.Sprintf("%s/layer%d", name, i)),
+			Size:      int64(1000 + i),
+		})
+	}
+	return manifest
+}
+
+// testLpmManifest returns the lpm manifest that describes the subject image manifest.
+func testLpmManifest(subject artifactDescriptor, manifest artifactManifest) artifactManifest {
+	subjectAnnotations := func(desc ocispecv1.Descriptor) map[string]string {
+		return map[string]string{
+			annotationKeyForSubjectDigest:    desc.Digest.String(),
+			annotationKeyForSubjectSize:      fmt.Sprint(desc.Size),
+			annotationKeyForSubjectMediaType: desc.MediaType,
+		}
+	}
+	subjectDesc := subject.Descriptor
+	lpmManifest := artifactManifest{
+		Manifest: ocispecv1.Manifest{
+			Config: ocispecv1.Descriptor{MediaType: mediaTypeForConfigLpm, Annotations: subjectAnnotations(manifest.Config)},
+			Layers: []ocispecv1.Descriptor{},
+		},
+		ArtifactType: mediaTypeForManifestLpm,
+		Subject:      &subjectDesc,
+	}
+	for _, layer := range manifest.Layers {
+		lpmManifest.Layers = append(lpmManifest.Layers, ocispecv1.Descriptor{Annotations: subjectAnnotations(layer)})
+	}
+	return lpmManifest
+}
+
+func TestLpmDrifts(t *testing.T) {
+	ctx := context.Background()
+	_, host := newTestRegistry(t, false)
+	remote, err := newRemoteRepository(ctx, host+"/myimage:1", &registryOptions{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := newRegistry(&registryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A single-platform image, and the same image rebuilt with one more layer.
+	image := testImageManifest("image", 2)
+	imageDesc := pushTestManifest(t, remote, "single", image)
+	rebuiltImage := testImageManifest("rebuilt", 3)
+	pushTestManifest(t, remote, "rebuilt", rebuiltImage)
+
+	// A multi-platform image.
+	amd64Image, arm64Image := testImageManifest("amd64", 2), testImageManifest("arm64", 1)
+	amd64Desc, arm64Desc := pushTestManifest(t, remote, "", amd64Image), pushTestManifest(t, remote, "", arm64Image)
+	amd64Desc.Platform = &ocispecv1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64Desc.Platform = &ocispecv1.Platform{OS: "linux", Architecture: "arm64"}
+	indexBytes, indexDesc, err := marshalArtifact(ocispecv1.MediaTypeImageIndex, "", ocispecv1.Index{
+		Versioned: ocispecs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecv1.MediaTypeImageIndex,
+		Manifests: []ocispecv1.Descriptor{amd64Desc.Descriptor, arm64Desc.Descriptor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.pushManifest(ctx, "multi", ocispecv1.MediaTypeImageIndex, indexBytes); err != nil {
+		t.Fatal(err)
+	}
+	indexSubject := indexDesc.Descriptor
+	lpmIndex := &artifactIndex{Subject: &indexSubject}
+
+	// withoutSubject returns the lpm manifest as generated before the subject field was recorded.
+	withoutSubject := func(lpmManifest artifactManifest) artifactManifest {
+		lpmManifest.Subject = nil
+		return lpmManifest
+	}
+
+	tests := []struct {
+		name            string
+		subjectImageRef string
+		loaded          []loadedLpmManifest
+		lpmIndex        *artifactIndex
+		wantDrifts      []string
+	}{
+		{
+			name:            "single-platform image",
+			subjectImageRef: host + "/myimage:single",
+			loaded:          []loadedLpmManifest{{manifest: testLpmManifest(imageDesc, image)}},
+			wantDrifts:      []string{},
+		},
+		{
+			name:            "lpm manifest without subject",
+			subjectImageRef: host + "/myimage:single",
+			loaded:          []loadedLpmManifest{{manifest: withoutSubject(testLpmManifest(imageDesc, image))}},
+			wantDrifts:      []string{},
+		},
+		{
+			name:            "lpm manifest without subject of a rebuilt image",
+			subjectImageRef: host + "/myimage:rebuilt",
+			loaded:          []loadedLpmManifest{{manifest: withoutSubject(testLpmManifest(imageDesc, image))}},
+			wantDrifts:      []string{"config: 'io.azurecr.lpm.v1.subject.digest'", "lpm manifest has 2 layers but the subject image manifest has 3 layers", "layer 0: 'io.azurecr.lpm.v1.subject.digest'", "layer 1: 'io.azurecr.lpm.v1.subject.digest'"},
+		},
+		{
+			name:            "rebuilt single-platform image",
+			subjectImageRef: host + "/myimage:rebuilt",
+			loaded:          []loadedLpmManifest{{manifest: testLpmManifest(imageDesc, image)}},
+			wantDrifts:      []string{"lpm manifest: subject digest", "lpm manifest: subject size", "config: 'io.azurecr.lpm.v1.subject.digest'", "lpm manifest has 2 layers but the subject image manifest has 3 layers", "layer 0: 'io.azurecr.lpm.v1.subject.digest'", "layer 1: 'io.azurecr.lpm.v1.subject.digest'"},
+		},
+		{
+			name:            "lpm index of a single-platform image",
+			subjectImageRef: host + "/myimage:single",
+			loaded:          []loadedLpmManifest{{platform: "linux/amd64", manifest: testLpmManifest(imageDesc, image)}},
+			lpmIndex:        lpmIndex,
+			wantDrifts:      []string{"lpm index describes a multi-platform image"},
+		},
+		{
+			name:            "lpm index of a multi-platform image",
+			subjectImageRef: host + "/myimage:multi",
+			loaded: []loadedLpmManifest{
+				{platform: "linux/amd64", manifest: testLpmManifest(amd64Desc, amd64Image)},
+				{platform: "linux/arm64", manifest: testLpmManifest(arm64Desc, arm64Image)},
+			},
+			lpmIndex:   lpmIndex,
+			wantDrifts: []string{},
+		},
+		{
+			name:            "lpm manifest of a platform of a multi-platform image",
+			subjectImageRef: host + "/myimage:multi",
+			loaded:          []loadedLpmManifest{{manifest: testLpmManifest(arm64Desc, arm64Image)}},
+			wantDrifts:      []string{},
+		},
+		{
+			name:            "lpm index with a platform describing another platform's image",
+			subjectImageRef: host + "/myimage:multi",
+			loaded: []loadedLpmManifest{
+				{platform: "linux/amd64", manifest: testLpmManifest(amd64Desc, amd64Image)},
+				{platform: "linux/arm64", manifest: testLpmManifest(amd64Desc, amd64Image)},
+			},
+			lpmIndex:   lpmIndex,
+			wantDrifts: []string{"platform 'linux/arm64': lpm manifest: subject digest", "platform 'linux/arm64': lpm manifest: subject size", "platform 'linux/arm64': config: 'io.azurecr.lpm.v1.subject.digest'", "platform 'linux/arm64': lpm manifest has 2 layers but the subject image manifest has 1 layers", "platform 'linux/arm64': layer 0: 'io.azurecr.lpm.v1.subject.digest'"},
+		},
+		{
+			name:            "lpm index of a platform missing from the image",
+			subjectImageRef: host + "/myimage:multi",
+			loaded: []loadedLpmManifest{
+				{source: "lpm@sha256:abc", platform: "linux/s390x", manifest: testLpmManifest(amd64Desc, amd64Image)},
+			},
+			lpmIndex:   lpmIndex,
+			wantDrifts: []string{"lpm@sha256:abc: no matching platform manifest"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drifts, _, err := lpmDrifts(ctx, registry, tt.loaded, tt.lpmIndex, tt.subjectImageRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(drifts) != len(tt.wantDrifts) {
+				b, _ := json.MarshalIndent(drifts, "", "\t")
+				t.Fatalf("lpmDrifts() = %d drifts %s, want %d", len(drifts), b, len(tt.wantDrifts))
+			}
+			for i := range drifts {
+				if !strings.HasPrefix(drifts[i], tt.wantDrifts[i]) {
+					t.Errorf("drift %d = %q, want prefix %q", i, drifts[i], tt.wantDrifts[i])
+				}
+			}
+		})
+	}
+}
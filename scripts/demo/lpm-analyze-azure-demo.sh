@@ -18,6 +18,5 @@ mkdir -p ./examples/manifests/lpm-manifests/
     --password 						"${ACR_ACCESS_TOKEN}" \
     --subject-image-ref 			"${ACR_LOGIN_SERVER}/${IMAGE_NAME}:latest" \
     --dockerfile 					"./examples/dockerfiles/${IMAGE_NAME}.dockerfile" \
-    --subject-image-manifest 		"./examples/manifests/subject-image-manifests/${IMAGE_NAME}.json" \
     --lpm-manifest-artifact-ref 	"${ACR_LOGIN_SERVER}/${IMAGE_NAME}-lpm:latest" \
     --output 						"./examples/manifests/lpm-manifests/${IMAGE_NAME}-lpm.json"
@@ -0,0 +1,36 @@
+#!/bin/bash
+
+set -euao pipefail
+
+IMAGE_NAME=${IMAGE_NAME:-"python-layered-simple"}
+
+ACR_ACCESS_TOKEN_OUTPUT=$(az acr login --name "$REGISTRY_NAME" --expose-token)
+ACR_ACCESS_TOKEN_USERNAME="00000000-0000-0000-0000-000000000000"
+ACR_ACCESS_TOKEN=$(echo "$ACR_ACCESS_TOKEN_OUTPUT" | jq --raw-output ".accessToken")
+ACR_LOGIN_SERVER=$(echo "$ACR_ACCESS_TOKEN_OUTPUT" | jq --raw-output ".loginServer")
+
+make build-cli
+
+mkdir -p ./examples/manifests/eol-manifests
+
+./bin/lpm eol set \
+    --username 						"${ACR_ACCESS_TOKEN_USERNAME}" \
+    --password 						"${ACR_ACCESS_TOKEN}" \
+    --date 							"2025-01-01" \
+    --reason 						"end-of-maintenance" \
+    --description 					"This image will no longer be maintained by the maintainer." \
+    --support-url 					"https://docs.microsoft.com/en-us/azure/container-registry/container-registry-eol" \
+    --lpm-manifest-artifact-ref 	"${ACR_LOGIN_SERVER}/${IMAGE_NAME}-eol:latest" \
+    --output 						"./examples/manifests/eol-manifests/${IMAGE_NAME}-eol.json" \
+    "${ACR_LOGIN_SERVER}/${IMAGE_NAME}:latest"
+
+./bin/lpm eol get \
+    --username 						"${ACR_ACCESS_TOKEN_USERNAME}" \
+    --password 						"${ACR_ACCESS_TOKEN}" \
+    "${ACR_LOGIN_SERVER}/${IMAGE_NAME}:latest"
+
+./bin/lpm eol check \
+    --username 						"${ACR_ACCESS_TOKEN_USERNAME}" \
+    --password 						"${ACR_ACCESS_TOKEN}" \
+    --warn-days 					90 \
+    "${ACR_LOGIN_SERVER}/${IMAGE_NAME}:latest"